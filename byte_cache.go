@@ -0,0 +1,102 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+/**
+ByteCache is a cache of []byte key and value; all data of one shard live in a
+single pointer-free ring buffer, so millions of entries cost GC nothing.
+eviction is CLOCK (fifo with second chance for entries read), cheaper than lru
+on a ring but only close to it.
+charge of entry is its encoded size in ring (20 bytes header + key + value).
+*/
+type ByteCache struct {
+	shards         []*ByteCacheShard
+	capacity       uint64
+	num_shard_bits uint // must < 10
+}
+
+func NewByteCache(capacity uint64, num_shard_bits uint) *ByteCache {
+
+	if num_shard_bits >= 10 {
+		panic("num_shard_bits must < 10")
+	}
+
+	if num_shard_bits <= 0 {
+		num_shard_bits = getDefaultCacheShardBits(capacity)
+	}
+
+	cache := &ByteCache{
+		num_shard_bits: num_shard_bits,
+		capacity:       capacity,
+	}
+
+	num_shards := 1 << num_shard_bits
+	per_shard := getPerfShardCapacity(capacity, num_shard_bits)
+	for i := 0; i < num_shards; i++ {
+		cache.shards = append(cache.shards, NewByteCacheShard(per_shard))
+	}
+
+	return cache
+}
+
+func (this *ByteCache) shard(hash uint64) uint64 {
+	if this.num_shard_bits > 0 {
+		return hash >> (64 - this.num_shard_bits)
+	}
+	return 0
+}
+
+/**
+value is copied into cache; return ErrEntryTooLarge if it can't fit in one shard
+*/
+func (this *ByteCache) Set(key, value []byte) error {
+	hash := HashSlice64(key)
+	return this.shards[this.shard(hash)].Set(key, hash, value)
+}
+
+func (this *ByteCache) Get(key []byte) ([]byte, bool) {
+	hash := HashSlice64(key)
+	return this.shards[this.shard(hash)].Get(key, hash)
+}
+
+func (this *ByteCache) Delete(key []byte) bool {
+	hash := HashSlice64(key)
+	return this.shards[this.shard(hash)].Delete(key, hash)
+}
+
+func (this *ByteCache) Prune() {
+	for _, shard := range this.shards {
+		shard.Prune()
+	}
+}
+
+func (this *ByteCache) TotalCharge() uint64 {
+	var total uint64 = 0
+	for _, shard := range this.shards {
+		total += shard.TotalCharge()
+	}
+	return total
+}
+
+func (this *ByteCache) Len() int {
+	total := 0
+	for _, shard := range this.shards {
+		total += shard.Len()
+	}
+	return total
+}
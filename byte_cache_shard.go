@@ -0,0 +1,332 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+/**
+entry layout in ring:
+	| hash 8 | key_len 4 | value_len 4 | flags 4 | key | value |
+*/
+const (
+	byteEntryHeaderSize = 20
+
+	byteEntryDeleted  uint32 = 1 << 0
+	byteEntryAccessed uint32 = 1 << 1
+
+	// max entries moved from head to tail by clock hand for one Set
+	maxSecondChance = 5
+)
+
+var ErrEntryTooLarge = errors.New("entry is larger than shard capacity")
+
+type byteEntryHeader struct {
+	hash      uint64
+	key_len   uint32
+	value_len uint32
+	flags     uint32
+}
+
+func (this *byteEntryHeader) size() uint64 {
+	return byteEntryHeaderSize + uint64(this.key_len) + uint64(this.value_len)
+}
+
+/**
+ByteCacheShard keep all entries in one ring buffer; index only hold logical offsets,
+so GC has nothing to scan. eviction is CLOCK, not lru: oldest entry is at head,
+new entry is append at tail; an entry read since it was written gets a second
+chance and is moved to tail instead of being dropped.
+entries keep their key, every lookup compare it, so keys of the same hash never
+see each other's value.
+*/
+type ByteCacheShard struct {
+	mutex sync.Mutex
+	buf   []byte
+	head  uint64            // logical offset of oldest entry
+	tail  uint64            // logical offset of next entry
+	index map[uint64]uint64 // hash -> logical offset
+	// more entries of a hash already in index; rare, so index stay pointer-free
+	collisions map[uint64][]uint64
+	entries    int
+	usage      uint64 // bytes of live entries
+	scratch    []byte
+}
+
+func NewByteCacheShard(capacity uint64) *ByteCacheShard {
+	return &ByteCacheShard{
+		buf:        make([]byte, capacity),
+		index:      make(map[uint64]uint64),
+		collisions: make(map[uint64][]uint64),
+	}
+}
+
+func (this *ByteCacheShard) Set(key []byte, hash uint64, value []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	hdr := byteEntryHeader{
+		hash:      hash,
+		key_len:   uint32(len(key)),
+		value_len: uint32(len(value)),
+	}
+	size := hdr.size()
+	if size > uint64(len(this.buf)) {
+		return ErrEntryTooLarge
+	}
+
+	if off, ok := this.find(key, hash); ok {
+		this.mark_deleted(off)
+	}
+
+	chances := 0
+	for uint64(len(this.buf))-(this.tail-this.head) < size {
+		if this.evict_head(chances < maxSecondChance) {
+			chances++
+		}
+	}
+
+	this.write_entry(&hdr, key, value)
+	return nil
+}
+
+/**
+return a copy of value; the ring may be overwritten as soon as lock is released
+*/
+func (this *ByteCacheShard) Get(key []byte, hash uint64) ([]byte, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	off, ok := this.find(key, hash)
+	if !ok {
+		return nil, false
+	}
+	hdr := this.read_header(off)
+	if hdr.flags&byteEntryAccessed == 0 {
+		hdr.flags |= byteEntryAccessed
+		this.write_header(off, &hdr)
+	}
+	value := make([]byte, hdr.value_len)
+	this.read_at(off+byteEntryHeaderSize+uint64(hdr.key_len), value)
+	return value, true
+}
+
+func (this *ByteCacheShard) Delete(key []byte, hash uint64) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	off, ok := this.find(key, hash)
+	if !ok {
+		return false
+	}
+	this.mark_deleted(off)
+	return true
+}
+
+func (this *ByteCacheShard) Prune() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.head = 0
+	this.tail = 0
+	this.usage = 0
+	this.entries = 0
+	this.index = make(map[uint64]uint64)
+	this.collisions = make(map[uint64][]uint64)
+}
+
+func (this *ByteCacheShard) TotalCharge() uint64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.usage
+}
+
+func (this *ByteCacheShard) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.entries
+}
+
+/*********** ring method *************/
+
+/**
+clock hand: drop oldest entry; if it was read and second_chance is allowed, it's moved to tail.
+return true if entry is moved.
+*/
+func (this *ByteCacheShard) evict_head(second_chance bool) bool {
+	off := this.head
+	hdr := this.read_header(off)
+	size := hdr.size()
+	this.head += size
+	if hdr.flags&byteEntryDeleted != 0 {
+		return false
+	}
+
+	if second_chance && hdr.flags&byteEntryAccessed != 0 {
+		// head has been advanced, so tail has at least size bytes free
+		if uint64(cap(this.scratch)) < size {
+			this.scratch = make([]byte, size)
+		}
+		entry := this.scratch[:size]
+		this.read_at(off, entry)
+		hdr.flags &^= byteEntryAccessed
+		binary.LittleEndian.PutUint32(entry[16:], hdr.flags)
+		this.index_move(hdr.hash, off, this.tail)
+		this.write_at(this.tail, entry)
+		this.tail += size
+		return true
+	}
+
+	this.index_remove(hdr.hash, off)
+	this.usage -= size
+	return false
+}
+
+func (this *ByteCacheShard) mark_deleted(off uint64) {
+	hdr := this.read_header(off)
+	hdr.flags |= byteEntryDeleted
+	this.write_header(off, &hdr)
+	this.index_remove(hdr.hash, off)
+	this.usage -= hdr.size()
+}
+
+func (this *ByteCacheShard) write_entry(hdr *byteEntryHeader, key, value []byte) {
+	off := this.tail
+	this.write_header(off, hdr)
+	this.write_at(off+byteEntryHeaderSize, key)
+	this.write_at(off+byteEntryHeaderSize+uint64(len(key)), value)
+	this.index_add(hdr.hash, off)
+	this.tail += hdr.size()
+	this.usage += hdr.size()
+}
+
+/*********** index method *************/
+
+/**
+find offset of entry of key; entries of the same hash are told apart by key
+*/
+func (this *ByteCacheShard) find(key []byte, hash uint64) (uint64, bool) {
+	off, ok := this.index[hash]
+	if !ok {
+		return 0, false
+	}
+	if this.key_equal(off, key) {
+		return off, true
+	}
+	for _, off := range this.collisions[hash] {
+		if this.key_equal(off, key) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+func (this *ByteCacheShard) index_add(hash uint64, off uint64) {
+	if _, ok := this.index[hash]; ok {
+		this.collisions[hash] = append(this.collisions[hash], off)
+	} else {
+		this.index[hash] = off
+	}
+	this.entries++
+}
+
+func (this *ByteCacheShard) index_remove(hash uint64, off uint64) {
+	others := this.collisions[hash]
+	if this.index[hash] == off {
+		if len(others) == 0 {
+			delete(this.index, hash)
+		} else {
+			this.index[hash] = others[len(others)-1]
+			others = others[:len(others)-1]
+		}
+	} else {
+		for i := range others {
+			if others[i] == off {
+				others = append(others[:i], others[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(others) == 0 {
+		delete(this.collisions, hash)
+	} else {
+		this.collisions[hash] = others
+	}
+	this.entries--
+}
+
+func (this *ByteCacheShard) index_move(hash uint64, from, to uint64) {
+	if this.index[hash] == from {
+		this.index[hash] = to
+		return
+	}
+	for i, off := range this.collisions[hash] {
+		if off == from {
+			this.collisions[hash][i] = to
+			return
+		}
+	}
+}
+
+func (this *ByteCacheShard) key_equal(off uint64, key []byte) bool {
+	hdr := this.read_header(off)
+	if int(hdr.key_len) != len(key) {
+		return false
+	}
+	p := off + byteEntryHeaderSize
+	n := uint64(len(this.buf))
+	start := p % n
+	if start+uint64(len(key)) <= n {
+		return bytes.Equal(this.buf[start:start+uint64(len(key))], key)
+	}
+	first := n - start
+	return bytes.Equal(this.buf[start:], key[:first]) && bytes.Equal(this.buf[:uint64(len(key))-first], key[first:])
+}
+
+func (this *ByteCacheShard) read_header(off uint64) byteEntryHeader {
+	var raw [byteEntryHeaderSize]byte
+	this.read_at(off, raw[:])
+	return byteEntryHeader{
+		hash:      binary.LittleEndian.Uint64(raw[0:]),
+		key_len:   binary.LittleEndian.Uint32(raw[8:]),
+		value_len: binary.LittleEndian.Uint32(raw[12:]),
+		flags:     binary.LittleEndian.Uint32(raw[16:]),
+	}
+}
+
+func (this *ByteCacheShard) write_header(off uint64, hdr *byteEntryHeader) {
+	var raw [byteEntryHeaderSize]byte
+	binary.LittleEndian.PutUint64(raw[0:], hdr.hash)
+	binary.LittleEndian.PutUint32(raw[8:], hdr.key_len)
+	binary.LittleEndian.PutUint32(raw[12:], hdr.value_len)
+	binary.LittleEndian.PutUint32(raw[16:], hdr.flags)
+	this.write_at(off, raw[:])
+}
+
+func (this *ByteCacheShard) read_at(off uint64, dst []byte) {
+	p := off % uint64(len(this.buf))
+	n := copy(dst, this.buf[p:])
+	copy(dst[n:], this.buf)
+}
+
+func (this *ByteCacheShard) write_at(off uint64, src []byte) {
+	p := off % uint64(len(this.buf))
+	n := copy(this.buf[p:], src)
+	copy(this.buf, src[n:])
+}
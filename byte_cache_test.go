@@ -0,0 +1,133 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestByteCache_SetGetDelete(t *testing.T) {
+	cache := NewByteCache(1024*1024, 2)
+	var total_charge uint64 = 0
+	for _, test_bar := range case_cache {
+		if err := cache.Set(test_bar.key, []byte(test_bar.value)); err != nil {
+			t.Fatalf("set key:%s error:%v", test_bar.key, err)
+		}
+		total_charge += uint64(byteEntryHeaderSize + len(test_bar.key) + len(test_bar.value))
+		value, ok := cache.Get(test_bar.key)
+		if !ok || string(value) != test_bar.value {
+			t.Errorf("set key:%s ,value:%s, got value:%s", test_bar.key, test_bar.value, value)
+		}
+		if cache.TotalCharge() != total_charge {
+			t.Errorf("total charge expected: %v, got: %v", total_charge, cache.TotalCharge())
+		}
+	}
+
+	// overwrite keep one entry
+	cache.Set(case_cache[0].key, []byte("new"))
+	if value, _ := cache.Get(case_cache[0].key); string(value) != "new" {
+		t.Errorf("overwrite expected: new, got: %s", value)
+	}
+	if cache.Len() != len(case_cache) {
+		t.Errorf("len expected: %d, got: %d", len(case_cache), cache.Len())
+	}
+
+	for _, test_bar := range case_cache {
+		if !cache.Delete(test_bar.key) {
+			t.Errorf("delete key:%s not found", test_bar.key)
+		}
+		if _, ok := cache.Get(test_bar.key); ok {
+			t.Errorf("deleted key, still get ok; key:%s", test_bar.key)
+		}
+	}
+	if cache.TotalCharge() != 0 {
+		t.Errorf("total charge after delete expected: 0, got: %v", cache.TotalCharge())
+	}
+}
+
+func TestByteCache_Evict(t *testing.T) {
+	cache := NewByteCache(1024, 1)
+	value := bytes.Repeat([]byte("v"), 30)
+	hot := []byte("hot")
+	cache.Set(hot, value)
+	for i := 0; i < 1000; i++ {
+		key := []byte(strconv.Itoa(i))
+		if err := cache.Set(key, value); err != nil {
+			t.Fatalf("set error:%v", err)
+		}
+		if got, ok := cache.Get(key); !ok || !bytes.Equal(got, value) {
+			t.Fatalf("key:%s lost right after set", key)
+		}
+		// keep reading hot key, second chance keep it in cache
+		cache.Get(hot)
+		if cache.TotalCharge() > 1024 {
+			t.Fatalf("total charge %v over capacity", cache.TotalCharge())
+		}
+	}
+	if _, ok := cache.Get([]byte("0")); ok {
+		t.Errorf("oldest key should be evicted")
+	}
+	if got, ok := cache.Get(hot); !ok || !bytes.Equal(got, value) {
+		t.Errorf("hot key is evicted")
+	}
+
+	if err := cache.Set([]byte("big"), make([]byte, 1024)); err != ErrEntryTooLarge {
+		t.Errorf("expected ErrEntryTooLarge, got: %v", err)
+	}
+
+	cache.Prune()
+	if cache.Len() != 0 || cache.TotalCharge() != 0 {
+		t.Errorf("prune left len:%d charge:%v", cache.Len(), cache.TotalCharge())
+	}
+}
+
+func TestByteCacheShard_HashCollision(t *testing.T) {
+	shard := NewByteCacheShard(1024)
+	// different keys of the same hash live side by side
+	shard.Set([]byte("a"), 42, []byte("va"))
+	shard.Set([]byte("b"), 42, []byte("vb"))
+	shard.Set([]byte("c"), 42, []byte("vc"))
+	for _, key := range []string{"a", "b", "c"} {
+		if value, ok := shard.Get([]byte(key), 42); !ok || string(value) != "v"+key {
+			t.Errorf("key:%s expected: v%s, got: %s", key, key, value)
+		}
+	}
+	if _, ok := shard.Get([]byte("d"), 42); ok {
+		t.Errorf("key of same hash, never set, should miss")
+	}
+	if !shard.Delete([]byte("a"), 42) || shard.Len() != 2 {
+		t.Fatalf("delete of colliding key failed, len: %d", shard.Len())
+	}
+	if value, ok := shard.Get([]byte("c"), 42); !ok || string(value) != "vc" {
+		t.Errorf("c lost after delete of a, got: %s", value)
+	}
+
+	// second chance move colliding entries, they stay reachable
+	for i := 0; i < 100; i++ {
+		shard.Get([]byte("b"), 42)
+		shard.Get([]byte("c"), 42)
+		shard.Set([]byte(strconv.Itoa(i)), uint64(i), bytes.Repeat([]byte("x"), 30))
+	}
+	for _, key := range []string{"b", "c"} {
+		if value, ok := shard.Get([]byte(key), 42); !ok || string(value) != "v"+key {
+			t.Errorf("hot key:%s expected: v%s, got: %s", key, key, value)
+		}
+	}
+}
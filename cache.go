@@ -26,6 +26,19 @@ type DeleteCallback func(key []byte, entry interface{})
 type MergeOperator func(old_entry, new_entry interface{}) interface{}
 type ChargeOperator func(entry interface{}, old_charge, new_charge uint64) uint64
 type TravelEntryOperator func(key []byte, entry interface{})
+type TravelChargeOperator func(key []byte, entry interface{}, charge uint64)
+
+// what Compute do with the entry
+type Action int
+
+const (
+	ActionKeep Action = iota // leave entry as it is, or missing
+	ActionReplace            // insert returned entry and charge
+	ActionDelete             // remove entry
+)
+
+// old is nil and exists false when key is missing
+type ComputeOperator func(old interface{}, exists bool) (entry interface{}, charge uint64, action Action)
 
 type Cache interface {
 	Put(key string, value string)
@@ -35,6 +48,7 @@ type Cache interface {
 	Prune()
 	TotalCharge() uint64
 
+	// charge == 0 means estimate it from entry, see EstimateSize
 	Insert(key[]byte, entry interface{}, charge uint64, deleter DeleteCallback)
 	Lookup(key []byte) interface{}
 	Remove(key []byte) interface{}
@@ -0,0 +1,281 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	Network     string // "tcp" or "unix", default tcp
+	DialTimeout time.Duration
+	IOTimeout   time.Duration
+	PoolSize    int // idle connections kept
+}
+
+func (this *Options) setDefault() {
+	if this.Network == "" {
+		this.Network = "tcp"
+	}
+	if this.DialTimeout == 0 {
+		this.DialTimeout = time.Second
+	}
+	if this.IOTimeout == 0 {
+		this.IOTimeout = 3 * time.Second
+	}
+	if this.PoolSize == 0 {
+		this.PoolSize = 8
+	}
+}
+
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+/**
+Client talk to one lrucached (or redis) server with a pool of connections
+*/
+type Client struct {
+	addr    string
+	options Options
+	mutex   sync.Mutex
+	idle    []*conn
+	closed  bool
+}
+
+func NewClient(addr string, options Options) *Client {
+	options.setDefault()
+	return &Client{addr: addr, options: options}
+}
+
+func (this *Client) Addr() string {
+	return this.addr
+}
+
+func (this *Client) get() (*conn, error) {
+	this.mutex.Lock()
+	if n := len(this.idle); n > 0 {
+		c := this.idle[n-1]
+		this.idle = this.idle[:n-1]
+		this.mutex.Unlock()
+		return c, nil
+	}
+	this.mutex.Unlock()
+	nc, err := net.DialTimeout(this.options.Network, this.addr, this.options.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc, reader: bufio.NewReader(nc), writer: bufio.NewWriter(nc)}, nil
+}
+
+func (this *Client) put(c *conn, err error) {
+	this.mutex.Lock()
+	if err != nil || this.closed || len(this.idle) >= this.options.PoolSize {
+		this.mutex.Unlock()
+		c.Close()
+		return
+	}
+	this.idle = append(this.idle, c)
+	this.mutex.Unlock()
+}
+
+/**
+Do send one command and return its reply; server error reply is returned as RedisError value
+*/
+func (this *Client) Do(args ...[]byte) (interface{}, error) {
+	replies, err := this.Pipeline([][][]byte{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+/**
+Pipeline send all commands at once and read their replies in order
+*/
+func (this *Client) Pipeline(cmds [][][]byte) ([]interface{}, error) {
+	c, err := this.get()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(this.options.IOTimeout))
+	for _, args := range cmds {
+		writeCommand(c.writer, args)
+	}
+	if err = c.writer.Flush(); err != nil {
+		this.put(c, err)
+		return nil, err
+	}
+	replies := make([]interface{}, 0, len(cmds))
+	for len(replies) < len(cmds) {
+		var reply interface{}
+		reply, err = readReply(c.reader)
+		if err != nil {
+			this.put(c, err)
+			return nil, err
+		}
+		if _, ok := reply.(Push); ok {
+			continue
+		}
+		replies = append(replies, reply)
+	}
+	this.put(c, nil)
+	return replies, nil
+}
+
+func (this *Client) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.closed = true
+	for _, c := range this.idle {
+		c.Close()
+	}
+	this.idle = nil
+	return nil
+}
+
+/*********** commands *************/
+
+func (this *Client) Ping() error {
+	return replyError(this.Do([]byte("PING")))
+}
+
+/**
+return nil, nil if key not found
+*/
+func (this *Client) Get(key []byte) ([]byte, error) {
+	return replyBytes(this.Do([]byte("GET"), key))
+}
+
+func (this *Client) Set(key, value []byte) error {
+	return replyError(this.Do([]byte("SET"), key, value))
+}
+
+func (this *Client) Del(keys ...[]byte) (int64, error) {
+	return replyInt(this.Do(append([][]byte{[]byte("DEL")}, keys...)...))
+}
+
+/**
+GetVersioned return value and version of key by GETV; version 0 if key not found
+*/
+func (this *Client) GetVersioned(key []byte) ([]byte, uint64, error) {
+	reply, err := replyArray(this.Do([]byte("GETV"), key))
+	if err != nil || reply == nil {
+		return nil, 0, err
+	}
+	if len(reply) != 2 {
+		return nil, 0, fmt.Errorf("client: unexpected GETV reply of %d elements", len(reply))
+	}
+	value, err := replyBytes(reply[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := replyInt(reply[1], nil)
+	return value, uint64(version), err
+}
+
+/**
+CompareAndSwap set key only if its version is still expected, 0 expect key to be missing;
+return new version, or 0 and false if key was changed
+*/
+func (this *Client) CompareAndSwap(key []byte, expected uint64, value []byte) (uint64, bool, error) {
+	reply, err := this.Do([]byte("CAS"), key, []byte(strconv.FormatUint(expected, 10)), value)
+	if err = replyError(reply, err); err != nil || reply == nil {
+		return 0, false, err
+	}
+	version, err := replyInt(reply, nil)
+	return uint64(version), err == nil, err
+}
+
+/**
+CompareAndDelete delete key only if its version is still expected
+*/
+func (this *Client) CompareAndDelete(key []byte, expected uint64) (bool, error) {
+	n, err := replyInt(this.Do([]byte("CAD"), key, []byte(strconv.FormatUint(expected, 10))))
+	return n == 1, err
+}
+
+func (this *Client) IncrBy(key []byte, delta int64) (int64, error) {
+	return replyInt(this.Do([]byte("INCRBY"), key, []byte(strconv.FormatInt(delta, 10))))
+}
+
+/**
+value of missing key is nil
+*/
+func (this *Client) MGet(keys ...[]byte) ([][]byte, error) {
+	values, err := replyArray(this.Do(append([][]byte{[]byte("MGET")}, keys...)...))
+	if err != nil {
+		return nil, err
+	}
+	res := make([][]byte, len(values))
+	for i, v := range values {
+		if res[i], err = replyBytes(v, nil); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (this *Client) MSet(pairs ...[]byte) error {
+	return replyError(this.Do(append([][]byte{[]byte("MSET")}, pairs...)...))
+}
+
+func (this *Client) Keys(pattern string) ([][]byte, error) {
+	values, err := replyArray(this.Do([]byte("KEYS"), []byte(pattern)))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, len(values))
+	for _, v := range values {
+		key, err := replyBytes(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (this *Client) FlushAll() error {
+	return replyError(this.Do([]byte("FLUSHALL")))
+}
+
+/**
+Info return fields of INFO reply
+*/
+func (this *Client) Info() (map[string]string, error) {
+	reply, err := replyBytes(this.Do([]byte("INFO")))
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, line := range bytes.Split(reply, []byte("\r\n")) {
+		if i := bytes.IndexByte(line, ':'); i > 0 && line[0] != '#' {
+			info[string(line[:i])] = string(line[i+1:])
+		}
+	}
+	return info, nil
+}
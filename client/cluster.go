@@ -0,0 +1,457 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+var ErrNoServers = errors.New("client: no live server")
+
+// key of NewId counter on server
+var idKey = []byte("__lrucache:id")
+
+type ClusterOptions struct {
+	Options
+	Strategy      HashStrategy
+	EjectAfter    int           // consecutive failures before a server is ejected, default 3
+	RetryInterval time.Duration // ping interval of ejected servers, default 1s
+	Codec         lrucache.EntryCodec
+	OnError       func(err error) // errors of Cache methods, which can't return them
+}
+
+/**
+ValueCodec encode string, []byte and integers as is, decode to string
+*/
+type ValueCodec struct{}
+
+func (ValueCodec) Encode(entry interface{}) ([]byte, error) {
+	switch v := entry.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return []byte(strconv.FormatUint(v, 10)), nil
+	}
+	return nil, lrucache.ErrUnsupportedEntry
+}
+
+func (ValueCodec) Decode(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+type clusterNode struct {
+	ServerNode
+	client   *Client
+	failures int32
+	ejected  bool
+}
+
+/**
+Cluster spread keys over servers by HashStrategy and implement lrucache.Cache,
+so application can swap a local LRUCache for remote servers.
+server that fail EjectAfter times in a row is taken out of the ring until it answers PING again.
+*/
+type Cluster struct {
+	nodes   []*clusterNode
+	options ClusterOptions
+
+	mutex   sync.RWMutex
+	live    []*clusterNode
+	locator locator
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewCluster(servers []ServerNode, options ClusterOptions) *Cluster {
+	options.setDefault()
+	if options.EjectAfter == 0 {
+		options.EjectAfter = 3
+	}
+	if options.RetryInterval == 0 {
+		options.RetryInterval = time.Second
+	}
+	if options.Codec == nil {
+		options.Codec = ValueCodec{}
+	}
+	cluster := &Cluster{
+		options: options,
+		stop:    make(chan struct{}),
+	}
+	for _, server := range servers {
+		cluster.nodes = append(cluster.nodes, &clusterNode{
+			ServerNode: server,
+			client:     NewClient(server.Addr, options.Options),
+		})
+	}
+	cluster.rebuild()
+	cluster.wg.Add(1)
+	go cluster.healthLoop()
+	return cluster
+}
+
+func (this *Cluster) Close() error {
+	close(this.stop)
+	this.wg.Wait()
+	for _, node := range this.nodes {
+		node.client.Close()
+	}
+	return nil
+}
+
+/**
+LiveServers return addresses of servers in ring
+*/
+func (this *Cluster) LiveServers() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	var addrs []string
+	for _, node := range this.live {
+		addrs = append(addrs, node.Addr)
+	}
+	return addrs
+}
+
+/**
+Locate return address of server owning key, "" if no server is live
+*/
+func (this *Cluster) Locate(key []byte) string {
+	node := this.pick(key)
+	if node == nil {
+		return ""
+	}
+	return node.Addr
+}
+
+/**
+must hold mutex
+*/
+func (this *Cluster) rebuild() {
+	this.live = this.live[:0]
+	servers := make([]ServerNode, len(this.nodes))
+	live := make([]bool, len(this.nodes))
+	for i, node := range this.nodes {
+		servers[i] = node.ServerNode
+		if !node.ejected {
+			this.live = append(this.live, node)
+			live[i] = true
+		}
+	}
+	// locator is built over all nodes, so ejecting one doesn't move keys of the others
+	this.locator = nil
+	if len(this.live) > 0 {
+		this.locator = newLocator(this.options.Strategy, servers, live)
+	}
+}
+
+func (this *Cluster) pick(key []byte) *clusterNode {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.locator == nil {
+		return nil
+	}
+	return this.nodes[this.locator.locate(key)]
+}
+
+/**
+count network errors of node; error reply of server doesn't count
+*/
+func (this *Cluster) report(node *clusterNode, err error) {
+	if err == nil {
+		atomic.StoreInt32(&node.failures, 0)
+		return
+	}
+	if _, ok := err.(RedisError); ok {
+		return
+	}
+	if atomic.AddInt32(&node.failures, 1) < int32(this.options.EjectAfter) {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !node.ejected {
+		node.ejected = true
+		this.rebuild()
+	}
+}
+
+func (this *Cluster) healthLoop() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.options.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+		this.mutex.RLock()
+		var ejected []*clusterNode
+		for _, node := range this.nodes {
+			if node.ejected {
+				ejected = append(ejected, node)
+			}
+		}
+		this.mutex.RUnlock()
+
+		for _, node := range ejected {
+			if node.client.Ping() != nil {
+				continue
+			}
+			atomic.StoreInt32(&node.failures, 0)
+			this.mutex.Lock()
+			node.ejected = false
+			this.rebuild()
+			this.mutex.Unlock()
+		}
+	}
+}
+
+func (this *Cluster) onError(err error) {
+	if err != nil && this.options.OnError != nil {
+		this.options.OnError(err)
+	}
+}
+
+/*********** byte api *************/
+
+func (this *Cluster) GetBytes(key []byte) ([]byte, error) {
+	node := this.pick(key)
+	if node == nil {
+		return nil, ErrNoServers
+	}
+	value, err := node.client.Get(key)
+	this.report(node, err)
+	return value, err
+}
+
+func (this *Cluster) SetBytes(key, value []byte) error {
+	node := this.pick(key)
+	if node == nil {
+		return ErrNoServers
+	}
+	err := node.client.Set(key, value)
+	this.report(node, err)
+	return err
+}
+
+func (this *Cluster) DelBytes(key []byte) (bool, error) {
+	node := this.pick(key)
+	if node == nil {
+		return false, ErrNoServers
+	}
+	n, err := node.client.Del(key)
+	this.report(node, err)
+	return n > 0, err
+}
+
+/**
+MultiGet fetch keys from all their servers in parallel, one MGET per server;
+missing keys are not in result. result of reachable servers is returned with the first error.
+*/
+func (this *Cluster) MultiGet(keys [][]byte) (map[string][]byte, error) {
+	batches := make(map[*clusterNode][][]byte)
+	for _, key := range keys {
+		node := this.pick(key)
+		if node == nil {
+			return nil, ErrNoServers
+		}
+		batches[node] = append(batches[node], key)
+	}
+
+	var mutex sync.Mutex
+	var first_err error
+	res := make(map[string][]byte, len(keys))
+	var wg sync.WaitGroup
+	for node, batch := range batches {
+		wg.Add(1)
+		go func(node *clusterNode, batch [][]byte) {
+			defer wg.Done()
+			values, err := node.client.MGet(batch...)
+			this.report(node, err)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if first_err == nil {
+					first_err = err
+				}
+				return
+			}
+			for i, value := range values {
+				if value != nil {
+					res[string(batch[i])] = value
+				}
+			}
+		}(node, batch)
+	}
+	wg.Wait()
+	return res, first_err
+}
+
+/*********** lrucache.Cache *************/
+
+func (this *Cluster) Put(key string, value string) {
+	this.onError(this.SetBytes([]byte(key), []byte(value)))
+}
+
+func (this *Cluster) Get(key string) (string, bool) {
+	value, err := this.GetBytes([]byte(key))
+	this.onError(err)
+	if value == nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func (this *Cluster) Delete(key string) {
+	_, err := this.DelBytes([]byte(key))
+	this.onError(err)
+}
+
+/**
+ids come from a counter on the server owning idKey
+*/
+func (this *Cluster) NewId() uint64 {
+	node := this.pick(idKey)
+	if node == nil {
+		this.onError(ErrNoServers)
+		return 0
+	}
+	id, err := node.client.IncrBy(idKey, 1)
+	this.report(node, err)
+	this.onError(err)
+	return uint64(id)
+}
+
+func (this *Cluster) Prune() {
+	for _, node := range this.liveNodes() {
+		err := node.client.FlushAll()
+		this.report(node, err)
+		this.onError(err)
+	}
+}
+
+func (this *Cluster) TotalCharge() uint64 {
+	var total uint64
+	for _, node := range this.liveNodes() {
+		info, err := node.client.Info()
+		this.report(node, err)
+		if err != nil {
+			this.onError(err)
+			continue
+		}
+		used, _ := strconv.ParseUint(info["used_memory"], 10, 64)
+		total += used
+	}
+	return total
+}
+
+/**
+entry is encoded by Codec; charge is computed by server and deleter is never called
+*/
+func (this *Cluster) Insert(key []byte, entry interface{}, charge uint64, deleter lrucache.DeleteCallback) {
+	value, err := this.options.Codec.Encode(entry)
+	if err != nil {
+		this.onError(err)
+		return
+	}
+	this.onError(this.SetBytes(key, value))
+}
+
+func (this *Cluster) Lookup(key []byte) interface{} {
+	value, err := this.GetBytes(key)
+	if err != nil || value == nil {
+		this.onError(err)
+		return nil
+	}
+	entry, err := this.options.Codec.Decode(value)
+	if err != nil {
+		this.onError(err)
+		return nil
+	}
+	return entry
+}
+
+func (this *Cluster) Remove(key []byte) interface{} {
+	old := this.Lookup(key)
+	if old != nil {
+		this.Delete(string(key))
+	}
+	return old
+}
+
+/**
+Merge is a get and set, it's not atomic against other clients
+*/
+func (this *Cluster) Merge(key []byte, entry interface{}, charge uint64, merge_opt lrucache.MergeOperator, charge_opt lrucache.ChargeOperator) (old_entry interface{}) {
+	old := this.Lookup(key)
+	this.Insert(key, merge_opt(old, entry), 0, nil)
+	return old
+}
+
+func (this *Cluster) ApplyToAllCacheEntries(travel_fun lrucache.TravelEntryOperator) {
+	for _, node := range this.liveNodes() {
+		keys, err := node.client.Keys("*")
+		this.report(node, err)
+		if err != nil {
+			this.onError(err)
+			continue
+		}
+		const batch = 100
+		for i := 0; i < len(keys); i += batch {
+			end := i + batch
+			if end > len(keys) {
+				end = len(keys)
+			}
+			values, err := node.client.MGet(keys[i:end]...)
+			this.report(node, err)
+			if err != nil {
+				this.onError(err)
+				break
+			}
+			for j, value := range values {
+				if value == nil {
+					continue
+				}
+				if entry, err := this.options.Codec.Decode(value); err == nil {
+					travel_fun(keys[i+j], entry)
+				}
+			}
+		}
+	}
+}
+
+func (this *Cluster) liveNodes() []*clusterNode {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return append([]*clusterNode(nil), this.live...)
+}
+
+var _ lrucache.Cache = (*Cluster)(nil)
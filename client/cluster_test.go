@@ -0,0 +1,214 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GerSure/lrucache"
+	"github.com/GerSure/lrucache/server"
+)
+
+type testServer struct {
+	addr   string
+	server *server.RESPServer
+}
+
+func startServer(t *testing.T, addr string) *testServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.NewRESPServer(lrucache.NewLRUCache(1024*1024, 1))
+	go srv.Serve(l)
+	return &testServer{addr: l.Addr().String(), server: srv}
+}
+
+func TestLocators(t *testing.T) {
+	nodes := []ServerNode{{Addr: "a", Weight: 1}, {Addr: "b", Weight: 1}, {Addr: "c", Weight: 2}}
+	for _, strategy := range []HashStrategy{Ketama, Jump, Rendezvous} {
+		locator := newLocator(strategy, nodes, nil)
+		counts := make([]int, len(nodes))
+		for i := 0; i < 40000; i++ {
+			counts[locator.locate([]byte(strconv.Itoa(i)))]++
+		}
+		// weight 2 node get about half of keys
+		if counts[2] < 16000 || counts[2] > 24000 || counts[0] < 7000 || counts[1] < 7000 {
+			t.Errorf("strategy %d distribution: %v", strategy, counts)
+		}
+
+		// removing a node only move its own keys
+		smaller := newLocator(strategy, nodes[:2], nil)
+		for i := 0; i < 10000; i++ {
+			key := []byte(strconv.Itoa(i))
+			if before := locator.locate(key); before != 2 && smaller.locate(key) != before {
+				t.Fatalf("strategy %d moved key %s from node %d", strategy, key, before)
+			}
+		}
+
+		// so does ejecting a node from the middle
+		ejected := newLocator(strategy, nodes, []bool{true, false, true})
+		for i := 0; i < 10000; i++ {
+			key := []byte(strconv.Itoa(i))
+			before, after := locator.locate(key), ejected.locate(key)
+			if after == 1 || before != 1 && after != before {
+				t.Fatalf("strategy %d moved key %s from node %d to %d", strategy, key, before, after)
+			}
+		}
+	}
+}
+
+func TestCluster_Cache(t *testing.T) {
+	var servers []*testServer
+	var nodes []ServerNode
+	for i := 0; i < 3; i++ {
+		s := startServer(t, "127.0.0.1:0")
+		defer s.server.Close()
+		servers = append(servers, s)
+		nodes = append(nodes, ServerNode{Addr: s.addr, Weight: 1})
+	}
+	cluster := NewCluster(nodes, ClusterOptions{Strategy: Ketama})
+	defer cluster.Close()
+
+	var cache lrucache.Cache = cluster
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		keys = append(keys, []byte(key))
+		cache.Put(key, "value"+key)
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if value, ok := cache.Get(key); !ok || value != "value"+key {
+			t.Errorf("get key %s, got: %s", key, value)
+		}
+	}
+
+	values, err := cluster.MultiGet(append(keys, []byte("missing")))
+	if err != nil || len(values) != 100 {
+		t.Fatalf("MultiGet got %d values, err: %v", len(values), err)
+	}
+	if string(values["7"]) != "value7" {
+		t.Errorf("MultiGet key 7 got: %s", values["7"])
+	}
+
+	cache.Insert([]byte("int"), int64(41), 0, nil)
+	if old := cache.Remove([]byte("int")); old != "41" {
+		t.Errorf("remove expected old: 41, got: %v", old)
+	}
+	if cache.NewId() >= cache.NewId() {
+		t.Errorf("NewId not increasing")
+	}
+
+	count := 0
+	cache.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		count++
+	})
+	// 100 keys and id counter
+	if count != 101 {
+		t.Errorf("ApplyToAllCacheEntries count expected: 101, got: %d", count)
+	}
+	if cache.TotalCharge() == 0 {
+		t.Errorf("TotalCharge of servers is 0")
+	}
+	cache.Prune()
+	if cache.TotalCharge() != 0 {
+		t.Errorf("TotalCharge after Prune: %d", cache.TotalCharge())
+	}
+}
+
+func TestCluster_EjectAndReadd(t *testing.T) {
+	a := startServer(t, "127.0.0.1:0")
+	defer a.server.Close()
+	b := startServer(t, "127.0.0.1:0")
+
+	cluster := NewCluster([]ServerNode{{Addr: a.addr}, {Addr: b.addr}}, ClusterOptions{
+		EjectAfter:    2,
+		RetryInterval: 20 * time.Millisecond,
+		Options:       Options{DialTimeout: 100 * time.Millisecond},
+	})
+	defer cluster.Close()
+
+	var key []byte
+	for i := 0; ; i++ {
+		key = []byte(strconv.Itoa(i))
+		if cluster.Locate(key) == b.addr {
+			break
+		}
+	}
+
+	b.server.Close()
+	for i := 0; i < 2; i++ {
+		if err := cluster.SetBytes(key, []byte("v")); err == nil {
+			t.Fatalf("set on closed server should fail")
+		}
+	}
+	if live := cluster.LiveServers(); len(live) != 1 || live[0] != a.addr {
+		t.Fatalf("server b should be ejected, live: %v", live)
+	}
+	// key move to a
+	if err := cluster.SetBytes(key, []byte("v")); err != nil {
+		t.Fatalf("set after eject error: %v", err)
+	}
+
+	b = startServer(t, b.addr)
+	defer b.server.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cluster.LiveServers()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server b is not re-added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cluster.Locate(key) != b.addr {
+		t.Errorf("key should move back to b")
+	}
+}
+
+func TestClient_CompareAndSwap(t *testing.T) {
+	s := startServer(t, "127.0.0.1:0")
+	defer s.server.Close()
+	client := NewClient(s.addr, Options{})
+	defer client.Close()
+
+	key := []byte("key")
+	if _, version, err := client.GetVersioned(key); version != 0 || err != nil {
+		t.Fatalf("missing key got version %d, err: %v", version, err)
+	}
+	v1, ok, err := client.CompareAndSwap(key, 0, []byte("a"))
+	if !ok || err != nil {
+		t.Fatalf("create by CAS failed: %v", err)
+	}
+	if _, ok, _ := client.CompareAndSwap(key, 0, []byte("b")); ok {
+		t.Errorf("CAS of existing key with 0 should fail")
+	}
+	client.Set(key, []byte("c"))
+	value, v2, err := client.GetVersioned(key)
+	if string(value) != "c" || v2 <= v1 || err != nil {
+		t.Errorf("GetVersioned got: %s, %d, %v", value, v2, err)
+	}
+	if ok, _ := client.CompareAndDelete(key, v1); ok {
+		t.Errorf("CAD with stale version should fail")
+	}
+	if ok, err := client.CompareAndDelete(key, v2); !ok || err != nil {
+		t.Errorf("CAD failed: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+var (
+	ErrTimeout        = errors.New("client: i/o timeout")
+	ErrConnectionLost = errors.New("client: tracking connection lost")
+)
+
+type NearCacheOptions struct {
+	Options
+	Capacity  uint64 // bytes of local cache, default 64MB
+	ShardBits uint
+	// local copy older than MaxAge is read from server again, bound staleness
+	// even if an invalidation is lost; 0 means no limit
+	MaxAge time.Duration
+}
+
+type NearCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64 // keys invalidated by server
+	Flushes       uint64 // local cache dropped, by FLUSHALL or connection loss
+	Connects      uint64
+}
+
+type nearEntry struct {
+	value   []byte
+	fetched time.Time
+}
+
+/**
+NearCache keep recently read values in a local LRUCache, and use server side
+client tracking (RESP3 push) to drop them when any client change the key.
+reads which miss go through one tracking connection; writes use a pooled Client.
+when the tracking connection is lost, local cache is dropped since invalidations may be lost.
+*/
+type NearCache struct {
+	client  *Client
+	local   *lrucache.LRUCache
+	options NearCacheOptions
+
+	mutex   sync.Mutex
+	tracker *trackingConn
+	closed  bool
+
+	stats NearCacheStats
+}
+
+func NewNearCache(addr string, options NearCacheOptions) *NearCache {
+	options.setDefault()
+	if options.Capacity == 0 {
+		options.Capacity = 64 << 20
+	}
+	return &NearCache{
+		client:  NewClient(addr, options.Options),
+		local:   lrucache.NewLRUCache(options.Capacity, options.ShardBits),
+		options: options,
+	}
+}
+
+/**
+Get return nil, nil if key not found; returned value must not be modified
+*/
+func (this *NearCache) Get(key []byte) ([]byte, error) {
+	if entry, ok := this.local.Lookup(key).(*nearEntry); ok {
+		if this.options.MaxAge == 0 || time.Since(entry.fetched) < this.options.MaxAge {
+			atomic.AddUint64(&this.stats.Hits, 1)
+			return entry.value, nil
+		}
+	}
+	atomic.AddUint64(&this.stats.Misses, 1)
+	tracker, err := this.getTracker()
+	if err != nil {
+		return nil, err
+	}
+	return tracker.get(key, this.options.IOTimeout)
+}
+
+func (this *NearCache) Set(key, value []byte) error {
+	err := this.client.Set(key, value)
+	// server push invalidation too, but our own read after write must not see old value
+	this.local.Remove(key)
+	return err
+}
+
+func (this *NearCache) Del(keys ...[]byte) (int64, error) {
+	n, err := this.client.Del(keys...)
+	for _, key := range keys {
+		this.local.Remove(key)
+	}
+	return n, err
+}
+
+/**
+Client return the client used for writes, commands sent by it keep near cache valid
+*/
+func (this *NearCache) Client() *Client {
+	return this.client
+}
+
+func (this *NearCache) Local() *lrucache.LRUCache {
+	return this.local
+}
+
+func (this *NearCache) Stats() NearCacheStats {
+	return NearCacheStats{
+		Hits:          atomic.LoadUint64(&this.stats.Hits),
+		Misses:        atomic.LoadUint64(&this.stats.Misses),
+		Invalidations: atomic.LoadUint64(&this.stats.Invalidations),
+		Flushes:       atomic.LoadUint64(&this.stats.Flushes),
+		Connects:      atomic.LoadUint64(&this.stats.Connects),
+	}
+}
+
+func (this *NearCache) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	tracker := this.tracker
+	this.tracker = nil
+	this.mutex.Unlock()
+	if tracker != nil {
+		tracker.fail(ErrConnectionLost)
+	}
+	return this.client.Close()
+}
+
+func (this *NearCache) getTracker() (*trackingConn, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return nil, ErrConnectionLost
+	}
+	if this.tracker != nil {
+		return this.tracker, nil
+	}
+	tracker, err := dialTracking(this)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&this.stats.Connects, 1)
+	this.tracker = tracker
+	go tracker.readLoop()
+	return tracker, nil
+}
+
+func (this *NearCache) flush() {
+	atomic.AddUint64(&this.stats.Flushes, 1)
+	this.local.Prune()
+}
+
+/*********** tracking connection *************/
+
+type nearReply struct {
+	value []byte
+	err   error
+}
+
+type nearRequest struct {
+	key   []byte
+	reply chan nearReply
+}
+
+/**
+trackingConn have GET requests in flight and receive invalidate pushes;
+reader goroutine fill local cache in the order server sent replies and pushes,
+so a value is never inserted after the invalidation of it
+*/
+type trackingConn struct {
+	near    *NearCache
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	mutex   sync.Mutex
+	pending []*nearRequest
+	err     error
+}
+
+func dialTracking(near *NearCache) (*trackingConn, error) {
+	options := near.options
+	nc, err := net.DialTimeout(options.Network, near.client.Addr(), options.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	this := &trackingConn{
+		near:   near,
+		conn:   nc,
+		reader: bufio.NewReader(nc),
+		writer: bufio.NewWriter(nc),
+	}
+	nc.SetDeadline(time.Now().Add(options.IOTimeout))
+	writeCommand(this.writer, [][]byte{[]byte("HELLO"), []byte("3")})
+	writeCommand(this.writer, [][]byte{[]byte("CLIENT"), []byte("TRACKING"), []byte("ON")})
+	if err = this.writer.Flush(); err == nil {
+		if err = replyError(readReply(this.reader)); err == nil {
+			err = replyError(readReply(this.reader))
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	// pushes come at any time, requests have their own timeout
+	nc.SetDeadline(time.Time{})
+	return this, nil
+}
+
+func (this *trackingConn) get(key []byte, timeout time.Duration) ([]byte, error) {
+	req := &nearRequest{key: key, reply: make(chan nearReply, 1)}
+	this.mutex.Lock()
+	if this.err != nil {
+		err := this.err
+		this.mutex.Unlock()
+		return nil, err
+	}
+	this.pending = append(this.pending, req)
+	writeCommand(this.writer, [][]byte{[]byte("GET"), key})
+	err := this.writer.Flush()
+	this.mutex.Unlock()
+	if err != nil {
+		this.fail(err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-req.reply:
+		return reply.value, reply.err
+	case <-timer.C:
+		// can't tell which reply is whose anymore
+		this.fail(ErrTimeout)
+		return nil, ErrTimeout
+	}
+}
+
+func (this *trackingConn) readLoop() {
+	for {
+		reply, err := readReply(this.reader)
+		if err != nil {
+			this.fail(err)
+			return
+		}
+		if push, ok := reply.(Push); ok {
+			this.invalidate(push)
+			continue
+		}
+		this.mutex.Lock()
+		if len(this.pending) == 0 {
+			this.mutex.Unlock()
+			this.fail(ErrProtocol)
+			return
+		}
+		req := this.pending[0]
+		this.pending = this.pending[1:]
+		this.mutex.Unlock()
+
+		switch v := reply.(type) {
+		case []byte:
+			key := append([]byte(nil), req.key...)
+			entry := &nearEntry{value: v, fetched: time.Now()}
+			this.near.local.Insert(key, entry, uint64(len(key)+len(v)), nil)
+			req.reply <- nearReply{value: v}
+		case nil:
+			req.reply <- nearReply{}
+		case RedisError:
+			req.reply <- nearReply{err: v}
+		default:
+			req.reply <- nearReply{err: ErrProtocol}
+		}
+	}
+}
+
+/**
+>2 invalidate [keys]; null keys means all
+*/
+func (this *trackingConn) invalidate(push Push) {
+	if len(push) != 2 {
+		return
+	}
+	if kind, ok := push[0].([]byte); !ok || string(kind) != "invalidate" {
+		return
+	}
+	keys, ok := push[1].([]interface{})
+	if !ok {
+		this.near.flush()
+		return
+	}
+	for _, key := range keys {
+		if k, ok := key.([]byte); ok {
+			this.near.local.Remove(k)
+			atomic.AddUint64(&this.near.stats.Invalidations, 1)
+		}
+	}
+}
+
+/**
+fail close connection, fail requests in flight and drop local cache;
+the next Get dial a new tracking connection
+*/
+func (this *trackingConn) fail(err error) {
+	this.mutex.Lock()
+	if this.err != nil {
+		this.mutex.Unlock()
+		return
+	}
+	this.err = err
+	pending := this.pending
+	this.pending = nil
+	this.mutex.Unlock()
+
+	this.conn.Close()
+	near := this.near
+	near.mutex.Lock()
+	if near.tracker == this {
+		near.tracker = nil
+	}
+	near.mutex.Unlock()
+	near.flush()
+	for _, req := range pending {
+		req.reply <- nearReply{err: ErrConnectionLost}
+	}
+}
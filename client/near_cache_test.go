@@ -0,0 +1,126 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestNearCache(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0")
+	defer srv.server.Close()
+
+	near := NewNearCache(srv.addr, NearCacheOptions{})
+	defer near.Close()
+	other := NewClient(srv.addr, Options{})
+	defer other.Close()
+
+	if err := other.Set([]byte("k1"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		value, err := near.Get([]byte("k1"))
+		if err != nil || string(value) != "v1" {
+			t.Fatalf("get k1: %q, %v", value, err)
+		}
+	}
+	if stats := near.Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("expected 2 hits 1 miss, stats: %+v", stats)
+	}
+
+	// write of another client is pushed to near cache
+	if err := other.Set([]byte("k1"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return near.Local().Lookup([]byte("k1")) == nil }) {
+		t.Fatalf("k1 not invalidated, stats: %+v", near.Stats())
+	}
+	if value, _ := near.Get([]byte("k1")); string(value) != "v2" {
+		t.Errorf("expected v2, got %q", value)
+	}
+
+	// own write is visible at once
+	if err := near.Set([]byte("k1"), []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := near.Get([]byte("k1")); string(value) != "v3" {
+		t.Errorf("expected v3, got %q", value)
+	}
+
+	if value, err := near.Get([]byte("missing")); value != nil || err != nil {
+		t.Errorf("missing key: %q, %v", value, err)
+	}
+
+	if err := other.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return near.Stats().Flushes == 1 }) {
+		t.Fatalf("flushall not pushed, stats: %+v", near.Stats())
+	}
+	if value, _ := near.Get([]byte("k1")); value != nil {
+		t.Errorf("expected nil after flushall, got %q", value)
+	}
+}
+
+func TestNearCache_ConnectionLost(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0")
+
+	near := NewNearCache(srv.addr, NearCacheOptions{Options: Options{IOTimeout: 200 * time.Millisecond}})
+	defer near.Close()
+	near.Set([]byte("k"), []byte("v"))
+	if value, _ := near.Get([]byte("k")); string(value) != "v" {
+		t.Fatalf("expected v, got %q", value)
+	}
+
+	// invalidations may be lost with the connection, local copy can't be trusted
+	srv.server.Close()
+	if !waitFor(func() bool { return near.Local().Lookup([]byte("k")) == nil }) {
+		t.Fatalf("local cache not dropped after connection lost")
+	}
+	if _, err := near.Get([]byte("k")); err == nil {
+		t.Errorf("expected error without server")
+	}
+}
+
+func TestNearCache_MaxAge(t *testing.T) {
+	srv := startServer(t, "127.0.0.1:0")
+	defer srv.server.Close()
+
+	near := NewNearCache(srv.addr, NearCacheOptions{MaxAge: 20 * time.Millisecond})
+	defer near.Close()
+	near.Set([]byte("k"), []byte("v"))
+	near.Get([]byte("k"))
+	near.Get([]byte("k"))
+	time.Sleep(30 * time.Millisecond)
+	near.Get([]byte("k"))
+	if stats := near.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("expected 1 hit 2 misses, stats: %+v", stats)
+	}
+}
@@ -0,0 +1,187 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var ErrProtocol = errors.New("client: protocol error")
+
+/**
+RedisError is an error reply of server
+*/
+type RedisError string
+
+func (this RedisError) Error() string {
+	return string(this)
+}
+
+/**
+Push is a RESP3 out of band message, like client tracking invalidation
+*/
+type Push []interface{}
+
+/**
+readReply parse one reply:
+	simple string -> string, error -> RedisError, integer -> int64,
+	bulk string -> []byte, null -> nil, array/map/set -> []interface{} (map is flat), push -> Push
+*/
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '_':
+		return nil, nil
+	case '#':
+		return len(line) > 1 && line[1] == 't', nil
+	case ',':
+		return strconv.ParseFloat(string(line[1:]), 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*', '%', '~', '>':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == '>' {
+			return Push(values), nil
+		}
+		return values, nil
+	}
+	return nil, ErrProtocol
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProtocol
+		}
+		return nil, err
+	}
+	n := len(line) - 1
+	if n > 0 && line[n-1] == '\r' {
+		n--
+	}
+	return line[:n], nil
+}
+
+func writeCommand(w *bufio.Writer, args [][]byte) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(arg)))
+		w.WriteString("\r\n")
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+	return nil
+}
+
+/**
+reply helpers; RedisError reply is returned as error
+*/
+
+func replyError(reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	if e, ok := reply.(RedisError); ok {
+		return e
+	}
+	return nil
+}
+
+func replyBytes(reply interface{}, err error) ([]byte, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("client: unexpected reply type %T", reply)
+}
+
+func replyInt(reply interface{}, err error) (int64, error) {
+	if err = replyError(reply, err); err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	}
+	return 0, fmt.Errorf("client: unexpected reply type %T", reply)
+}
+
+func replyArray(reply interface{}, err error) ([]interface{}, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	if v, ok := reply.([]interface{}); ok || reply == nil {
+		return v, nil
+	}
+	return nil, fmt.Errorf("client: unexpected reply type %T", reply)
+}
@@ -0,0 +1,209 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/GerSure/lrucache"
+)
+
+type HashStrategy int
+
+const (
+	// consistent hash ring, 160 points per weight unit
+	Ketama HashStrategy = iota
+	// jump consistent hash; weight is done by repeating node in buckets
+	Jump
+	// highest random weight
+	Rendezvous
+)
+
+const ketamaPointsPerWeight = 160
+
+type ServerNode struct {
+	Addr   string
+	Weight int // 0 means 1
+}
+
+func (this ServerNode) weight() int {
+	if this.Weight <= 0 {
+		return 1
+	}
+	return this.Weight
+}
+
+/**
+locator map key to index of nodes it's built with, skipping nodes not live.
+live is indexed like nodes, nil means all live; at least one node must be live
+*/
+type locator interface {
+	locate(key []byte) int
+}
+
+func newLocator(strategy HashStrategy, nodes []ServerNode, live []bool) locator {
+	switch strategy {
+	case Jump:
+		return newJumpLocator(nodes, live)
+	case Rendezvous:
+		return newRendezvousLocator(nodes, live)
+	}
+	return newKetamaLocator(nodes, live)
+}
+
+func isLive(live []bool, i int) bool {
+	return live == nil || live[i]
+}
+
+/*********** ketama *************/
+
+type ketamaPoint struct {
+	hash uint32
+	node int
+}
+
+type ketamaLocator struct {
+	points []ketamaPoint
+}
+
+func newKetamaLocator(nodes []ServerNode, live []bool) *ketamaLocator {
+	locator := &ketamaLocator{}
+	for i, node := range nodes {
+		if !isLive(live, i) {
+			continue
+		}
+		for j := 0; j < ketamaPointsPerWeight*node.weight(); j++ {
+			hash := lrucache.HashSlice([]byte(node.Addr + "-" + strconv.Itoa(j)))
+			locator.points = append(locator.points, ketamaPoint{hash: hash, node: i})
+		}
+	}
+	sort.Slice(locator.points, func(i, j int) bool {
+		a, b := locator.points[i], locator.points[j]
+		return a.hash < b.hash || a.hash == b.hash && a.node < b.node
+	})
+	return locator
+}
+
+func (this *ketamaLocator) locate(key []byte) int {
+	hash := lrucache.HashSlice(key)
+	i := sort.Search(len(this.points), func(i int) bool { return this.points[i].hash >= hash })
+	if i == len(this.points) {
+		i = 0
+	}
+	return this.points[i].node
+}
+
+/*********** jump *************/
+
+// rehash of a key landing on buckets of dead nodes, before falling back to a scan
+const jumpMaxRehash = 32
+
+/**
+buckets of jump hash are positions, so they are always built over all nodes:
+dropping a node from the middle would renumber buckets after it and move their keys.
+key landing on a dead node is rehashed until it lands on a live one,
+keys of live nodes never move.
+*/
+type jumpLocator struct {
+	buckets []int
+	live    []bool
+}
+
+func newJumpLocator(nodes []ServerNode, live []bool) *jumpLocator {
+	locator := &jumpLocator{live: live}
+	for i, node := range nodes {
+		for j := 0; j < node.weight(); j++ {
+			locator.buckets = append(locator.buckets, i)
+		}
+	}
+	return locator
+}
+
+func (this *jumpLocator) locate(key []byte) int {
+	hash := lrucache.HashSlice64(key)
+	bucket := jumpHash(hash, len(this.buckets))
+	for i := 0; i < jumpMaxRehash; i++ {
+		if node := this.buckets[bucket]; isLive(this.live, node) {
+			return node
+		}
+		hash = jumpRehash(hash)
+		bucket = jumpHash(hash, len(this.buckets))
+	}
+	for i := range this.buckets {
+		if node := this.buckets[(bucket+i)%len(this.buckets)]; isLive(this.live, node) {
+			return node
+		}
+	}
+	return this.buckets[bucket]
+}
+
+/**
+splitmix64 finalizer
+*/
+func jumpRehash(hash uint64) uint64 {
+	hash += 0x9e3779b97f4a7c15
+	hash = (hash ^ hash>>30) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ hash>>27) * 0x94d049bb133111eb
+	return hash ^ hash>>31
+}
+
+/**
+Lamping and Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm"
+*/
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+/*********** rendezvous *************/
+
+type rendezvousLocator struct {
+	nodes []ServerNode
+	live  []bool
+}
+
+func newRendezvousLocator(nodes []ServerNode, live []bool) *rendezvousLocator {
+	return &rendezvousLocator{nodes: nodes, live: live}
+}
+
+/**
+weighted rendezvous: score = -weight / ln(u), u is hash of node and key in (0, 1)
+*/
+func (this *rendezvousLocator) locate(key []byte) int {
+	best, best_score := 0, math.Inf(-1)
+	buf := make([]byte, 0, 64)
+	for i, node := range this.nodes {
+		if !isLive(this.live, i) {
+			continue
+		}
+		buf = append(append(buf[:0], node.Addr...), key...)
+		u := (float64(lrucache.HashSlice64(buf)>>11) + 0.5) / (1 << 53)
+		score := -float64(node.weight()) / math.Log(u)
+		if score > best_score {
+			best, best_score = i, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,81 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// lrucached serve a LRUCache over redis or memcached protocol, so stock clients can use it.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/GerSure/lrucache"
+	"github.com/GerSure/lrucache/server"
+)
+
+type protocolServer interface {
+	ListenAndServe(network, addr string) error
+	Close() error
+}
+
+func main() {
+	protocol := flag.String("protocol", "redis", "redis or memcache")
+	addr := flag.String("addr", "127.0.0.1:6379", "tcp address to listen, empty to disable")
+	unix := flag.String("unix", "", "unix socket path to listen")
+	capacity := flag.Uint64("capacity", 1024*1024*1024, "cache capacity in bytes")
+	shard_bits := flag.Uint("shard-bits", 0, "log2 of shard number, 0 choose by capacity")
+	flag.Parse()
+
+	if *addr == "" && *unix == "" {
+		log.Fatal("nothing to listen, set -addr or -unix")
+	}
+
+	cache := lrucache.NewLRUCache(*capacity, *shard_bits)
+	var srv protocolServer
+	switch *protocol {
+	case "redis":
+		srv = server.NewRESPServer(cache)
+	case "memcache":
+		srv = server.NewMemcacheServer(cache)
+	default:
+		log.Fatalf("unknown protocol: %s", *protocol)
+	}
+
+	serve := func(network, address string) {
+		log.Printf("lrucached serve %s protocol on %s %s", *protocol, network, address)
+		if err := srv.ListenAndServe(network, address); err != nil && err != server.ErrServerClosed {
+			log.Fatalf("listen on %s %s error: %v", network, address, err)
+		}
+	}
+	if *addr != "" {
+		go serve("tcp", *addr)
+	}
+	if *unix != "" {
+		os.Remove(*unix)
+		go serve("unix", *unix)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	srv.Close()
+	if *unix != "" {
+		os.Remove(*unix)
+	}
+}
@@ -0,0 +1,198 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+)
+
+// index 0 of handles is never used, it means "no handle" in slots
+const compactNil uint32 = 0
+
+// open addressing slot; idx == compactNil means empty
+type compactSlot struct {
+	hash uint32
+	idx  uint32
+}
+
+/**
+CompactHandleTable index handles by open addressing on cached hash instead of
+next_hash chains: slots hold only hash and position in handles, a probe compare
+hashes in one flat array and load a handle only when its hash match.
+slots have no pointer, so gc skip them; handles still keep one pointer per entry.
+*/
+type CompactHandleTable struct {
+	handles []*LRUHandle
+	free    []uint32 // unused positions of handles
+	slots   []compactSlot
+	elems   uint32
+}
+
+func NewCompactHandleTable() *CompactHandleTable {
+	table := &CompactHandleTable{
+		handles: make([]*LRUHandle, 1, 16),
+	}
+	table.Resize()
+	return table
+}
+
+func (this *CompactHandleTable) Lookup(key []byte, hash uint32) *LRUHandle {
+	pos, found := this.findSlot(key, hash)
+	if !found {
+		return nil
+	}
+	return this.handles[this.slots[pos].idx]
+}
+
+/**
+	when not find return nil;
+	else replace handle and return old handle
+ */
+func (this *CompactHandleTable) Insert(e *LRUHandle) *LRUHandle {
+	pos, found := this.findSlot(e.key, e.hash)
+	if found {
+		idx := this.slots[pos].idx
+		old := this.handles[idx]
+		this.handles[idx] = e
+		return old
+	}
+	this.slots[pos] = compactSlot{hash: e.hash, idx: this.alloc(e)}
+	this.elems++
+	// keep load factor < 0.75
+	if this.elems*4 > uint32(len(this.slots))*3 {
+		this.Resize()
+	}
+	return nil
+}
+
+func (this *CompactHandleTable) Remove(key []byte, hash uint32) *LRUHandle {
+	pos, found := this.findSlot(key, hash)
+	if !found {
+		return nil
+	}
+	idx := this.slots[pos].idx
+	e := this.handles[idx]
+	this.removeSlot(pos)
+	this.release(idx)
+	this.elems--
+	return e
+}
+
+func (this *CompactHandleTable) Resize() {
+	var new_length uint32 = 16
+	for new_length*3 < this.elems*4+4 {
+		new_length *= 2
+	}
+
+	old := this.slots
+	this.slots = make([]compactSlot, new_length)
+	mask := new_length - 1
+	for _, s := range old {
+		if s.idx == compactNil {
+			continue
+		}
+		i := s.hash & mask
+		for this.slots[i].idx != compactNil {
+			i = (i + 1) & mask
+		}
+		this.slots[i] = s
+	}
+}
+
+func (this *CompactHandleTable) ApplyToAllCacheEntries(travel_fun TravelEntryOperator) {
+	this.ApplyToAllHandles(func(h *LRUHandle) {
+		travel_fun(h.key, h.entry)
+	})
+}
+
+func (this *CompactHandleTable) ApplyToAllHandles(travel_fun func(h *LRUHandle)) {
+	for _, h := range this.handles {
+		if h != nil {
+			travel_fun(h)
+		}
+	}
+}
+
+/**
+put handle at an unused position of handles
+*/
+func (this *CompactHandleTable) alloc(e *LRUHandle) uint32 {
+	if n := len(this.free); n > 0 {
+		idx := this.free[n-1]
+		this.free = this.free[:n-1]
+		this.handles[idx] = e
+		return idx
+	}
+	this.handles = append(this.handles, e)
+	return uint32(len(this.handles) - 1)
+}
+
+func (this *CompactHandleTable) release(idx uint32) {
+	this.handles[idx] = nil
+	this.free = append(this.free, idx)
+}
+
+func (this *CompactHandleTable) findSlot(key []byte, hash uint32) (uint32, bool) {
+	mask := uint32(len(this.slots)) - 1
+	i := hash & mask
+	for {
+		s := this.slots[i]
+		if s.idx == compactNil {
+			return i, false
+		}
+		if s.hash == hash && bytes.Equal(this.handles[s.idx].key, key) {
+			return i, true
+		}
+		i = (i + 1) & mask
+	}
+}
+
+/**
+backward shift deletion, so no tombstone is left in slots
+*/
+func (this *CompactHandleTable) removeSlot(pos uint32) {
+	mask := uint32(len(this.slots)) - 1
+	i, j := pos, pos
+	for {
+		j = (j + 1) & mask
+		if this.slots[j].idx == compactNil {
+			break
+		}
+		k := this.slots[j].hash & mask
+		// slot j can stay if its home k is cyclically in (i, j]
+		if (i <= j && i < k && k <= j) || (i > j && (i < k || k <= j)) {
+			continue
+		}
+		this.slots[i] = this.slots[j]
+		i = j
+	}
+	this.slots[i] = compactSlot{}
+}
+
+/*********** LRUCache *************/
+
+/**
+NewCompactLRUCache is NewLRUCache with shards indexed by CompactHandleTable
+*/
+func NewCompactLRUCache(capacity uint64, num_shard_bits uint) *LRUCache {
+	cache := NewLRUCache(capacity, num_shard_bits)
+	for _, shard := range cache.shards {
+		shard.table = NewCompactHandleTable()
+	}
+	return cache
+}
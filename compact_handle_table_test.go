@@ -0,0 +1,99 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestCompactLRUCache_InsertLookupRemove(t *testing.T) {
+	var _ Cache = NewCompactLRUCache(1024, 1)
+
+	var total_charge uint64 = 0
+	var deleted = 0
+	lru := NewCompactLRUCache(1024*1024, 1)
+	for _, test_bar := range case_cache {
+		lru.Insert(test_bar.key, test_bar.value, test_bar.charge, func(key []byte, entry interface{}) {
+			deleted++
+		})
+		total_charge += test_bar.charge
+		origin, _ := lru.Lookup(test_bar.key).(string)
+		if origin != test_bar.value {
+			t.Errorf("put key: %s ,value : %s, got value : %s", test_bar.key, test_bar.value, origin)
+		}
+		if lru.TotalCharge() != total_charge {
+			t.Errorf("total charge expected: %v, got: %v", total_charge, lru.TotalCharge())
+		}
+	}
+
+	for _, test_bar := range case_cache {
+		origin, _ := lru.Remove(test_bar.key).(string)
+		total_charge -= test_bar.charge
+		if origin != test_bar.value {
+			t.Errorf("remove key: %s ,value : %s, got value : %s", test_bar.key, test_bar.value, origin)
+		}
+		if lru.TotalCharge() != total_charge {
+			t.Errorf("total charge expected: %v, got: %v", total_charge, lru.TotalCharge())
+		}
+	}
+	if deleted != len(case_cache) {
+		t.Errorf("deleter called %d times, expected: %d", deleted, len(case_cache))
+	}
+}
+
+/**
+same operations on LRUCache and CompactLRUCache must give same result
+*/
+func TestCompactLRUCache_SameAsLRUCache(t *testing.T) {
+	lru := NewLRUCache(2000, 1)
+	compact := NewCompactLRUCache(2000, 1)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := []byte(strconv.Itoa(rnd.Intn(500)))
+		switch rnd.Intn(4) {
+		case 0, 1:
+			charge := uint64(rnd.Intn(20) + 1)
+			lru.Insert(key, i, charge, nil)
+			compact.Insert(key, i, charge, nil)
+		case 2:
+			a, a_version := lru.LookupVersioned(key)
+			b, b_version := compact.LookupVersioned(key)
+			if a != b || a_version != b_version {
+				t.Fatalf("lookup key:%s, lru:%v@%d, compact:%v@%d", key, a, a_version, b, b_version)
+			}
+		case 3:
+			if a, b := lru.Remove(key), compact.Remove(key); a != b {
+				t.Fatalf("remove key:%s, lru:%v, compact:%v", key, a, b)
+			}
+		}
+		if lru.TotalCharge() != compact.TotalCharge() {
+			t.Fatalf("total charge lru:%v, compact:%v", lru.TotalCharge(), compact.TotalCharge())
+		}
+	}
+
+	compact.Prune()
+	var count = 0
+	compact.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		count++
+	})
+	if count != 0 || compact.TotalCharge() != 0 {
+		t.Errorf("prune left %d entries, charge:%v", count, compact.TotalCharge())
+	}
+}
@@ -0,0 +1,211 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"time"
+)
+
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Compressor of stdlib compress/flate; zero value use flate.DefaultCompression
+type FlateCompressor struct {
+	Level int
+}
+
+func (this FlateCompressor) Compress(data []byte) ([]byte, error) {
+	level := this.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this FlateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type CompressionStats struct {
+	CompressedEntries uint64 // entries compressed now
+	Compressions      uint64
+	Decompressions    uint64
+	RawBytes          uint64 // encoded bytes given to compressor
+	CompressedBytes   uint64 // bytes compressor returned
+	CompressNanos     uint64
+	DecompressNanos   uint64
+	Errors            uint64 // entries failed to decompress or decode, they are dropped
+}
+
+// RawBytes / CompressedBytes, 0 if nothing is compressed
+func (this CompressionStats) Ratio() float64 {
+	if this.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(this.RawBytes) / float64(this.CompressedBytes)
+}
+
+func (this *CompressionStats) add(other *CompressionStats) {
+	this.CompressedEntries += other.CompressedEntries
+	this.Compressions += other.Compressions
+	this.Decompressions += other.Decompressions
+	this.RawBytes += other.RawBytes
+	this.CompressedBytes += other.CompressedBytes
+	this.CompressNanos += other.CompressNanos
+	this.DecompressNanos += other.DecompressNanos
+	this.Errors += other.Errors
+}
+
+/*********** compressed tier method of shard *************/
+
+/**
+entries after cold_boundary are hot; when hot usage grows over
+(1-cold_ratio)*capacity, oldest hot entries become cold and are compressed.
+*/
+func (this *LRUCacheShard) maybe_compress() {
+	if this.compressor == nil {
+		return
+	}
+	hot_limit := uint64(float64(this.capacity) * (1 - this.cold_ratio))
+	for this.hot_usage > hot_limit && this.cold_boundary.next != &this.lrulist {
+		e := this.cold_boundary.next
+		e.cold = true
+		this.hot_usage -= e.charge
+		this.cold_boundary = e
+		this.compress_handle(e)
+	}
+}
+
+/**
+entry is replaced by compressed | charge 8 | codec data |; entry codec can't encode stay as it is
+*/
+func (this *LRUCacheShard) compress_handle(e *LRUHandle) {
+	// dirty entries keep their charge until they are clean
+	if e.dirty || isTombstone(e.entry) {
+		return
+	}
+	raw, err := encodeSecondaryValue(this.tier_codec, e.entry, this.user_charge(e))
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	data, err := this.compressor.Compress(raw)
+	this.compression.CompressNanos += uint64(time.Since(start))
+	if err != nil {
+		return
+	}
+	this.compression.Compressions++
+	this.compression.RawBytes += uint64(len(raw))
+	this.compression.CompressedBytes += uint64(len(data))
+	this.compression.CompressedEntries++
+
+	charge := uint64(len(data))
+	if this.metadata_charge_policy == FullChargeCacheMetadata {
+		charge += metadataCharge(e.key)
+	}
+	this.usage -= e.charge
+	this.usage += charge
+	e.entry = data
+	e.charge = charge
+	e.compressed = true
+}
+
+/**
+restore entry and charge of compressed handle in place; a corrupt one is dropped,
+return false then
+*/
+func (this *LRUCacheShard) decompress_handle(e *LRUHandle) bool {
+	entry, charge, err := this.decompress_value(e)
+	if err != nil {
+		this.compression.Errors++
+		this.drop_corrupt(e)
+		return false
+	}
+	this.compression.Decompressions++
+	this.compression.CompressedEntries--
+	if this.metadata_charge_policy == FullChargeCacheMetadata {
+		charge += metadataCharge(e.key)
+	}
+	this.usage -= e.charge
+	this.usage += charge
+	e.entry = entry
+	e.charge = charge
+	e.compressed = false
+	return true
+}
+
+/**
+drop_corrupt remove compressed e which can't be restored; deleter and watchers get nil entry
+*/
+func (this *LRUCacheShard) drop_corrupt(e *LRUHandle) {
+	this.compression.CompressedEntries--
+	e.entry = nil
+	e.compressed = false
+	this.lru_remove_handle(e, true, reasonRemoved)
+}
+
+/**
+corrupt is whether handle_value failed to restore compressed e
+*/
+func corrupt(e *LRUHandle, entry interface{}) bool {
+	return e.compressed && entry == nil
+}
+
+/**
+return entry and charge (without metadata) of handle, decompress a copy if it's compressed;
+entry is nil if that failed
+*/
+func (this *LRUCacheShard) handle_value(e *LRUHandle) (interface{}, uint64) {
+	if !e.compressed {
+		return e.entry, this.user_charge(e)
+	}
+	entry, charge, err := this.decompress_value(e)
+	if err != nil {
+		this.compression.Errors++
+		return nil, 0
+	}
+	return entry, charge
+}
+
+func (this *LRUCacheShard) decompress_value(e *LRUHandle) (interface{}, uint64, error) {
+	start := time.Now()
+	raw, err := this.compressor.Decompress(e.entry.([]byte))
+	this.compression.DecompressNanos += uint64(time.Since(start))
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeSecondaryValue(this.tier_codec, raw)
+}
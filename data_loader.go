@@ -0,0 +1,299 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrBatchResults = errors.New("lrucache: batch loader returned wrong number of results")
+
+/**
+BatchResult is what BatchLoader found for one key. nil Entry and nil Err means
+key doesn't exist, it's cached as a tombstone; charge 0 means estimate it
+*/
+type BatchResult struct {
+	Entry  interface{}
+	Charge uint64
+	Err    error
+}
+
+/**
+BatchLoader load keys in one call, results in order of keys;
+an error fails every key of the batch
+*/
+type BatchLoader func(keys [][]byte) ([]BatchResult, error)
+
+type DataLoaderOptions struct {
+	Wait     time.Duration // how long the first miss of a batch wait for others, default 1ms
+	MaxBatch int           // batch is loaded at once when it has so many keys, default 100
+}
+
+type DataLoaderStats struct {
+	Hits        uint64 // values and tombstones found in cache
+	Misses      uint64
+	Deduped     uint64 // misses joined a load of the same key
+	Batches     uint64
+	BatchedKeys uint64
+	Errors      uint64 // keys failed by their own or their batch error
+}
+
+type dataLoaderStats struct {
+	hits, misses, deduped, batches, batched_keys, errors uint64
+}
+
+type batchCall struct {
+	key   []byte
+	token uint64 // 0 if another caller of cache hold the lease
+	done  chan struct{}
+	entry interface{}
+	err   error
+}
+
+type batch struct {
+	calls      []*batchCall
+	dispatched bool
+}
+
+/**
+DataLoader collect misses of Load calls made within Wait, and load them by one
+BatchLoader call, like the dataloader of graphql. results are cached with leases,
+so keys changed or removed during the load are not overwritten.
+*/
+type DataLoader struct {
+	cache   *LRUCache
+	loader  BatchLoader
+	options DataLoaderOptions
+
+	mutex   sync.Mutex
+	current *batch
+	calls   map[string]*batchCall // queued or loading
+
+	stats dataLoaderStats
+}
+
+func NewDataLoader(cache *LRUCache, loader BatchLoader, options DataLoaderOptions) *DataLoader {
+	if options.Wait <= 0 {
+		options.Wait = time.Millisecond
+	}
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = 100
+	}
+	return &DataLoader{
+		cache:   cache,
+		loader:  loader,
+		options: options,
+		calls:   make(map[string]*batchCall),
+	}
+}
+
+/**
+Load return cached entry of key, or load it in the next batch.
+(nil, nil) means key doesn't exist
+*/
+func (this *DataLoader) Load(key []byte) (interface{}, error) {
+	entry, call := this.enqueue(key)
+	if call == nil {
+		return unwrapTombstone(entry)
+	}
+	<-call.done
+	return call.entry, call.err
+}
+
+/**
+LoadMany is Load of every key, queued together so they share batches
+*/
+func (this *DataLoader) LoadMany(keys [][]byte) ([]interface{}, []error) {
+	entries := make([]interface{}, len(keys))
+	errs := make([]error, len(keys))
+	calls := make([]*batchCall, len(keys))
+	for i, key := range keys {
+		entries[i], calls[i] = this.enqueue(key)
+		if calls[i] == nil {
+			entries[i], errs[i] = unwrapTombstone(entries[i])
+		}
+	}
+	for i, call := range calls {
+		if call != nil {
+			<-call.done
+			entries[i], errs[i] = call.entry, call.err
+		}
+	}
+	return entries, errs
+}
+
+func (this *DataLoader) Cache() *LRUCache {
+	return this.cache
+}
+
+func (this *DataLoader) Stats() DataLoaderStats {
+	return DataLoaderStats{
+		Hits:        atomic.LoadUint64(&this.stats.hits),
+		Misses:      atomic.LoadUint64(&this.stats.misses),
+		Deduped:     atomic.LoadUint64(&this.stats.deduped),
+		Batches:     atomic.LoadUint64(&this.stats.batches),
+		BatchedKeys: atomic.LoadUint64(&this.stats.batched_keys),
+		Errors:      atomic.LoadUint64(&this.stats.errors),
+	}
+}
+
+/**
+enqueue return cached entry, or the call which will have it
+*/
+func (this *DataLoader) enqueue(key []byte) (interface{}, *batchCall) {
+	if call := this.join(key); call != nil {
+		return nil, call
+	}
+	entry, token, status := this.cache.LookupOrLease(key)
+	if status == LeaseHit {
+		atomic.AddUint64(&this.stats.hits, 1)
+		return entry, nil
+	}
+
+	this.mutex.Lock()
+	if call, ok := this.calls[string(key)]; ok {
+		// queued while we looked up
+		this.mutex.Unlock()
+		if token != 0 {
+			this.cache.ReleaseLease(key, token)
+		}
+		atomic.AddUint64(&this.stats.misses, 1)
+		atomic.AddUint64(&this.stats.deduped, 1)
+		return nil, call
+	}
+	atomic.AddUint64(&this.stats.misses, 1)
+	call := &batchCall{
+		key:   append([]byte(nil), key...),
+		token: token,
+		done:  make(chan struct{}),
+	}
+	this.calls[string(key)] = call
+	b := this.current
+	if b == nil {
+		b = &batch{}
+		this.current = b
+		time.AfterFunc(this.options.Wait, func() {
+			this.dispatch(b)
+		})
+	}
+	b.calls = append(b.calls, call)
+	full := len(b.calls) >= this.options.MaxBatch
+	if full {
+		this.current = nil
+	}
+	this.mutex.Unlock()
+
+	if full {
+		go this.dispatch(b)
+	}
+	return nil, call
+}
+
+/**
+join return queued or loading call of key, nil if there is none
+*/
+func (this *DataLoader) join(key []byte) *batchCall {
+	this.mutex.Lock()
+	call := this.calls[string(key)]
+	this.mutex.Unlock()
+	if call != nil {
+		atomic.AddUint64(&this.stats.misses, 1)
+		atomic.AddUint64(&this.stats.deduped, 1)
+	}
+	return call
+}
+
+/**
+dispatch load batch b once, when it's full or its Wait passed
+*/
+func (this *DataLoader) dispatch(b *batch) {
+	this.mutex.Lock()
+	if this.current == b {
+		this.current = nil
+	}
+	if b.dispatched {
+		this.mutex.Unlock()
+		return
+	}
+	b.dispatched = true
+	this.mutex.Unlock()
+
+	keys := make([][]byte, len(b.calls))
+	for i, call := range b.calls {
+		keys[i] = call.key
+	}
+	atomic.AddUint64(&this.stats.batches, 1)
+	atomic.AddUint64(&this.stats.batched_keys, uint64(len(keys)))
+	results, err := this.load(keys)
+	if err == nil && len(results) != len(keys) {
+		err = ErrBatchResults
+	}
+
+	for i, call := range b.calls {
+		if err != nil {
+			call.err = err
+		} else {
+			call.entry, call.err = results[i].Entry, results[i].Err
+		}
+		switch {
+		case call.err != nil:
+			atomic.AddUint64(&this.stats.errors, 1)
+			if call.token != 0 {
+				this.cache.ReleaseLease(call.key, call.token)
+			}
+		case call.token == 0:
+			// somebody else is loading it for the cache
+		case call.entry == nil:
+			this.cache.InsertNotFoundWithLease(call.key, call.token)
+		default:
+			this.cache.InsertWithLease(call.key, call.token, call.entry, results[i].Charge, nil)
+		}
+	}
+
+	this.mutex.Lock()
+	for _, call := range b.calls {
+		delete(this.calls, string(call.key))
+	}
+	this.mutex.Unlock()
+	for _, call := range b.calls {
+		close(call.done)
+	}
+}
+
+/**
+load call loader; a panic of it fail the batch, instead of leaving its callers waiting
+*/
+func (this *DataLoader) load(keys [][]byte) (results []BatchResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results, err = nil, fmt.Errorf("lrucache: batch loader panic: %v", r)
+		}
+	}()
+	return this.loader(keys)
+}
+
+func unwrapTombstone(entry interface{}) (interface{}, error) {
+	if tombstone, ok := entry.(*Tombstone); ok {
+		return nil, tombstone.Err
+	}
+	return entry, nil
+}
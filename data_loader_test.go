@@ -0,0 +1,144 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDataLoader_Batching(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	var mutex sync.Mutex
+	var batches [][]string
+	release := make(chan struct{})
+	loader := NewDataLoader(lru, func(keys [][]byte) ([]BatchResult, error) {
+		// hold batches until every Load is queued
+		<-release
+		var batch []string
+		results := make([]BatchResult, len(keys))
+		for i, key := range keys {
+			batch = append(batch, string(key))
+			switch {
+			case strings.HasPrefix(string(key), "missing"):
+			case strings.HasPrefix(string(key), "bad"):
+				results[i].Err = errors.New("bad key")
+			default:
+				results[i] = BatchResult{Entry: "value-" + string(key), Charge: 10}
+			}
+		}
+		mutex.Lock()
+		batches = append(batches, batch)
+		mutex.Unlock()
+		return results, nil
+	}, DataLoaderOptions{Wait: 20 * time.Millisecond, MaxBatch: 16})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		key := strconv.Itoa(i % 20)
+		if i%10 == 7 {
+			key = "missing" + key
+		}
+		if i%10 == 9 {
+			key = "bad" + key
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := loader.Load([]byte(key))
+			switch {
+			case strings.HasPrefix(key, "missing"):
+				if value != nil || err != nil {
+					t.Errorf("missing key got: %v, %v", value, err)
+				}
+			case strings.HasPrefix(key, "bad"):
+				if err == nil || err.Error() != "bad key" {
+					t.Errorf("bad key got: %v, %v", value, err)
+				}
+			default:
+				if value != "value-"+key || err != nil {
+					t.Errorf("key %s got: %v, %v", key, value, err)
+				}
+			}
+		}()
+	}
+	for stats := loader.Stats(); stats.Misses < 40; stats = loader.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	loaded := 0
+	for _, batch := range batches {
+		if len(batch) > 16 {
+			t.Errorf("batch over MaxBatch: %d keys", len(batch))
+		}
+		loaded += len(batch)
+	}
+	stats := loader.Stats()
+	// 20 distinct keys, each loaded once
+	if loaded != 20 || stats.BatchedKeys != 20 || stats.Deduped != 20 || len(batches) != 2 {
+		t.Errorf("unexpected batches: %v, stats: %+v", batches, stats)
+	}
+
+	// values and not found are cached, errors are not
+	values, errs := loader.LoadMany([][]byte{[]byte("1"), []byte("missing7"), []byte("bad9")})
+	if values[0] != "value-1" || values[1] != nil || errs[1] != nil || errs[2] == nil {
+		t.Errorf("LoadMany got: %v, %v", values, errs)
+	}
+	if _, ok := lru.Lookup([]byte("missing7")).(*Tombstone); !ok {
+		t.Errorf("missing key should be cached as tombstone")
+	}
+	if got := loader.Stats(); got.Hits != 2 || got.BatchedKeys != 21 {
+		t.Errorf("expected 2 hits and bad key reloaded, stats: %+v", got)
+	}
+}
+
+func TestDataLoader_BatchError(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	fail := errors.New("db down")
+	loader := NewDataLoader(lru, func(keys [][]byte) ([]BatchResult, error) {
+		if string(keys[0]) == "short" {
+			return nil, nil
+		}
+		return nil, fail
+	}, DataLoaderOptions{})
+
+	_, errs := loader.LoadMany([][]byte{[]byte("a"), []byte("b")})
+	if errs[0] != fail || errs[1] != fail {
+		t.Errorf("batch error should fail every key, got: %v", errs)
+	}
+	if _, err := loader.Load([]byte("short")); err != ErrBatchResults {
+		t.Errorf("expected ErrBatchResults, got: %v", err)
+	}
+	// panic of loader fail the batch, callers don't wait forever
+	panicking := NewDataLoader(lru, func(keys [][]byte) ([]BatchResult, error) {
+		panic("loader bug")
+	}, DataLoaderOptions{})
+	if _, errs := panicking.LoadMany([][]byte{[]byte("c"), []byte("d")}); errs[0] == nil || errs[1] == nil {
+		t.Errorf("panic of loader should fail every key, got: %v", errs)
+	}
+	// leases were released, keys can be loaded by others
+	if _, _, status := lru.LookupOrLease([]byte("a")); status != LeaseGranted {
+		t.Errorf("lease of failed key should be released, status: %d", status)
+	}
+}
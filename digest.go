@@ -0,0 +1,241 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+var ErrBadDigest = errors.New("lrucache: bad digest")
+
+const (
+	digestMagic      = "LRUD"
+	digestVersion    = 1
+	digestHeaderSize = 4 + 1 + 1 + 8
+	counterMax       = 15 // 4 bit counters; saturated counters are never decreased
+)
+
+/**
+bloom positions of key: murmur3 64 bit hash split to h1, h2, position i is (h1 + i*h2) mod m.
+it's part of the digest format, don't change it.
+*/
+func bloomPositions(key []byte, k uint8, m uint64, fn func(pos uint64)) {
+	h := HashSlice64(key)
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < uint64(k); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+// bits and hash count for n keys at false positive rate p
+func bloomGeometry(n uint64, p float64) (uint64, uint8) {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint8(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 16 {
+		k = 16
+	}
+	return m, k
+}
+
+/**
+countingBloom has a 4 bit counter per position, 8 in a word, updated by CAS;
+shards share one filter and update it under their own mutex
+*/
+type countingBloom struct {
+	m        uint64
+	k        uint8
+	counters []uint32
+}
+
+func newCountingBloom(expected_keys uint64, fp_rate float64) *countingBloom {
+	m, k := bloomGeometry(expected_keys, fp_rate)
+	return &countingBloom{m: m, k: k, counters: make([]uint32, (m+7)/8)}
+}
+
+func (this *countingBloom) add(key []byte) {
+	bloomPositions(key, this.k, this.m, func(pos uint64) {
+		this.update(pos, 1)
+	})
+}
+
+func (this *countingBloom) remove(key []byte) {
+	bloomPositions(key, this.k, this.m, func(pos uint64) {
+		this.update(pos, -1)
+	})
+}
+
+func (this *countingBloom) update(pos uint64, delta int) {
+	word := &this.counters[pos/8]
+	shift := (pos % 8) * 4
+	for {
+		old := atomic.LoadUint32(word)
+		count := (old >> shift) & 0xf
+		if count == counterMax || (delta < 0 && count == 0) {
+			return
+		}
+		var updated uint32
+		if delta > 0 {
+			updated = old + 1<<shift
+		} else {
+			updated = old - 1<<shift
+		}
+		if atomic.CompareAndSwapUint32(word, old, updated) {
+			return
+		}
+	}
+}
+
+func (this *countingBloom) digest() *Digest {
+	digest := &Digest{m: this.m, k: this.k, bits: make([]byte, (this.m+7)/8)}
+	for i := range this.counters {
+		word := atomic.LoadUint32(&this.counters[i])
+		for j := uint64(0); j < 8 && word != 0; j++ {
+			if word&0xf != 0 {
+				pos := uint64(i)*8 + j
+				digest.bits[pos/8] |= 1 << (pos % 8)
+			}
+			word >>= 4
+		}
+	}
+	return digest
+}
+
+/**
+Digest is a Bloom filter of keys a cache held when it was taken; MayContain
+has no false negatives for those keys.
+
+serialized: | "LRUD" | version 1 | k 1 | m 8 | bits (m+7)/8 |, big endian;
+bit i is bit i%8 of byte i/8. positions are computed by bloomPositions.
+*/
+type Digest struct {
+	m    uint64
+	k    uint8
+	bits []byte
+}
+
+func (this *Digest) MayContain(key []byte) bool {
+	found := true
+	bloomPositions(key, this.k, this.m, func(pos uint64) {
+		if this.bits[pos/8]&(1<<(pos%8)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+/**
+FalsePositiveRate estimated from the ratio of set bits
+*/
+func (this *Digest) FalsePositiveRate() float64 {
+	var set int
+	for _, b := range this.bits {
+		for ; b != 0; b &= b - 1 {
+			set++
+		}
+	}
+	return math.Pow(float64(set)/float64(this.m), float64(this.k))
+}
+
+func (this *Digest) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, digestHeaderSize+len(this.bits))
+	copy(buf, digestMagic)
+	buf[4] = digestVersion
+	buf[5] = this.k
+	binary.BigEndian.PutUint64(buf[6:], this.m)
+	copy(buf[digestHeaderSize:], this.bits)
+	return buf, nil
+}
+
+func (this *Digest) UnmarshalBinary(data []byte) error {
+	if len(data) < digestHeaderSize || string(data[:4]) != digestMagic || data[4] != digestVersion {
+		return ErrBadDigest
+	}
+	k := data[5]
+	m := binary.BigEndian.Uint64(data[6:])
+	// bound m by the bits first, so m+7 can't overflow
+	size := uint64(len(data) - digestHeaderSize)
+	if k == 0 || m == 0 || m > size*8 || size != (m+7)/8 {
+		return ErrBadDigest
+	}
+	this.k = k
+	this.m = m
+	this.bits = append([]byte(nil), data[digestHeaderSize:]...)
+	return nil
+}
+
+/*********** LRUCache *************/
+
+/**
+EnableDigest start tracking keys in a counting Bloom filter sized for expected_keys
+at fp_rate false positives; keys already cached are added. it's updated on every
+insert and removal, Digest only snapshot it.
+*/
+func (this *LRUCache) EnableDigest(expected_keys uint64, fp_rate float64) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	filter := newCountingBloom(expected_keys, fp_rate)
+	for _, shard := range this.shards {
+		shard.set_digest(filter)
+	}
+}
+
+/**
+Digest return a Bloom filter of keys in memory, nil if EnableDigest is not called;
+keys only in secondary cache are not included
+*/
+func (this *LRUCache) Digest() *Digest {
+	filter := this.shards[0].digest_filter()
+	if filter == nil {
+		return nil
+	}
+	return filter.digest()
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) set_digest(filter *countingBloom) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.digest = filter
+	if filter != nil {
+		this.table.ApplyToAllHandles(func(h *LRUHandle) {
+			filter.add(h.key)
+		})
+	}
+}
+
+func (this *LRUCacheShard) digest_filter() *countingBloom {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.digest
+}
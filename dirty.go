@@ -0,0 +1,212 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+	"context"
+)
+
+/**
+Flusher persist a dirty entry which is about to be evicted; it's called with shard
+locked, so it must not use the cache. version is the one its InsertDirty returned,
+or of the last write over it
+*/
+type Flusher func(key []byte, entry interface{}, version uint64) error
+
+/*********** LRUCache *************/
+
+/**
+SetFlusher register flusher of dirty victims; with no flusher they are never evicted.
+Insert of a dirty entry block while its shard has more than max_dirty_bytes
+dirty; 0, or more than capacity, means capacity: dirty entries can't be evicted,
+so they would grow usage past capacity without bound
+*/
+func (this *LRUCache) SetFlusher(flusher Flusher, max_dirty_bytes uint64) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	per_shard := uint64(0)
+	if max_dirty_bytes > 0 {
+		per_shard = getPerfShardCapacity(max_dirty_bytes, this.num_shard_bits)
+	}
+	for _, shard := range this.shards {
+		shard.SetFlusher(flusher, per_shard)
+	}
+}
+
+/**
+InsertDirty insert an entry not persisted yet, and return its version for MarkClean.
+eviction flush it through Flusher first, or pass it over
+*/
+func (this *LRUCache) InsertDirty(key []byte, entry interface{}, charge uint64, deleter DeleteCallback) uint64 {
+	version, _ := this.InsertDirtyContext(context.Background(), key, entry, charge, deleter);
+	return version
+}
+
+/**
+InsertDirtyContext is InsertDirty giving up waiting for dirty bytes to be flushed
+when ctx is done; it return ctx.Err() and the entry is not inserted
+*/
+func (this *LRUCache) InsertDirtyContext(ctx context.Context, key []byte, entry interface{}, charge uint64, deleter DeleteCallback) (uint64, error) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].InsertDirty(ctx, key, hash, entry, charge, deleter);
+}
+
+/**
+MarkClean clear dirty flag of key if it's still the version InsertDirty returned
+*/
+func (this *LRUCache) MarkClean(key []byte, version uint64) bool {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].MarkClean(key, hash, version);
+}
+
+/**
+DirtyCharge is charge of dirty entries in all shards
+*/
+func (this *LRUCache) DirtyCharge() uint64 {
+	var total uint64 = 0;
+	for _, shard := range this.shards {
+		total += shard.DirtyCharge();
+	}
+	return total;
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) SetFlusher(flusher Flusher, max_dirty uint64) {
+	this.mutex.Lock()
+	defer this.unlock()
+	this.flusher = flusher
+	this.max_dirty = max_dirty
+	this.dirty_cond.Broadcast()
+}
+
+func (this *LRUCacheShard) InsertDirty(ctx context.Context, key []byte, hash uint32, entry interface{}, charge uint64, deleter DeleteCallback) (uint64, error) {
+	this.mutex.Lock();
+	defer this.unlock()
+	if charge == 0 {
+		charge = EstimateSize(entry)
+	}
+	// dirty_usage count metadata too
+	full_charge := charge
+	if this.metadata_charge_policy == FullChargeCacheMetadata {
+		full_charge += metadataCharge(key)
+	}
+	if ctx.Done() != nil {
+		// cond can't select on ctx; wake the wait below when it's done
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				this.mutex.Lock()
+				this.dirty_cond.Broadcast()
+				this.mutex.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	// back pressure; an older dirty value of key is replaced, its charge is freed
+	for max_dirty := this.dirty_limit(); max_dirty > 0 && this.dirty_usage > 0; max_dirty = this.dirty_limit() {
+		dirty := this.dirty_usage
+		if old := this.handle_lookup(key, hash); old != nil && old.dirty {
+			dirty -= old.charge
+		}
+		if dirty+full_charge <= max_dirty || dirty == 0 {
+			break
+		}
+		// eviction would flush them anyway; do it now instead of waiting
+		if this.flush_oldest(dirty+full_charge-max_dirty, key, hash) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		this.dirty_cond.Wait()
+	}
+	this.invalidate_lease(key, nil)
+	return this.insert_handle(key, hash, entry, charge, deleter, true)
+}
+
+func (this *LRUCacheShard) MarkClean(key []byte, hash uint32, version uint64) bool {
+	this.mutex.Lock()
+	defer this.unlock()
+	e := this.handle_lookup(key, hash)
+	if e == nil || !e.dirty || e.version != version {
+		return false
+	}
+	this.clean_handle(e)
+	return true
+}
+
+/**
+flush_oldest flush oldest dirty entries, except the one of key, until need bytes are clean;
+return whether any was flushed
+*/
+func (this *LRUCacheShard) flush_oldest(need uint64, key []byte, hash uint32) bool {
+	if this.flusher == nil {
+		return false
+	}
+	var flushed uint64
+	for e := this.lrulist.next; e != &this.lrulist && flushed < need; e = e.next {
+		if !e.dirty || e.hash == hash && bytes.Equal(e.key, key) {
+			continue
+		}
+		if this.flush_handle(e) {
+			flushed += e.charge
+		}
+	}
+	return flushed > 0
+}
+
+/**
+dirty_limit is bound of dirty_usage, never over capacity
+*/
+func (this *LRUCacheShard) dirty_limit() uint64 {
+	if this.max_dirty == 0 || this.max_dirty > this.capacity {
+		return this.capacity
+	}
+	return this.max_dirty
+}
+
+func (this *LRUCacheShard) DirtyCharge() uint64 {
+	this.mutex.Lock()
+	defer this.unlock()
+	return this.dirty_usage
+}
+
+/**
+flush_handle persist dirty e by flusher, return whether it's clean now
+*/
+func (this *LRUCacheShard) flush_handle(e *LRUHandle) bool {
+	if this.flusher == nil {
+		return false
+	}
+	entry, _ := this.handle_value(e)
+	if err := this.flusher(e.key, entry, e.version); err != nil {
+		return false
+	}
+	this.clean_handle(e)
+	return true
+}
+
+func (this *LRUCacheShard) clean_handle(e *LRUHandle) {
+	e.dirty = false
+	this.dirty_usage -= e.charge
+	this.dirty_cond.Broadcast()
+}
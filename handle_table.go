@@ -31,9 +31,24 @@ type LRUHandle struct {
 	charge    uint64; // TODO(opt): Only allow uint32_t?
 	hash      uint32; // Hash of key(); used for fast sharding and comparisons
 	key  []byte; // Beginning of key
+	cold       bool // older than cold_boundary of shard
+	compressed bool // entry is []byte of compressed tier
+	dirty      bool   // not persisted yet, see InsertDirty
+	version    uint64 // from NewId of cache, new for every insert
 }
 
 
+/**
+handleIndex find handles of a shard by key; HandleTable chain them by next_hash,
+CompactHandleTable use open addressing
+*/
+type handleIndex interface {
+	Lookup(key []byte, hash uint32) *LRUHandle
+	Insert(e *LRUHandle) *LRUHandle
+	Remove(key []byte, hash uint32) *LRUHandle
+	ApplyToAllHandles(travel_fun func(h *LRUHandle))
+}
+
 type HandleTable struct {
 	list   []*LRUHandle
 	lenght uint32
@@ -134,6 +149,16 @@ func (this *HandleTable) ApplyToAllCacheEntries(travel_fun TravelEntryOperator)
 }
 
 
+func (this *HandleTable) ApplyToAllHandles(travel_fun func(h *LRUHandle)) {
+	for i := uint32(0); i < this.lenght; i++ {
+		h := this.list[i];
+		for h != nil {
+			n := h.next_hash;
+			travel_fun(h);
+			h = n;
+		}
+	}
+}
 
 func (this *HandleTable) findPointer(key []byte, hash uint32) **LRUHandle {
 	ptr := &this.list[hash&(this.lenght-1)]
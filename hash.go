@@ -23,3 +23,6 @@ func HashSlice(key []byte) uint32 {
 	return murmur3.Sum32(key)
 }
 
+func HashSlice64(key []byte) uint64 {
+	return murmur3.Sum64(key)
+}
@@ -0,0 +1,144 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"sort"
+)
+
+type HotKey struct {
+	Key   []byte
+	Count uint64 // estimated lookups since counts were last decayed
+}
+
+/*********** LRUCache *************/
+
+/**
+one of rate Lookup hits is sampled and counted by key, at most max_tracked keys per shard
+(default 64); rate 0 turn it off. a full shard replace its least counted key (space saving),
+so hot keys are never lost, cold keys may be overestimated.
+*/
+func (this *LRUCache) SetAccessSampling(rate uint32, max_tracked int) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetAccessSampling(rate, max_tracked)
+	}
+}
+
+/**
+HotKeys return keys with estimated count >= min_count, hottest first
+*/
+func (this *LRUCache) HotKeys(min_count uint64) []HotKey {
+	var keys []HotKey
+	for _, shard := range this.shards {
+		keys = append(keys, shard.HotKeys(min_count)...)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Count > keys[j].Count })
+	return keys
+}
+
+/**
+DecayAccessCounts halve all counts; call it periodically so counts follow recent traffic
+*/
+func (this *LRUCache) DecayAccessCounts() {
+	for _, shard := range this.shards {
+		shard.DecayAccessCounts()
+	}
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) SetAccessSampling(rate uint32, max_tracked int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if max_tracked <= 0 {
+		max_tracked = 64
+	}
+	this.sample_rate = rate
+	this.max_tracked = max_tracked
+	if rate == 0 {
+		this.access_counts = nil
+	} else if this.access_counts == nil {
+		this.access_counts = make(map[string]uint64)
+		this.sample_state = 0x9e3779b9
+	}
+}
+
+func (this *LRUCacheShard) HotKeys(min_count uint64) []HotKey {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var keys []HotKey
+	for key, count := range this.access_counts {
+		if estimated := count * uint64(this.sample_rate); estimated >= min_count {
+			keys = append(keys, HotKey{Key: []byte(key), Count: estimated})
+		}
+	}
+	return keys
+}
+
+func (this *LRUCacheShard) DecayAccessCounts() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.decay_access_counts()
+}
+
+/**
+record_access count key with probability 1/sample_rate; caller hold mutex
+*/
+func (this *LRUCacheShard) record_access(key []byte) {
+	if this.sample_rate == 0 {
+		return
+	}
+	// xorshift; a counter would alias with periodic access patterns
+	x := this.sample_state
+	x ^= x << 13
+	x ^= x >> 17
+	x ^= x << 5
+	this.sample_state = x
+	if x%this.sample_rate != 0 {
+		return
+	}
+	if count, ok := this.access_counts[string(key)]; ok {
+		this.access_counts[string(key)] = count + 1
+		return
+	}
+	var count uint64 = 1
+	if len(this.access_counts) >= this.max_tracked {
+		var min_key string
+		min_count := ^uint64(0)
+		for k, c := range this.access_counts {
+			if c < min_count {
+				min_key, min_count = k, c
+			}
+		}
+		delete(this.access_counts, min_key)
+		count = min_count + 1
+	}
+	this.access_counts[string(key)] = count
+}
+
+func (this *LRUCacheShard) decay_access_counts() {
+	for key, count := range this.access_counts {
+		if count <= 1 {
+			delete(this.access_counts, key)
+		} else {
+			this.access_counts[key] = count / 2
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package invalidation
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+const (
+	kindKey       byte = 1
+	kindPrefix    byte = 2
+	kindAll       byte = 3
+	kindHeartbeat byte = 4 // seq is last published, not a new message
+
+	messageMagic      = 0x4c52 // "LR"
+	messageHeaderSize = 2 + 1 + 8 + 8 + 4
+)
+
+var (
+	ErrKeyTooLarge = errors.New("invalidation: key too large")
+	errBadMessage  = errors.New("invalidation: bad message")
+)
+
+/**
+message: | magic 2 | kind 1 | sender 8 | seq 8 | key_len 4 | key |
+*/
+type message struct {
+	kind   byte
+	sender uint64
+	seq    uint64
+	key    []byte
+}
+
+func (this *message) encode() []byte {
+	buf := make([]byte, messageHeaderSize+len(this.key))
+	binary.BigEndian.PutUint16(buf[0:], messageMagic)
+	buf[2] = this.kind
+	binary.BigEndian.PutUint64(buf[3:], this.sender)
+	binary.BigEndian.PutUint64(buf[11:], this.seq)
+	binary.BigEndian.PutUint32(buf[19:], uint32(len(this.key)))
+	copy(buf[messageHeaderSize:], this.key)
+	return buf
+}
+
+func decodeMessage(buf []byte) (*message, error) {
+	if len(buf) < messageHeaderSize || binary.BigEndian.Uint16(buf) != messageMagic {
+		return nil, errBadMessage
+	}
+	key_len := binary.BigEndian.Uint32(buf[19:])
+	if uint64(key_len) != uint64(len(buf)-messageHeaderSize) {
+		return nil, errBadMessage
+	}
+	return &message{
+		kind:   buf[2],
+		sender: binary.BigEndian.Uint64(buf[3:]),
+		seq:    binary.BigEndian.Uint64(buf[11:]),
+		key:    append([]byte(nil), buf[messageHeaderSize:]...),
+	}, nil
+}
+
+type BusOptions struct {
+	// interval of heartbeat, which let subscribers detect loss of last messages; default 1s, <0 disable
+	HeartbeatInterval time.Duration
+}
+
+type BusStats struct {
+	Published uint64
+	Received  uint64
+	Applied   uint64 // key or prefix invalidations applied
+	Lost      uint64 // gaps of sequence detected, each cause a Prune
+	BadFrames uint64
+}
+
+/**
+Bus keep a LRUCache in sync with the same data cached by other processes:
+Invalidate and InvalidatePrefix remove locally and broadcast, messages of other
+processes are applied to cache. every sender number its messages; a gap means
+messages were lost, then whole cache is pruned because we don't know what's stale.
+*/
+type Bus struct {
+	cache     *lrucache.LRUCache
+	transport Transport
+	options   BusOptions
+	id        uint64
+
+	mutex sync.Mutex
+	// held from numbering a message to sending it, so messages and heartbeats
+	// are on the wire in seq order
+	send_mutex sync.Mutex
+	seq        uint64
+	senders    map[uint64]uint64 // last seq of every sender
+	stats      BusStats
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewBus(cache *lrucache.LRUCache, transport Transport, options BusOptions) *Bus {
+	if options.HeartbeatInterval == 0 {
+		options.HeartbeatInterval = time.Second
+	}
+	bus := &Bus{
+		cache:     cache,
+		transport: transport,
+		options:   options,
+		id:        uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()) | 1,
+		senders:   make(map[uint64]uint64),
+		stop:      make(chan struct{}),
+	}
+	bus.wg.Add(1)
+	go bus.receiveLoop()
+	if options.HeartbeatInterval > 0 {
+		bus.wg.Add(1)
+		go bus.heartbeatLoop()
+	}
+	return bus
+}
+
+/**
+Invalidate remove key here and in every other process on the bus
+*/
+func (this *Bus) Invalidate(key []byte) error {
+	this.cache.Remove(key)
+	return this.publish(kindKey, key)
+}
+
+func (this *Bus) InvalidatePrefix(prefix []byte) error {
+	this.cache.RemovePrefix(prefix)
+	return this.publish(kindPrefix, prefix)
+}
+
+func (this *Bus) InvalidateAll() error {
+	this.cache.Prune()
+	return this.publish(kindAll, nil)
+}
+
+func (this *Bus) Stats() BusStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stats
+}
+
+/**
+Close stop receiving and close transport
+*/
+func (this *Bus) Close() error {
+	close(this.stop)
+	err := this.transport.Close()
+	this.wg.Wait()
+	return err
+}
+
+func (this *Bus) publish(kind byte, key []byte) error {
+	if messageHeaderSize+len(key) > maxMessageSize {
+		return ErrKeyTooLarge
+	}
+	this.send_mutex.Lock()
+	defer this.send_mutex.Unlock()
+	this.mutex.Lock()
+	this.seq++
+	msg := &message{kind: kind, sender: this.id, seq: this.seq, key: key}
+	this.stats.Published++
+	this.mutex.Unlock()
+	return this.transport.Send(msg.encode())
+}
+
+func (this *Bus) heartbeatLoop() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+		this.send_mutex.Lock()
+		this.mutex.Lock()
+		msg := &message{kind: kindHeartbeat, sender: this.id, seq: this.seq}
+		this.mutex.Unlock()
+		this.transport.Send(msg.encode())
+		this.send_mutex.Unlock()
+	}
+}
+
+func (this *Bus) receiveLoop() {
+	defer this.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := this.transport.Recv(buf)
+		if err != nil {
+			select {
+			case <-this.stop:
+				return
+			default:
+			}
+			// transport is broken, nothing we receive can be trusted
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			this.mutex.Lock()
+			this.stats.BadFrames++
+			this.mutex.Unlock()
+			continue
+		}
+		if msg.sender != this.id {
+			this.receive(msg)
+		}
+	}
+}
+
+func (this *Bus) receive(msg *message) {
+	this.mutex.Lock()
+	last, known := this.senders[msg.sender]
+	lost := false
+	if msg.kind == kindHeartbeat {
+		if known && msg.seq > last {
+			lost = true
+		}
+		// a delayed heartbeat must not move the mark back
+		this.senders[msg.sender] = maxSeq(last, msg.seq)
+	} else {
+		this.stats.Received++
+		if known && msg.seq != last+1 {
+			if msg.seq <= last {
+				// duplicated or reordered message, removing again is harmless
+				this.mutex.Unlock()
+				this.apply(msg)
+				return
+			}
+			lost = true
+		}
+		this.senders[msg.sender] = maxSeq(last, msg.seq)
+	}
+	if lost {
+		this.stats.Lost++
+	}
+	this.mutex.Unlock()
+
+	if lost {
+		this.cache.Prune()
+	}
+	if msg.kind != kindHeartbeat {
+		this.apply(msg)
+	}
+}
+
+func maxSeq(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (this *Bus) apply(msg *message) {
+	switch msg.kind {
+	case kindKey:
+		this.cache.Remove(msg.key)
+	case kindPrefix:
+		this.cache.RemovePrefix(msg.key)
+	case kindAll:
+		this.cache.Prune()
+	default:
+		return
+	}
+	this.mutex.Lock()
+	this.stats.Applied++
+	this.mutex.Unlock()
+}
@@ -0,0 +1,153 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package invalidation
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func newTestBus(t *testing.T, dir, name string) (*Bus, *lrucache.LRUCache) {
+	transport, err := NewUnixTransport(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := lrucache.NewLRUCache(1<<20, 2)
+	return NewBus(cache, transport, BusOptions{HeartbeatInterval: -1}), cache
+}
+
+func TestBus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bus1, cache1 := newTestBus(t, dir, "a")
+	defer bus1.Close()
+	bus2, cache2 := newTestBus(t, dir, "b")
+	defer bus2.Close()
+
+	for _, cache := range []*lrucache.LRUCache{cache1, cache2} {
+		cache.Insert([]byte("user:1"), "a", 1, nil)
+		cache.Insert([]byte("user:2"), "b", 1, nil)
+		cache.Insert([]byte("order:1"), "c", 1, nil)
+	}
+
+	if err := bus1.Invalidate([]byte("user:1")); err != nil {
+		t.Fatal(err)
+	}
+	if cache1.Lookup([]byte("user:1")) != nil {
+		t.Errorf("user:1 not removed locally")
+	}
+	if !waitUntil(func() bool { return cache2.Lookup([]byte("user:1")) == nil }) {
+		t.Errorf("user:1 not invalidated on peer")
+	}
+
+	if err := bus2.InvalidatePrefix([]byte("user:")); err != nil {
+		t.Fatal(err)
+	}
+	if !waitUntil(func() bool { return cache1.Lookup([]byte("user:2")) == nil }) {
+		t.Errorf("user:2 not invalidated by prefix")
+	}
+	if cache1.Lookup([]byte("order:1")) == nil || cache2.Lookup([]byte("order:1")) == nil {
+		t.Errorf("order:1 should survive prefix invalidation")
+	}
+	if stats := bus1.Stats(); stats.Published != 1 || stats.Applied != 1 || stats.Lost != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBus_Loss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bus, cache := newTestBus(t, dir, "a")
+	defer bus.Close()
+	sender, err := NewUnixTransport(dir, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	cache.Insert([]byte("k1"), "v1", 1, nil)
+	cache.Insert([]byte("k2"), "v2", 1, nil)
+
+	send := func(kind byte, seq uint64, key string) {
+		msg := &message{kind: kind, sender: 42, seq: seq, key: []byte(key)}
+		if err := sender.Send(msg.encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(kindKey, 1, "k1")
+	if !waitUntil(func() bool { return cache.Lookup([]byte("k1")) == nil }) {
+		t.Fatalf("k1 not invalidated")
+	}
+	if cache.Lookup([]byte("k2")) == nil {
+		t.Fatalf("k2 should not be removed")
+	}
+
+	// seq 2 is lost; whole cache is stale
+	send(kindKey, 3, "other")
+	if !waitUntil(func() bool { return bus.Stats().Lost == 1 }) {
+		t.Fatalf("gap not detected, stats: %+v", bus.Stats())
+	}
+	if cache.Lookup([]byte("k2")) != nil {
+		t.Errorf("cache should be pruned after message loss")
+	}
+
+	// heartbeat tell us the last message was lost
+	cache.Insert([]byte("k3"), "v3", 1, nil)
+	send(kindHeartbeat, 4, "")
+	if !waitUntil(func() bool { return bus.Stats().Lost == 2 }) {
+		t.Fatalf("heartbeat gap not detected, stats: %+v", bus.Stats())
+	}
+	if cache.Lookup([]byte("k3")) != nil {
+		t.Errorf("cache should be pruned after heartbeat gap")
+	}
+
+	// delayed heartbeat must not move the mark back and fake a gap
+	cache.Insert([]byte("k4"), "v4", 1, nil)
+	cache.Insert([]byte("k5"), "v5", 1, nil)
+	send(kindHeartbeat, 2, "")
+	send(kindKey, 5, "k5")
+	if !waitUntil(func() bool { return cache.Lookup([]byte("k5")) == nil }) {
+		t.Fatalf("k5 not invalidated")
+	}
+	if stats := bus.Stats(); stats.Lost != 2 || cache.Lookup([]byte("k4")) == nil {
+		t.Errorf("delayed heartbeat detected as loss, stats: %+v", stats)
+	}
+}
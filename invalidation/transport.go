@@ -0,0 +1,159 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package invalidation
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// max size of one message, key of larger message can't be sent
+const maxMessageSize = 64 * 1024
+
+/**
+Transport broadcast datagrams to every process of the bus; a process may
+or may not receive its own messages.
+*/
+type Transport interface {
+	Send(msg []byte) error
+	Recv(buf []byte) (int, error)
+	Close() error
+}
+
+/************* unix datagram *************/
+
+const unixSocketSuffix = ".sock"
+
+/**
+UnixTransport: every process bind a datagram socket in dir; Send write
+to all sockets in dir, so it only work for processes on one host.
+*/
+type UnixTransport struct {
+	dir  string
+	path string
+	conn *net.UnixConn
+}
+
+/**
+name must be unique among processes sharing dir
+*/
+func NewUnixTransport(dir, name string) (*UnixTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name+unixSocketSuffix)
+	os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &UnixTransport{dir: dir, path: path, conn: conn}, nil
+}
+
+/**
+sockets of dead processes are skipped; error is returned only if no peer got msg
+*/
+func (this *UnixTransport) Send(msg []byte) error {
+	peers, err := filepath.Glob(filepath.Join(this.dir, "*"+unixSocketSuffix))
+	if err != nil {
+		return err
+	}
+	var last_err error
+	sent := 0
+	for _, peer := range peers {
+		if peer == this.path || !strings.HasSuffix(peer, unixSocketSuffix) {
+			continue
+		}
+		_, err := this.conn.WriteToUnix(msg, &net.UnixAddr{Name: peer, Net: "unixgram"})
+		if err != nil {
+			last_err = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return last_err
+	}
+	return nil
+}
+
+func (this *UnixTransport) Recv(buf []byte) (int, error) {
+	n, _, err := this.conn.ReadFromUnix(buf)
+	return n, err
+}
+
+func (this *UnixTransport) Close() error {
+	err := this.conn.Close()
+	os.Remove(this.path)
+	return err
+}
+
+/************* udp multicast *************/
+
+/**
+MulticastTransport send to and receive from an udp multicast group, like "239.1.2.3:9999";
+own messages loop back and are dropped by Bus.
+*/
+type MulticastTransport struct {
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+/**
+ifname "" let system choose interface
+*/
+func NewMulticastTransport(group string, ifname string) (*MulticastTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	var ifi *net.Interface
+	if ifname != "" {
+		if ifi, err = net.InterfaceByName(ifname); err != nil {
+			return nil, err
+		}
+	}
+	listen, err := net.ListenMulticastUDP("udp", ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	listen.SetReadBuffer(4 * 1024 * 1024)
+	send, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return &MulticastTransport{listen: listen, send: send}, nil
+}
+
+func (this *MulticastTransport) Send(msg []byte) error {
+	_, err := this.send.Write(msg)
+	return err
+}
+
+func (this *MulticastTransport) Recv(buf []byte) (int, error) {
+	n, _, err := this.listen.ReadFromUDP(buf)
+	return n, err
+}
+
+func (this *MulticastTransport) Close() error {
+	this.send.Close()
+	return this.listen.Close()
+}
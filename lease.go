@@ -0,0 +1,213 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrLeaseInvalid = errors.New("lrucache: lease invalid")
+
+const (
+	defaultLeaseTimeout = 10 * time.Second
+	minLeaseSweep       = 64
+)
+
+type LeaseStatus int
+
+const (
+	// entry is cached
+	LeaseHit LeaseStatus = iota
+	// miss; caller load the value and InsertWithLease it with token
+	LeaseGranted
+	// miss; another caller is loading it. entry is the value Remove dropped
+	// if it's recent enough, caller may use it or retry later
+	LeaseWait
+)
+
+/**
+lease of a missing key; Remove, Insert and Merge of the key invalidate the token,
+so a loader which read before them can't write back its stale value
+*/
+type lease struct {
+	token         uint64 // 0 when nobody hold it
+	expires       time.Time
+	stale         interface{}
+	stale_expires time.Time
+}
+
+/*********** LRUCache *************/
+
+/**
+LookupOrLease is Lookup which hand out a lease to the first caller of a miss,
+like memcache leases: callers of the same key wait instead of all loading it,
+and the loader's InsertWithLease fail if key was changed or removed meanwhile.
+stale values returned with LeaseWait were passed to deleter already.
+*/
+func (this *LRUCache) LookupOrLease(key []byte) (interface{}, uint64, LeaseStatus) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].LookupOrLease(key, hash);
+}
+
+/**
+InsertWithLease insert entry only if token is still valid, else return ErrLeaseInvalid
+*/
+func (this *LRUCache) InsertWithLease(key []byte, token uint64, entry interface{}, charge uint64, deleter DeleteCallback) error {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].InsertWithLease(key, hash, token, entry, charge, deleter);
+}
+
+/**
+ReleaseLease give up a lease when load failed, so next caller get it at once
+*/
+func (this *LRUCache) ReleaseLease(key []byte, token uint64) {
+	hash := HashSlice(key);
+	this.shards[this.shard(hash)].ReleaseLease(key, hash, token);
+}
+
+/**
+lease not used in timeout is given to the next caller; stale values are kept as long. default 10s
+*/
+func (this *LRUCache) SetLeaseTimeout(timeout time.Duration) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetLeaseTimeout(timeout)
+	}
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) LookupOrLease(key []byte, hash uint32) (interface{}, uint64, LeaseStatus) {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.handle_lookup_update(key, hash)
+	if e != nil && this.live_handle(e) {
+		this.record_access(key)
+		return e.entry, 0, LeaseHit
+	}
+	// expired tombstone is a miss; there is nothing in secondary behind it
+	if e == nil {
+		if entry := this.secondary_promote(key, hash); entry != nil {
+			return entry, 0, LeaseHit
+		}
+	}
+
+	now := time.Now()
+	l := this.lease_of(key, now)
+	if l.token != 0 && now.Before(l.expires) {
+		if now.Before(l.stale_expires) {
+			return l.stale, 0, LeaseWait
+		}
+		return nil, 0, LeaseWait
+	}
+	// tokens share NewId's counter, only granted leases take one
+	l.token = atomic.AddUint64(this.ids, 1)
+	l.expires = now.Add(this.lease_timeout())
+	return nil, l.token, LeaseGranted
+}
+
+func (this *LRUCacheShard) InsertWithLease(key []byte, hash uint32, token uint64, entry interface{}, charge uint64, deleter DeleteCallback) error {
+	this.mutex.Lock();
+	defer this.unlock()
+	if !this.take_lease(key, token) {
+		return ErrLeaseInvalid
+	}
+	return this.insert(key, hash, entry, charge, deleter)
+}
+
+func (this *LRUCacheShard) ReleaseLease(key []byte, hash uint32, token uint64) {
+	this.mutex.Lock();
+	defer this.unlock()
+	if l, ok := this.leases[string(key)]; ok && l.token == token {
+		l.token = 0
+	}
+}
+
+func (this *LRUCacheShard) SetLeaseTimeout(timeout time.Duration) {
+	this.mutex.Lock()
+	defer this.unlock()
+	this.lease_ttl = timeout
+}
+
+func (this *LRUCacheShard) lease_timeout() time.Duration {
+	if this.lease_ttl > 0 {
+		return this.lease_ttl
+	}
+	return defaultLeaseTimeout
+}
+
+/**
+take_lease clear lease of key if token is valid, so caller can write the key; the lease
+is kept until it expires, so a Remove meanwhile leave the removed value to waiters
+*/
+func (this *LRUCacheShard) take_lease(key []byte, token uint64) bool {
+	l, ok := this.leases[string(key)]
+	if !ok || token == 0 || l.token != token || !time.Now().Before(l.expires) {
+		return false
+	}
+	l.token = 0
+	return true
+}
+
+/**
+lease_of find or create lease of key; expired leases are swept when table doubled
+*/
+func (this *LRUCacheShard) lease_of(key []byte, now time.Time) *lease {
+	if l, ok := this.leases[string(key)]; ok {
+		return l
+	}
+	if this.leases == nil {
+		this.leases = make(map[string]*lease)
+	}
+	if len(this.leases) >= this.lease_sweep {
+		for k, l := range this.leases {
+			if !now.Before(l.expires) && !now.Before(l.stale_expires) {
+				delete(this.leases, k)
+			}
+		}
+		this.lease_sweep = 2 * len(this.leases)
+		if this.lease_sweep < minLeaseSweep {
+			this.lease_sweep = minLeaseSweep
+		}
+	}
+	l := &lease{}
+	this.leases[string(key)] = l
+	return l
+}
+
+/**
+invalidate_lease is called by writes of key; removed value is kept for waiters,
+only if key has a lease: keys nobody loaded through leases don't pin their values
+*/
+func (this *LRUCacheShard) invalidate_lease(key []byte, removed interface{}) {
+	l, ok := this.leases[string(key)]
+	if !ok {
+		return
+	}
+	if removed == nil || isTombstone(removed) {
+		delete(this.leases, string(key))
+		return
+	}
+	now := time.Now()
+	l.token = 0
+	l.stale = removed
+	l.stale_expires = now.Add(this.lease_timeout())
+}
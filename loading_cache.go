@@ -0,0 +1,360 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Loader load entry of key from the source of truth; charge 0 means estimate it
+*/
+type Loader func(key []byte) (entry interface{}, charge uint64, err error)
+
+type LoadingOptions struct {
+	SoftTTL time.Duration // after it the value is stale: served, and refreshed in background
+	HardTTL time.Duration // after it the entry is a miss; default 2*SoftTTL
+	// if the last refresh failed, the value is still served for Grace after HardTTL
+	Grace time.Duration
+	// XFetch probabilistic early refresh before SoftTTL, 0 turn it off; 1 is the usual value,
+	// larger refresh earlier. slow loads are refreshed earlier too
+	EarlyRefreshBeta float64
+	RetryInterval    time.Duration    // wait after a failed refresh, default 1s
+	Now              func() time.Time // default time.Now
+}
+
+type LoadingStats struct {
+	Hits            uint64 // fresh values
+	StaleHits       uint64 // values after soft deadline, or of failed loads within grace
+	Misses          uint64
+	Loads           uint64 // loads of missing or hard expired keys, deduplicated
+	LoadFailures    uint64
+	Refreshes       uint64 // background refreshes, early ones included
+	EarlyRefreshes  uint64
+	RefreshFailures uint64
+}
+
+type loadingStats struct {
+	hits, stale_hits, misses, loads, load_failures, refreshes, early_refreshes, refresh_failures uint64
+}
+
+// cached by LoadingCache
+type loadedEntry struct {
+	value      interface{}
+	soft       time.Time
+	hard       time.Time
+	delta      time.Duration // time the load took, for XFetch
+	refreshing int32
+	failed     int32
+	retry_at   int64 // unix nanos
+}
+
+type loadCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+/**
+LoadingCache load missing keys through loader with stale-while-revalidate:
+fresh until SoftTTL, served stale and refreshed once in background until HardTTL,
+then a miss loaded synchronously. refreshed or loaded values replace the entry only
+if nobody changed or removed the key meanwhile (by leases), so invalidations win.
+*/
+type LoadingCache struct {
+	cache   *LRUCache
+	loader  Loader
+	options LoadingOptions
+
+	mutex  sync.Mutex
+	calls  map[string]*loadCall
+	rand   *rand.Rand
+	closed bool
+	wg     sync.WaitGroup
+
+	stats loadingStats
+}
+
+func NewLoadingCache(cache *LRUCache, loader Loader, options LoadingOptions) *LoadingCache {
+	if options.HardTTL == 0 {
+		options.HardTTL = 2 * options.SoftTTL
+	}
+	if options.HardTTL < options.SoftTTL {
+		options.HardTTL = options.SoftTTL
+	}
+	if options.RetryInterval == 0 {
+		options.RetryInterval = time.Second
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	return &LoadingCache{
+		cache:   cache,
+		loader:  loader,
+		options: options,
+		calls:   make(map[string]*loadCall),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+/**
+Get return the cached value, loading it if missing or hard expired;
+concurrent loads of a key are done once
+*/
+func (this *LoadingCache) Get(key []byte) (interface{}, error) {
+	if e, ok := this.cache.Lookup(key).(*loadedEntry); ok {
+		if value, ok := this.serve(key, e); ok {
+			return value, nil
+		}
+	}
+	atomic.AddUint64(&this.stats.misses, 1)
+	return this.load(key)
+}
+
+/**
+Lookup is Get without synchronous load; nil if missing or hard expired
+*/
+func (this *LoadingCache) Lookup(key []byte) interface{} {
+	if e, ok := this.cache.Lookup(key).(*loadedEntry); ok {
+		if value, ok := this.serve(key, e); ok {
+			return value
+		}
+	}
+	atomic.AddUint64(&this.stats.misses, 1)
+	return nil
+}
+
+/**
+Invalidate remove key; a load or refresh in flight won't bring it back
+*/
+func (this *LoadingCache) Invalidate(key []byte) {
+	this.cache.Remove(key)
+}
+
+func (this *LoadingCache) Cache() *LRUCache {
+	return this.cache
+}
+
+func (this *LoadingCache) Stats() LoadingStats {
+	return LoadingStats{
+		Hits:            atomic.LoadUint64(&this.stats.hits),
+		StaleHits:       atomic.LoadUint64(&this.stats.stale_hits),
+		Misses:          atomic.LoadUint64(&this.stats.misses),
+		Loads:           atomic.LoadUint64(&this.stats.loads),
+		LoadFailures:    atomic.LoadUint64(&this.stats.load_failures),
+		Refreshes:       atomic.LoadUint64(&this.stats.refreshes),
+		EarlyRefreshes:  atomic.LoadUint64(&this.stats.early_refreshes),
+		RefreshFailures: atomic.LoadUint64(&this.stats.refresh_failures),
+	}
+}
+
+/**
+Close wait background refreshes; none is started after it
+*/
+func (this *LoadingCache) Close() {
+	this.mutex.Lock()
+	this.closed = true
+	this.mutex.Unlock()
+	this.wg.Wait()
+}
+
+/**
+serve decide by deadlines whether e can be returned, and start a refresh if due
+*/
+func (this *LoadingCache) serve(key []byte, e *loadedEntry) (interface{}, bool) {
+	now := this.options.Now()
+	switch {
+	case now.Before(e.soft):
+		atomic.AddUint64(&this.stats.hits, 1)
+		if this.earlyRefresh(e, now) {
+			this.refresh(key, e, true)
+		}
+		return e.value, true
+	case now.Before(e.hard):
+	case atomic.LoadInt32(&e.failed) == 1 && now.Before(e.hard.Add(this.options.Grace)):
+	default:
+		return nil, false
+	}
+	atomic.AddUint64(&this.stats.stale_hits, 1)
+	this.refresh(key, e, false)
+	return e.value, true
+}
+
+/**
+XFetch: refresh when now - delta*beta*ln(rand) >= soft deadline
+*/
+func (this *LoadingCache) earlyRefresh(e *loadedEntry, now time.Time) bool {
+	if this.options.EarlyRefreshBeta <= 0 {
+		return false
+	}
+	this.mutex.Lock()
+	r := this.rand.Float64()
+	this.mutex.Unlock()
+	if r == 0 {
+		return true
+	}
+	gap := time.Duration(-float64(e.delta) * this.options.EarlyRefreshBeta * math.Log(r))
+	return !now.Add(gap).Before(e.soft)
+}
+
+/**
+refresh load key in background, at most one at a time per entry
+*/
+func (this *LoadingCache) refresh(key []byte, e *loadedEntry, early bool) {
+	if this.options.Now().UnixNano() < atomic.LoadInt64(&e.retry_at) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+		return
+	}
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		atomic.StoreInt32(&e.refreshing, 0)
+		return
+	}
+	this.wg.Add(1)
+	this.mutex.Unlock()
+
+	atomic.AddUint64(&this.stats.refreshes, 1)
+	if early {
+		atomic.AddUint64(&this.stats.early_refreshes, 1)
+	}
+	key = append([]byte(nil), key...)
+	go func() {
+		defer this.wg.Done()
+		start := this.options.Now()
+		value, charge, err := this.loader(key)
+		if err != nil {
+			atomic.AddUint64(&this.stats.refresh_failures, 1)
+			atomic.StoreInt32(&e.failed, 1)
+			atomic.StoreInt64(&e.retry_at, this.options.Now().Add(this.options.RetryInterval).UnixNano())
+			atomic.StoreInt32(&e.refreshing, 0)
+			return
+		}
+		ne, charge := this.newEntry(value, charge, start)
+		this.cache.replace_if(key, e, ne, charge)
+	}()
+}
+
+/**
+load key synchronously, one call per key at a time
+*/
+func (this *LoadingCache) load(key []byte) (interface{}, error) {
+	this.mutex.Lock()
+	if call, ok := this.calls[string(key)]; ok {
+		this.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	this.calls[string(key)] = call
+	this.mutex.Unlock()
+
+	call.value, call.err = this.doLoad(key)
+	call.wg.Done()
+
+	this.mutex.Lock()
+	delete(this.calls, string(key))
+	this.mutex.Unlock()
+	return call.value, call.err
+}
+
+func (this *LoadingCache) doLoad(key []byte) (interface{}, error) {
+	entry, token, status := this.cache.LookupOrLease(key)
+	var old *loadedEntry
+	if status == LeaseHit {
+		// a stale value of LeaseWait was removed, it can't be served
+		old, _ = entry.(*loadedEntry)
+	}
+	if old != nil && this.options.Now().Before(old.hard) {
+		// loaded by a call just finished
+		return old.value, nil
+	}
+
+	atomic.AddUint64(&this.stats.loads, 1)
+	start := this.options.Now()
+	value, charge, err := this.loader(key)
+	if err != nil {
+		atomic.AddUint64(&this.stats.load_failures, 1)
+		if token != 0 {
+			this.cache.ReleaseLease(key, token)
+		}
+		if old != nil && this.options.Now().Before(old.hard.Add(this.options.Grace)) {
+			// stale if error
+			atomic.StoreInt32(&old.failed, 1)
+			atomic.AddUint64(&this.stats.stale_hits, 1)
+			return old.value, nil
+		}
+		return nil, err
+	}
+
+	ne, charge := this.newEntry(value, charge, start)
+	key = append([]byte(nil), key...)
+	switch {
+	case token != 0:
+		this.cache.InsertWithLease(key, token, ne, charge, nil)
+	case old != nil:
+		this.cache.replace_if(key, old, ne, charge)
+	}
+	// else somebody else hold the lease; value is returned but not cached
+	return value, nil
+}
+
+func (this *LoadingCache) newEntry(value interface{}, charge uint64, start time.Time) (*loadedEntry, uint64) {
+	now := this.options.Now()
+	if charge == 0 {
+		charge = EstimateSize(value)
+	}
+	e := &loadedEntry{
+		value: value,
+		soft:  now.Add(this.options.SoftTTL),
+		hard:  now.Add(this.options.HardTTL),
+		delta: now.Sub(start),
+	}
+	return e, charge
+}
+
+/*********** conditional replace *************/
+
+/**
+replace_if insert entry only if key still hold old; old must be a comparable value, like a pointer
+*/
+func (this *LRUCache) replace_if(key []byte, old interface{}, entry interface{}, charge uint64) bool {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].replace_if(key, hash, old, entry, charge);
+}
+
+func (this *LRUCacheShard) replace_if(key []byte, hash uint32, old interface{}, entry interface{}, charge uint64) bool {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.handle_lookup(key, hash)
+	if e == nil {
+		return false
+	}
+	if current, _ := this.handle_value(e); current != old {
+		return false
+	}
+	this.invalidate_lease(key, nil)
+	return this.insert(key, hash, entry, charge, e.deleter) == nil
+}
@@ -0,0 +1,232 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (this *fakeClock) Now() time.Time {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.now
+}
+
+func (this *fakeClock) Advance(d time.Duration) {
+	this.mutex.Lock()
+	this.now = this.now.Add(d)
+	this.mutex.Unlock()
+}
+
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+// value in cache, without touching stats
+func cachedValue(cache *LoadingCache, key []byte) interface{} {
+	if e, ok := cache.Cache().Lookup(key).(*loadedEntry); ok {
+		return e.value
+	}
+	return nil
+}
+
+/**
+loader return "<key>-<n>" where n count loads; fail make it return error
+*/
+type testLoader struct {
+	loads int32
+	fail  int32
+	block chan struct{}
+}
+
+func (this *testLoader) load(key []byte) (interface{}, uint64, error) {
+	if this.block != nil {
+		<-this.block
+	}
+	n := atomic.AddInt32(&this.loads, 1)
+	if atomic.LoadInt32(&this.fail) == 1 {
+		return nil, 0, errors.New("source down")
+	}
+	return string(key) + "-" + strconv.Itoa(int(n)), 0, nil
+}
+
+func TestLoadingCache_StaleWhileRevalidate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	loader := &testLoader{}
+	cache := NewLoadingCache(NewLRUCache(1024*1024, 1), loader.load,
+		LoadingOptions{SoftTTL: 10 * time.Second, HardTTL: 20 * time.Second, Now: clock.Now})
+	defer cache.Close()
+	key := []byte("k")
+
+	if value, err := cache.Get(key); err != nil || value != "k-1" {
+		t.Fatalf("first get: %v, %v", value, err)
+	}
+	clock.Advance(5 * time.Second)
+	if value, _ := cache.Get(key); value != "k-1" || atomic.LoadInt32(&loader.loads) != 1 {
+		t.Errorf("fresh value expected without load, got: %v", value)
+	}
+
+	// stale: old value now, one refresh in background
+	loader.block = make(chan struct{})
+	clock.Advance(7 * time.Second)
+	for i := 0; i < 5; i++ {
+		if value, _ := cache.Get(key); value != "k-1" {
+			t.Errorf("stale value expected, got: %v", value)
+		}
+	}
+	if refreshes := cache.Stats().Refreshes; refreshes != 1 {
+		t.Errorf("expected one refresh, got: %d", refreshes)
+	}
+	close(loader.block)
+	if !eventually(func() bool { return cachedValue(cache, key) == "k-2" }) {
+		t.Fatalf("refreshed value not cached: %v", cachedValue(cache, key))
+	}
+	loader.block = nil
+
+	// hard expired is a miss
+	clock.Advance(25 * time.Second)
+	if cache.Lookup(key) != nil {
+		t.Errorf("hard expired entry should be a miss")
+	}
+	if value, _ := cache.Get(key); value != "k-3" {
+		t.Errorf("expected synchronous load, got: %v", value)
+	}
+	stats := cache.Stats()
+	if stats.Loads != 2 || stats.StaleHits != 5 || stats.Misses != 3 || stats.Hits != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLoadingCache_Grace(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	loader := &testLoader{}
+	cache := NewLoadingCache(NewLRUCache(1024*1024, 1), loader.load, LoadingOptions{
+		SoftTTL: 10 * time.Second, HardTTL: 20 * time.Second, Grace: 30 * time.Second,
+		RetryInterval: time.Second, Now: clock.Now,
+	})
+	defer cache.Close()
+	key := []byte("k")
+	cache.Get(key)
+
+	atomic.StoreInt32(&loader.fail, 1)
+	clock.Advance(15 * time.Second)
+	cache.Get(key)
+	if !eventually(func() bool { return cache.Stats().RefreshFailures == 1 }) {
+		t.Fatalf("refresh should fail")
+	}
+	// past hard deadline, inside grace
+	clock.Advance(20 * time.Second)
+	if value, err := cache.Get(key); err != nil || value != "k-1" {
+		t.Errorf("stale value expected in grace, got: %v, %v", value, err)
+	}
+	// past grace
+	clock.Advance(20 * time.Second)
+	if value, err := cache.Get(key); err == nil {
+		t.Errorf("expected load error after grace, got: %v", value)
+	}
+
+	atomic.StoreInt32(&loader.fail, 0)
+	if value, err := cache.Get(key); err != nil || value == "k-1" {
+		t.Errorf("expected new value after source recover, got: %v, %v", value, err)
+	}
+}
+
+func TestLoadingCache_InvalidateDuringLoad(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	loader := &testLoader{}
+	cache := NewLoadingCache(NewLRUCache(1024*1024, 1), loader.load,
+		LoadingOptions{SoftTTL: 10 * time.Second, Now: clock.Now})
+	defer cache.Close()
+	key := []byte("k")
+	cache.Get(key)
+
+	// refresh read before the invalidation, it must not be cached
+	loader.block = make(chan struct{})
+	clock.Advance(15 * time.Second)
+	cache.Get(key)
+	cache.Invalidate(key)
+	close(loader.block)
+	cache.Close()
+	if value := cache.Cache().Lookup(key); value != nil {
+		t.Errorf("refresh wrote back after invalidate: %v", value)
+	}
+
+	// so does a synchronous load
+	block := make(chan struct{})
+	loader.block = block
+	done := make(chan interface{})
+	go func() {
+		value, _ := cache.Get([]byte("other"))
+		done <- value
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cache.Invalidate([]byte("other"))
+	close(block)
+	if value := <-done; value == nil {
+		t.Errorf("caller should still get loaded value")
+	}
+	if value := cache.Cache().Lookup([]byte("other")); value != nil {
+		t.Errorf("load wrote back after invalidate: %v", value)
+	}
+}
+
+func TestLoadingCache_EarlyRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	var loads int32
+	loader := func(key []byte) (interface{}, uint64, error) {
+		atomic.AddInt32(&loads, 1)
+		clock.Advance(time.Second) // a slow source
+		return "value", 0, nil
+	}
+	cache := NewLoadingCache(NewLRUCache(1024*1024, 1), loader,
+		LoadingOptions{SoftTTL: 10 * time.Second, EarlyRefreshBeta: 10, Now: clock.Now})
+	defer cache.Close()
+	cache.Get([]byte("k"))
+
+	// far from soft deadline nothing is refreshed
+	for i := 0; i < 100; i++ {
+		cache.Get([]byte("k"))
+	}
+	if early := cache.Stats().EarlyRefreshes; early > 5 {
+		t.Errorf("too many early refreshes: %d", early)
+	}
+	clock.Advance(9 * time.Second)
+	for i := 0; i < 100 && cache.Stats().EarlyRefreshes == 0; i++ {
+		cache.Get([]byte("k"))
+	}
+	if cache.Stats().EarlyRefreshes == 0 {
+		t.Errorf("expected early refresh close to soft deadline")
+	}
+}
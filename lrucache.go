@@ -18,6 +18,7 @@
 package lrucache
 
 import (
+	"bytes"
 	"sync"
 	"sync/atomic"
 )
@@ -29,6 +30,8 @@ type LRUCache struct {
 	capacity       uint64;
 	num_shard_bits uint; // must < 10
 	mutex          sync.Mutex
+	txn_mutex      sync.RWMutex // Txn commits hold it shared, whole cache travels exclusive
+	watches        *watchRegistry
 }
 
 func NewLRUCache(capacity uint64, num_shard_bits uint) *LRUCache {
@@ -45,12 +48,16 @@ func NewLRUCache(capacity uint64, num_shard_bits uint) *LRUCache {
 		num_shard_bits: num_shard_bits,
 		capacity:       capacity,
 		atomic_last_id: 1,
+		watches:        newWatchRegistry(),
 	}
 
 	num_shards := 1 << num_shard_bits
 	per_shard := getPerfShardCapacity(capacity, num_shard_bits);
 	for i := 0; i < num_shards; i++ {
-		cache.shards = append(cache.shards, NewLRUCacheShard(per_shard))
+		shard := NewLRUCacheShard(per_shard)
+		shard.ids = &cache.atomic_last_id
+		shard.watches = cache.watches
+		cache.shards = append(cache.shards, shard)
 	}
 
 	return cache
@@ -94,6 +101,12 @@ func (this *LRUCache) TotalCharge() uint64 {
 	return total;
 }
 
+func (this *LRUCache) Capacity() uint64 {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	return this.capacity
+}
+
 func (this *LRUCache) shard(hash uint32) uint32 {
 	if (this.num_shard_bits > 0) {
 		return hash >> (32 - this.num_shard_bits)
@@ -122,23 +135,136 @@ func (this *LRUCache) Merge(key []byte, entry interface{}, charge uint64, merge_
 	return this.shards[this.shard(hash)].Merge(key, hash, entry, charge, merge_opt, charge_opt);
 }
 
+/**
+Compute run compute_fun with the entry of key under shard lock, and keep, replace or
+delete it by the returned action, so read-modify-write of any type is atomic.
+return entry of key after it. compute_fun must not use the cache
+*/
+func (this *LRUCache) Compute(key []byte, compute_fun ComputeOperator) (interface{}, bool) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].Compute(key, hash, compute_fun);
+}
+
 func (this *LRUCache) ApplyToAllCacheEntries(travel_fun TravelEntryOperator) {
 	this.mutex.Lock();
 	defer this.mutex.Unlock();
+	this.txn_mutex.Lock();
+	defer this.txn_mutex.Unlock();
 	for _, shard := range this.shards {
 		shard.ApplyToAllCacheEntries(travel_fun)
 	}
 }
 
+func (this *LRUCache) ApplyToAllCacheEntriesWithCharge(travel_fun TravelChargeOperator) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	this.txn_mutex.Lock();
+	defer this.txn_mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.ApplyToAllCacheEntriesWithCharge(travel_fun)
+	}
+}
+
+/**
+ApplyToAllCacheEntriesInLRUOrder is ApplyToAllCacheEntriesWithCharge going from oldest
+to newest entry of every shard; inserting them in this order rebuild the lru order
+*/
+func (this *LRUCache) ApplyToAllCacheEntriesInLRUOrder(travel_fun TravelChargeOperator) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	this.txn_mutex.Lock();
+	defer this.txn_mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.ApplyToAllCacheEntriesInLRUOrder(travel_fun)
+	}
+}
+
+/**
+Peek return entry and its charge, lru order is not changed
+*/
+func (this *LRUCache) Peek(key []byte) (interface{}, uint64, bool) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].Peek(key, hash);
+}
+
+/**
+RemovePrefix remove all entries whose key start with prefix, tombstones and
+entries in secondary cache too; return number removed
+*/
+func (this *LRUCache) RemovePrefix(prefix []byte) int {
+	// secondary first: keys evicted meanwhile are still found in memory below,
+	// and Remove erase them from secondary
+	removed := this.shards[0].secondary_erase_prefix(prefix)
+	var keys [][]byte
+	this.ApplyToAllCacheEntriesWithTombstones(func(key []byte, entry interface{}) {
+		if bytes.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		if this.Remove(key) != nil {
+			removed++
+		}
+	}
+	return removed
+}
+
 func (this *LRUCache) SetCapacity(capacity uint64)  {
 	this.mutex.Lock();
 	defer this.mutex.Unlock();
+	this.capacity = capacity
 	per_shard := getPerfShardCapacity(capacity, this.num_shard_bits)
 	for _, shard := range this.shards {
 		shard.SetCapacity(per_shard)
 	}
 }
 
+/**
+with FullChargeCacheMetadata every entry is also charged for its LRUHandle and key,
+so capacity reflects real heap usage. set it before inserting entries.
+*/
+func (this *LRUCache) SetMetadataChargePolicy(policy MetadataChargePolicy) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetMetadataChargePolicy(policy)
+	}
+}
+
+/**
+evicted entries are serialized by codec and handed to secondary; Lookup and Merge
+miss will promote them back. entries codec can't encode are just dropped.
+*/
+func (this *LRUCache) SetSecondaryCache(secondary SecondaryCache, codec EntryCodec) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetSecondaryCache(secondary, codec)
+	}
+}
+
+/**
+entries in the oldest cold_ratio part of capacity are encoded by codec and compressed,
+and charged at their compressed size; Lookup decompress them.
+compressor nil turn it off.
+*/
+func (this *LRUCache) SetCompressedTier(compressor Compressor, codec EntryCodec, cold_ratio float64) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetCompressedTier(compressor, codec, cold_ratio)
+	}
+}
+
+func (this *LRUCache) CompressionStats() CompressionStats {
+	var stats CompressionStats
+	for _, shard := range this.shards {
+		shard_stats := shard.CompressionStats()
+		stats.add(&shard_stats)
+	}
+	return stats
+}
+
 func getPerfShardCapacity(capacity uint64, num_shard_bits uint) uint64 {
 	num_shards := 1 << num_shard_bits
 	return (capacity + uint64(num_shards-1)) / uint64(num_shards);
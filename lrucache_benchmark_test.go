@@ -76,4 +76,13 @@ func BenchmarkLRUCache_InsertRand(b *testing.B) {
 		key := (randbyte[i: i+5])
 		lru.Insert(key, nil, 1000, nil)
 	}
-}
\ No newline at end of file
+}
+
+func BenchmarkCompactLRUCache_InsertRand(b *testing.B) {
+	compact := NewCompactLRUCache(1024*1024*1, 1)
+	randbyte := RandomCreateBytes(b.N+5)
+	for i := 0; i < b.N; i++ {
+		key := (randbyte[i: i+5])
+		compact.Insert(key, nil, 1000, nil)
+	}
+}
@@ -20,6 +20,8 @@ package lrucache
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LRUCacheShard struct {
@@ -27,15 +29,64 @@ type LRUCacheShard struct {
 	mutex      sync.Mutex
 	usage      uint64    // usage of memory
 	lrulist    LRUHandle // head of lru list;    lru.prev is newest entry, lru.next is oldest entry
-	table      HandleTable
+	table      handleIndex
 	handlePool sync.Pool
+
+	metadata_charge_policy MetadataChargePolicy
+
+	secondary SecondaryCache
+	codec     EntryCodec
+
+	compressor    Compressor
+	tier_codec    EntryCodec
+	cold_ratio    float64
+	cold_boundary *LRUHandle // newest cold entry; entries after it are hot
+	hot_usage     uint64
+	compression   CompressionStats
+
+	sample_rate   uint32
+	sample_state  uint32
+	max_tracked   int
+	access_counts map[string]uint64 // sampled lookup hits
+
+	digest *countingBloom // shared by all shards
+
+	leases      map[string]*lease // nil until LookupOrLease is used
+	lease_ttl   time.Duration
+	lease_sweep int
+
+	negative NegativeCacheOptions // zero until SetNegativeCaching
+
+	ids *uint64 // version counter, shared with NewId of cache
+
+	watches        *watchRegistry // nil for a shard not in LRUCache
+	events         []pendingEvent // sent by unlock
+	dispatch_mutex sync.Mutex
+	merging        bool // insert is done by Merge
+	promoting      bool // insert is done by secondary_promote; not a change
+
+	flusher     Flusher
+	max_dirty   uint64 // 0 is capacity, see dirty_limit
+	dirty_usage uint64
+	dirty_cond  *sync.Cond // signaled when dirty_usage drops
 }
 
+// why a handle leave the cache
+type removeReason int
+
+const (
+	reasonRemoved removeReason = iota
+	reasonReplaced
+	reasonEvicted
+	reasonPruned
+	reasonExpired
+)
+
 func NewLRUCacheShard(capacity uint64) *LRUCacheShard {
 	lru_shared := &LRUCacheShard{
 		capacity: 0,
 		usage:    0,
-		table:    *NewLRUHandleTable(),
+		table:    NewLRUHandleTable(),
 		handlePool: sync.Pool{
 			New: func() interface{} {
 				return new(LRUHandle)
@@ -45,6 +96,9 @@ func NewLRUCacheShard(capacity uint64) *LRUCacheShard {
 
 	lru_shared.lrulist.next = &(lru_shared.lrulist)
 	lru_shared.lrulist.prev = &(lru_shared.lrulist)
+	lru_shared.cold_boundary = &(lru_shared.lrulist)
+	lru_shared.dirty_cond = sync.NewCond(&lru_shared.mutex)
+	lru_shared.ids = new(uint64)
 	lru_shared.SetCapacity(capacity)
 
 	return lru_shared
@@ -58,7 +112,8 @@ func (this *LRUCacheShard) Insert(key []byte, hash uint32, entry interface{}, ch
 	// If the cache is full, we'll have to release it
 	// It shouldn't happen very often though.
 	this.mutex.Lock();
-	defer this.mutex.Unlock()
+	defer this.unlock()
+	this.invalidate_lease(key, nil)
 	return this.insert(key, hash, entry, charge, deleter)
 }
 
@@ -67,18 +122,28 @@ find key's lruhandle, return nil if not find;
 */
 func (this *LRUCacheShard) Lookup(key []byte, hash uint32) interface{} {
 	this.mutex.Lock();
-	defer this.mutex.Unlock()
+	defer this.unlock()
 	e := this.handle_lookup_update(key, hash);
 	if e != nil {
+		if !this.live_handle(e) {
+			return nil
+		}
+		this.record_access(key)
 		return e.entry
 	}
-	return nil;
+	return this.secondary_promote(key, hash);
 }
 
 func (this *LRUCacheShard) Merge(key []byte, hash uint32, entry interface{}, charge uint64, merge MergeOperator, charge_opt ChargeOperator) (interface{}) {
 	this.mutex.Lock();
-	defer this.mutex.Unlock();
+	defer this.unlock()
 	e := this.handle_lookup_update(key, hash)
+	if e != nil && isTombstone(e.entry) {
+		// merge into nothing; insert below replace the tombstone
+		e = nil
+	} else if e == nil && this.secondary_promote(key, hash) != nil {
+		e = this.handle_lookup(key, hash)
+	}
 	var new_value interface{}
 	var new_charge uint64
 	var res interface{}
@@ -87,54 +152,223 @@ func (this *LRUCacheShard) Merge(key []byte, hash uint32, entry interface{}, cha
 		res = e.entry
 		deleter = e.deleter
 		new_value = merge(e.entry, entry)
-		new_charge = charge_opt(entry, e.charge, charge)
+		new_charge = charge_opt(entry, this.user_charge(e), charge)
 	} else {
 		res = nil
 		new_value = merge(nil, entry)
 		new_charge = charge_opt(entry, 0, charge)
 	}
+	this.invalidate_lease(key, nil)
+	this.merging = true
 	this.insert(key, hash, new_value, new_charge, deleter)
+	this.merging = false
 	return res
 }
 
+/**
+tombstone is a missing entry for compute_fun; ActionDelete remove it too
+*/
+func (this *LRUCacheShard) Compute(key []byte, hash uint32, compute_fun ComputeOperator) (interface{}, bool) {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.handle_lookup_update(key, hash)
+	if e == nil && this.secondary_promote(key, hash) != nil {
+		e = this.handle_lookup(key, hash)
+	}
+	var old interface{}
+	var deleter DeleteCallback = nil
+	exists := e != nil && !isTombstone(e.entry)
+	if exists {
+		old = e.entry
+		deleter = e.deleter
+	}
+	entry, charge, action := compute_fun(old, exists)
+	switch action {
+	case ActionReplace:
+		this.invalidate_lease(key, nil)
+		this.insert(key, hash, entry, charge, deleter)
+		return entry, true
+	case ActionDelete:
+		if e != nil {
+			this.invalidate_lease(key, this.lru_remove(key, hash))
+		}
+		return nil, false
+	}
+	return old, exists
+}
+
 func (this *LRUCacheShard) Remove(key []byte, hash uint32) interface{} {
 	this.mutex.Lock();
-	defer this.mutex.Unlock();
-	return this.lru_remove(key, hash)
+	defer this.unlock()
+	entry := this.lru_remove(key, hash)
+	this.invalidate_lease(key, entry)
+	return entry
 }
 
 func (this *LRUCacheShard) ApplyToAllCacheEntries(travel_fun TravelEntryOperator) {
 	this.mutex.Lock();
-	defer this.mutex.Unlock();
-	this.table.ApplyToAllCacheEntries(travel_fun)
+	defer this.unlock()
+	this.table.ApplyToAllHandles(func(h *LRUHandle) {
+		if isTombstone(h.entry) {
+			return
+		}
+		entry, _ := this.handle_value(h)
+		if corrupt(h, entry) {
+			return
+		}
+		travel_fun(h.key, entry)
+	})
 }
 
+/**
+charge is what caller gave, without cache metadata
+*/
+func (this *LRUCacheShard) ApplyToAllCacheEntriesWithCharge(travel_fun TravelChargeOperator) {
+	this.mutex.Lock();
+	defer this.unlock()
+	this.table.ApplyToAllHandles(func(h *LRUHandle) {
+		if isTombstone(h.entry) {
+			return
+		}
+		entry, charge := this.handle_value(h)
+		if corrupt(h, entry) {
+			return
+		}
+		travel_fun(h.key, entry, charge)
+	})
+}
+
+func (this *LRUCacheShard) ApplyToAllCacheEntriesInLRUOrder(travel_fun TravelChargeOperator) {
+	this.mutex.Lock();
+	defer this.unlock()
+	for h := this.lrulist.next; h != &this.lrulist; h = h.next {
+		if isTombstone(h.entry) {
+			continue
+		}
+		entry, charge := this.handle_value(h)
+		if corrupt(h, entry) {
+			continue
+		}
+		travel_fun(h.key, entry, charge)
+	}
+}
+
+/**
+find entry and its charge without updating lru order
+*/
+func (this *LRUCacheShard) Peek(key []byte, hash uint32) (interface{}, uint64, bool) {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.handle_lookup(key, hash)
+	if e == nil {
+		return nil, 0, false
+	}
+	if tombstone, ok := e.entry.(*Tombstone); ok && !time.Now().Before(tombstone.Expires) {
+		return nil, 0, false
+	}
+	entry, charge := this.handle_value(e)
+	if corrupt(e, entry) {
+		this.drop_corrupt(e)
+		return nil, 0, false
+	}
+	return entry, charge, true
+}
+
+/**
+dirty entries are flushed before they are removed, like eviction; the ones can't be are kept
+*/
 func (this *LRUCacheShard) Prune() {
 	this.mutex.Lock();
-	defer this.mutex.Unlock();
-	for this.lrulist.next != &this.lrulist {
-		e := this.lrulist.next;
-		this.lru_remove_handle(e, true)
+	defer this.unlock()
+	for e := this.lrulist.next; e != &this.lrulist; {
+		next := e.next
+		if !e.dirty || this.flush_handle(e) {
+			this.lru_remove_handle(e, true, reasonPruned)
+		}
+		e = next
 	}
+	// secondary is shared by shards; pruned keys must not be promoted back
+	if this.secondary != nil {
+		this.secondary.Clear()
+	}
+	this.leases = nil
 }
 
 func (this *LRUCacheShard) SetCapacity(capacity uint64) {
 	this.mutex.Lock()
-	defer this.mutex.Unlock()
+	defer this.unlock()
 	this.capacity = capacity
 	this.EvictLRU()
 }
 
+func (this *LRUCacheShard) SetMetadataChargePolicy(policy MetadataChargePolicy) {
+	this.mutex.Lock()
+	defer this.unlock()
+	this.metadata_charge_policy = policy
+}
+
+func (this *LRUCacheShard) SetSecondaryCache(secondary SecondaryCache, codec EntryCodec) {
+	this.mutex.Lock()
+	defer this.unlock()
+	this.secondary = secondary
+	this.codec = codec
+}
+
+/**
+compressor nil turn off compressed tier
+*/
+func (this *LRUCacheShard) SetCompressedTier(compressor Compressor, codec EntryCodec, cold_ratio float64) {
+	this.mutex.Lock()
+	defer this.unlock()
+	// entries compressed by old compressor must be restored
+	if this.compressor != nil {
+		for e := this.lrulist.next; e != &this.lrulist; {
+			next := e.next
+			if !e.compressed || this.decompress_handle(e) {
+				e.cold = false
+			}
+			e = next
+		}
+		this.cold_boundary = &this.lrulist
+		this.hot_usage = this.usage
+	}
+	this.compressor = compressor
+	this.tier_codec = codec
+	this.cold_ratio = cold_ratio
+	this.EvictLRU()
+	this.maybe_compress()
+}
+
+func (this *LRUCacheShard) CompressionStats() CompressionStats {
+	this.mutex.Lock()
+	defer this.unlock()
+	return this.compression
+}
+
 func (this *LRUCacheShard) TotalCharge() uint64 {
 	this.mutex.Lock();
-	defer this.mutex.Unlock();
+	defer this.unlock()
 	return this.usage;
 }
 
 /*********** lru method *************/
 
 func (this *LRUCacheShard) insert(key []byte, hash uint32, entry interface{}, charge uint64, deleter DeleteCallback) error {
+	_, err := this.insert_handle(key, hash, entry, charge, deleter, false)
+	return err
+}
+
+/**
+insert_handle insert entry with a new version and return the version
+*/
+func (this *LRUCacheShard) insert_handle(key []byte, hash uint32, entry interface{}, charge uint64, deleter DeleteCallback, dirty bool) (uint64, error) {
 	var err error
+	if charge == 0 {
+		charge = EstimateSize(entry)
+	}
+	if this.metadata_charge_policy == FullChargeCacheMetadata {
+		charge += metadataCharge(key)
+	}
 	e := this.handlePool.Get()
 	handle := e.(*LRUHandle)
 	handle.entry = entry
@@ -142,6 +376,14 @@ func (this *LRUCacheShard) insert(key []byte, hash uint32, entry interface{}, ch
 	handle.charge = charge
 	handle.hash = hash
 	handle.key = key
+	handle.compressed = false
+	// writes over an unflushed entry keep it dirty, so its data is flushed on eviction
+	if old := this.handle_lookup(key, hash); old != nil && old.dirty && !isTombstone(entry) {
+		dirty = true
+	}
+	handle.dirty = dirty
+	handle.version = atomic.AddUint64(this.ids, 1)
+	version := handle.version
 
 	// if capacity == 0; will turn off caching
 	if this.capacity > 0 {
@@ -151,8 +393,9 @@ func (this *LRUCacheShard) insert(key []byte, hash uint32, entry interface{}, ch
 	}
 
 	this.EvictLRU()
+	this.maybe_compress()
 
-	return err
+	return version, err
 }
 
 func (this *LRUCacheShard) handle_lookup(key []byte, hash uint32) *LRUHandle {
@@ -163,16 +406,52 @@ func (this *LRUCacheShard) handle_lookup(key []byte, hash uint32) *LRUHandle {
 func (this *LRUCacheShard) handle_lookup_update(key []byte, hash uint32) *LRUHandle {
 	e := this.table.Lookup(key, hash);
 	if (e != nil) {
+		if !e.compressed {
+			this.list_update(e)
+			return e
+		}
+		if !this.decompress_handle(e) {
+			return nil
+		}
 		this.list_update(e)
+		// entry grow back to raw size
+		this.maybe_compress()
+		this.evict_before(e)
 	}
 	return e;
 }
 
 func (this *LRUCacheShard) EvictLRU() {
-	for this.usage > this.capacity && this.lrulist.next != &this.lrulist {
-		old := this.lrulist.next
-		this.lru_remove_handle(old, true)
+	this.evict_before(&this.lrulist)
+}
+
+/**
+evict oldest entries until usage fit capacity, not going past stop;
+dirty ones are flushed first, or skipped if they can't be
+*/
+func (this *LRUCacheShard) evict_before(stop *LRUHandle) {
+	e := this.lrulist.next
+	for this.usage > this.capacity && e != stop {
+		next := e.next
+		if !e.dirty || this.flush_handle(e) {
+			this.lru_remove_handle(e, true, reasonEvicted)
+		}
+		e = next
+	}
+}
+
+/**
+charge of handle without cache metadata; that's what caller gave us
+*/
+func (this *LRUCacheShard) user_charge(e *LRUHandle) uint64 {
+	if this.metadata_charge_policy == FullChargeCacheMetadata {
+		meta := metadataCharge(e.key)
+		if e.charge > meta {
+			return e.charge - meta
+		}
+		return 0
 	}
+	return e.charge
 }
 
 /*********** lru method *************/
@@ -180,8 +459,12 @@ func (this *LRUCacheShard) EvictLRU() {
 func (this *LRUCacheShard) lru_remove(key []byte, hash uint32) interface{} {
 	e := this.handle_lookup(key, hash);
 	if e != nil {
-		this.lru_remove_handle(e, true)
-		return e.entry
+		entry, _ := this.handle_value(e)
+		this.lru_remove_handle(e, true, reasonRemoved)
+		return entry
+	}
+	if this.secondary != nil {
+		this.secondary.Erase(key)
 	}
 	return nil
 }
@@ -190,13 +473,34 @@ func (this *LRUCacheShard) lru_remove(key []byte, hash uint32) interface{} {
 lru Remove; if table Insert return's handle, it's aready removed from table,
 so also_table is flase
 */
-func (this *LRUCacheShard) lru_remove_handle(e *LRUHandle, also_table bool) {
+func (this *LRUCacheShard) lru_remove_handle(e *LRUHandle, also_table bool, reason removeReason) {
 	if also_table {
 		this.table.Remove(e.key, e.hash)
 	}
+	switch reason {
+	case reasonRemoved, reasonPruned:
+		this.emit(EventRemoved, e)
+	case reasonEvicted:
+		this.emit(EventEvicted, e)
+	case reasonExpired:
+		this.emit(EventExpired, e)
+	}
 	this.list_remove(e)
+	if this.digest != nil && reason != reasonReplaced {
+		this.digest.remove(e.key)
+	}
+	if this.secondary != nil && reason == reasonEvicted {
+		this.secondary_demote(e)
+	}
 	if (e.deleter != nil) {
-		e.deleter(e.key, e.entry)
+		entry, _ := this.handle_value(e)
+		e.deleter(e.key, entry)
+	}
+	if e.compressed {
+		this.compression.CompressedEntries--
+	}
+	if e.dirty {
+		this.clean_handle(e)
 	}
 	this.usage -= e.charge;
 	this.handlePool.Put(e)
@@ -205,16 +509,93 @@ func (this *LRUCacheShard) lru_remove_handle(e *LRUHandle, also_table bool) {
 func (this *LRUCacheShard) lru_insert(e *LRUHandle, charge uint64) {
 	this.list_append(e)
 	this.usage += charge
+	if e.dirty {
+		this.dirty_usage += charge
+	}
 	old := this.table.Insert(e)
+	if !this.promoting {
+		switch {
+		case this.merging:
+			this.emit(EventMerged, e)
+		case old != nil:
+			this.emit(EventReplaced, e)
+		default:
+			this.emit(EventInserted, e)
+		}
+	}
 	if old != nil {
 		//don't need table.Remove; it's aready removed
-		this.lru_remove_handle(old, false)
+		this.lru_remove_handle(old, false, reasonReplaced)
+		return
+	}
+	if this.digest != nil {
+		this.digest.add(e.key)
+	}
+	if this.secondary != nil {
+		// drop older copy, it would come back after this one is removed
+		this.secondary.Erase(e.key)
 	}
 }
 
+/*********** secondary cache method *************/
+
+func (this *LRUCacheShard) secondary_demote(e *LRUHandle) {
+	if isTombstone(e.entry) {
+		return
+	}
+	entry, charge := this.handle_value(e)
+	value, err := encodeSecondaryValue(this.codec, entry, charge)
+	if err != nil {
+		return
+	}
+	this.secondary.Insert(e.key, value)
+}
+
+/**
+secondary is shared by shards, any of them can erase prefix of all keys
+*/
+func (this *LRUCacheShard) secondary_erase_prefix(prefix []byte) int {
+	this.mutex.Lock()
+	defer this.unlock()
+	if this.secondary == nil {
+		return 0
+	}
+	return this.secondary.ErasePrefix(prefix)
+}
+
+/**
+move entry from secondary cache back to memory, return nil if not find;
+promoted entry has no deleter
+*/
+func (this *LRUCacheShard) secondary_promote(key []byte, hash uint32) interface{} {
+	if this.secondary == nil {
+		return nil
+	}
+	value, ok := this.secondary.Lookup(key)
+	if !ok {
+		return nil
+	}
+	entry, charge, err := decodeSecondaryValue(this.codec, value)
+	if err != nil {
+		this.secondary.Erase(key)
+		return nil
+	}
+	key = append([]byte(nil), key...)
+	this.promoting = true
+	this.insert(key, hash, entry, charge, nil)
+	this.promoting = false
+	return entry
+}
+
 /*********** lru list method *************/
 
 func (this *LRUCacheShard) list_remove(e *LRUHandle) {
+	if e == this.cold_boundary {
+		this.cold_boundary = e.prev
+	}
+	if !e.cold {
+		this.hot_usage -= e.charge
+	}
 	e.next.prev = e.prev
 	e.prev.next = e.next
 }
@@ -228,6 +609,8 @@ func (this *LRUCacheShard) list_append(e *LRUHandle) {
 	e.prev = list.prev;
 	e.prev.next = e;
 	e.next.prev = e;
+	e.cold = false
+	this.hot_usage += e.charge
 }
 
 func (this *LRUCacheShard) list_update(e *LRUHandle) {
@@ -19,8 +19,14 @@ package lrucache
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var case_shard_bits = []struct {
@@ -393,6 +399,22 @@ func TestLRUCache_ApplyToAllCacheEntries(t *testing.T) {
 	}
 }
 
+func TestLRUCache_ApplyToAllCacheEntriesInLRUOrder(t *testing.T) {
+	// one shard, so order is global
+	lru := NewLRUCache(1024, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		lru.Insert([]byte(key), key, 1, nil)
+	}
+	lru.Lookup([]byte("a"))
+	var order []string
+	lru.ApplyToAllCacheEntriesInLRUOrder(func(key []byte, entry interface{}, charge uint64) {
+		order = append(order, string(key))
+	})
+	if strings.Join(order, ",") != "b,c,a" {
+		t.Errorf("expected oldest first: b,c,a, got: %v", order)
+	}
+}
+
 func TestLRUCache_SetCapacity(t *testing.T) {
 
 	lru := NewLRUCache(1024*1024, 1)
@@ -435,4 +457,812 @@ func TestLRUCache_Prune(t *testing.T) {
 	if lru.TotalCharge() != 0 {
 		t.Errorf("turn off cache, but totalusage already has:%v", lru.TotalCharge())
 	}
-}
\ No newline at end of file
+}
+type sized_entry struct {
+	data []byte
+}
+
+func (this *sized_entry) Size() uint64 {
+	return 1000
+}
+
+func TestEstimateSize(t *testing.T) {
+	type node struct {
+		name string
+		next *node
+	}
+	a := &node{name: "aaaa"}
+	b := &node{name: "bbbb", next: a}
+	a.next = b // cycle must not loop forever
+
+	var cases = []struct {
+		entry    interface{}
+		expected uint64
+	}{
+		{nil, 0},
+		{int64(1), 8},
+		{"value", 16 + 5},
+		{[]byte("value"), 24 + 5},
+		{&sized_entry{}, 1000},
+		{a, 8 + 2*(16+8+4)},
+	}
+	for _, test := range cases {
+		if size := EstimateSize(test.entry); size != test.expected {
+			t.Errorf("EstimateSize(%#v) expected: %v, got: %v", test.entry, test.expected, size)
+		}
+	}
+
+	m := map[string][]int32{"k": {1, 2}}
+	if size := EstimateSize(m); size < 8+uint64(len(m))*(16+24)+1+8 {
+		t.Errorf("EstimateSize of map too small: %v", size)
+	}
+}
+
+func TestLRUCache_ChargeEstimate(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	lru.Insert([]byte("key"), &sized_entry{}, 0, nil)
+	if lru.TotalCharge() != 1000 {
+		t.Errorf("charge should estimate from Sizer, expected: 1000, got: %v", lru.TotalCharge())
+	}
+	lru.Remove([]byte("key"))
+
+	lru.SetMetadataChargePolicy(FullChargeCacheMetadata)
+	lru.Insert([]byte("key"), "value", 10, nil)
+	if expected := 10 + metadataCharge([]byte("key")); lru.TotalCharge() != expected {
+		t.Errorf("metadata charge expected: %v, got: %v", expected, lru.TotalCharge())
+	}
+	lru.Merge([]byte("key"), "1", 1, func(old_entry, new_entry interface{}) interface{} {
+		return old_entry.(string) + new_entry.(string)
+	}, func(entry interface{}, old_charge, new_charge uint64) uint64 {
+		return old_charge + new_charge
+	})
+	if expected := 11 + metadataCharge([]byte("key")); lru.TotalCharge() != expected {
+		t.Errorf("metadata charge after merge expected: %v, got: %v", expected, lru.TotalCharge())
+	}
+	lru.Remove([]byte("key"))
+	if lru.TotalCharge() != 0 {
+		t.Errorf("charge after remove expected: 0, got: %v", lru.TotalCharge())
+	}
+}
+
+func TestLRUCache_CompressedTier(t *testing.T) {
+	lru := NewLRUCache(64*1024, 1)
+	lru.SetCompressedTier(FlateCompressor{}, StringCodec{}, 0.5)
+
+	var deleted = 0
+	value := string(bytes.Repeat([]byte("0123456789"), 100))
+	for i := 0; i < 100; i++ {
+		key := []byte(strconv.Itoa(i))
+		lru.Insert(key, value+string(key), 0, func(key []byte, entry interface{}) {
+			deleted++
+			if entry.(string) != value+string(key) {
+				t.Errorf("deleter got compressed entry of key:%s", key)
+			}
+		})
+	}
+	if lru.TotalCharge() > 64*1024 {
+		t.Errorf("total charge %v over capacity", lru.TotalCharge())
+	}
+
+	stats := lru.CompressionStats()
+	if stats.CompressedEntries == 0 || stats.Ratio() <= 1 {
+		t.Fatalf("no entry is compressed, stats:%+v", stats)
+	}
+	// 100 entries of 1KB can't fit in 64KB without compression
+	if deleted != 0 {
+		t.Errorf("%d entries evicted", deleted)
+	}
+
+	var count = 0
+	lru.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		count++
+		if entry.(string) != value+string(key) {
+			t.Errorf("ApplyToAllCacheEntries got compressed entry of key:%s", key)
+		}
+	})
+	if count != 100 {
+		t.Errorf("ApplyToAllCacheEntries count expected: 100, got: %d", count)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if origin, _ := lru.Lookup([]byte(key)).(string); origin != value+key {
+			t.Errorf("lookup key:%s got wrong value", key)
+		}
+	}
+	if lru.CompressionStats().Decompressions == 0 {
+		t.Errorf("lookup of cold entries should decompress")
+	}
+
+	lru.SetCompressedTier(nil, nil, 0)
+	if lru.CompressionStats().CompressedEntries != 0 {
+		t.Errorf("turn off compressed tier left %v compressed entries", lru.CompressionStats().CompressedEntries)
+	}
+	lru.Prune()
+	if lru.TotalCharge() != 0 || deleted != 100 {
+		t.Errorf("prune left charge:%v, deleted:%d", lru.TotalCharge(), deleted)
+	}
+}
+
+type faultyCompressor struct {
+	FlateCompressor
+	fail bool
+}
+
+func (this *faultyCompressor) Decompress(data []byte) ([]byte, error) {
+	if this.fail {
+		return nil, errors.New("corrupt data")
+	}
+	return this.FlateCompressor.Decompress(data)
+}
+
+func TestLRUCache_CompressedTierCorrupt(t *testing.T) {
+	lru := NewLRUCache(64*1024, 0)
+	compressor := &faultyCompressor{}
+	lru.SetCompressedTier(compressor, StringCodec{}, 0.5)
+	value := string(bytes.Repeat([]byte("0123456789"), 100))
+	for i := 0; i < 100; i++ {
+		lru.Put(strconv.Itoa(i), value)
+	}
+	compressed := lru.CompressionStats().CompressedEntries
+	if compressed == 0 {
+		t.Fatalf("no entry is compressed")
+	}
+
+	// corrupt entries are misses, not panics
+	compressor.fail = true
+	var found uint64
+	lru.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		found++
+	})
+	if found != 100-compressed {
+		t.Errorf("ApplyToAllCacheEntries should skip corrupt entries, got: %d", found)
+	}
+	var peek_misses, misses uint64
+	for i := 0; i < 100; i++ {
+		if _, _, ok := lru.Peek([]byte(strconv.Itoa(i))); !ok {
+			peek_misses++
+		}
+		if _, ok := lru.Get(strconv.Itoa(i)); !ok {
+			misses++
+		}
+	}
+	stats := lru.CompressionStats()
+	if peek_misses != compressed || misses != compressed || stats.Errors < compressed || stats.CompressedEntries != 0 {
+		t.Errorf("corrupt entries expected dropped, misses: %d, %d, stats: %+v", peek_misses, misses, stats)
+	}
+	lru.Prune()
+	if lru.TotalCharge() != 0 {
+		t.Errorf("charge left after prune: %d", lru.TotalCharge())
+	}
+}
+
+func TestLRUCache_RemovePrefix(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	for _, key := range []string{"user:1", "user:2", "item:1", "user"} {
+		lru.Put(key, "value")
+	}
+	if removed := lru.RemovePrefix([]byte("user:")); removed != 2 {
+		t.Errorf("RemovePrefix expected: 2, got: %d", removed)
+	}
+	if _, ok := lru.Get("user"); !ok {
+		t.Errorf("key without prefix is removed")
+	}
+	if _, ok := lru.Get("user:1"); ok {
+		t.Errorf("key with prefix is still cached")
+	}
+}
+
+func TestLRUCache_HotKeys(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 2)
+	lru.SetAccessSampling(4, 16)
+	for i := 0; i < 100; i++ {
+		lru.Put("key"+strconv.Itoa(i), "value")
+	}
+	for round := 0; round < 100; round++ {
+		lru.Get("hot")
+		lru.Put("hot", "value")
+		for i := 0; i < 20; i++ {
+			lru.Get("hot")
+		}
+		for i := 0; i < 100; i++ {
+			lru.Get("key" + strconv.Itoa(i))
+		}
+	}
+	hot := lru.HotKeys(1000)
+	if len(hot) != 1 || string(hot[0].Key) != "hot" {
+		t.Fatalf("expected only hot key, got %v", hot)
+	}
+	// 2000 hits sampled at 1/4; counts of cold keys were decayed by tracking limit
+	if hot[0].Count < 1000 {
+		t.Errorf("hot key count too low: %d", hot[0].Count)
+	}
+	lru.DecayAccessCounts()
+	if after := lru.HotKeys(0); len(after) == 0 || after[0].Count > hot[0].Count/2+4 {
+		t.Errorf("decay expected to halve counts, before: %d, after: %v", hot[0].Count, after)
+	}
+	lru.SetAccessSampling(0, 0)
+	if len(lru.HotKeys(0)) != 0 {
+		t.Errorf("sampling turned off should forget counts")
+	}
+}
+
+func TestLRUCache_Digest(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 2)
+	if lru.Digest() != nil {
+		t.Errorf("digest should be nil before EnableDigest")
+	}
+	for i := 0; i < 500; i++ {
+		lru.Put("old"+strconv.Itoa(i), "value")
+	}
+	// keys cached before are added too
+	lru.EnableDigest(2000, 0.01)
+	for i := 0; i < 1000; i++ {
+		lru.Put("key"+strconv.Itoa(i), "value")
+	}
+	for i := 0; i < 500; i++ {
+		lru.Remove([]byte("key" + strconv.Itoa(i)))
+	}
+	lru.Put("key999", "replaced")
+
+	digest := lru.Digest()
+	for i := 0; i < 500; i++ {
+		if !digest.MayContain([]byte("old" + strconv.Itoa(i))) {
+			t.Fatalf("old%d missing in digest", i)
+		}
+	}
+	for i := 500; i < 1000; i++ {
+		if !digest.MayContain([]byte("key" + strconv.Itoa(i))) {
+			t.Fatalf("key%d missing in digest", i)
+		}
+	}
+	false_positives := 0
+	for i := 0; i < 500; i++ {
+		if digest.MayContain([]byte("key" + strconv.Itoa(i))) {
+			false_positives++
+		}
+	}
+	if false_positives > 25 {
+		t.Errorf("removed keys still in digest: %d of 500", false_positives)
+	}
+	if rate := digest.FalsePositiveRate(); rate > 0.02 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+
+	data, _ := digest.MarshalBinary()
+	var remote Digest
+	if err := remote.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !remote.MayContain([]byte("key700")) {
+		t.Errorf("unmarshaled digest lost key")
+	}
+	if err := remote.UnmarshalBinary(data[:len(data)-1]); err != ErrBadDigest {
+		t.Errorf("truncated digest expected ErrBadDigest, got: %v", err)
+	}
+	// header only, m = 2^64-1 must not round up to 0 bytes
+	malformed, _ := hex.DecodeString("4c5255440107ffffffffffffffff")
+	if err := remote.UnmarshalBinary(malformed); err != ErrBadDigest {
+		t.Errorf("malformed m expected ErrBadDigest, got: %v", err)
+	}
+	malformed, _ = hex.DecodeString("4c525544010700000000000000ff00")
+	if err := remote.UnmarshalBinary(malformed); err != ErrBadDigest {
+		t.Errorf("m larger than bits expected ErrBadDigest, got: %v", err)
+	}
+	if !remote.MayContain([]byte("key700")) {
+		t.Errorf("failed unmarshal changed digest")
+	}
+
+	// serialized format is read by other nodes, it must not change
+	small := NewLRUCache(1024, 1)
+	small.EnableDigest(10, 0.01)
+	small.Put("apple", "1")
+	small.Put("banana", "2")
+	data, _ = small.Digest().MarshalBinary()
+	if got := hex.EncodeToString(data); got != "4c52554401070000000000000060804000208024490204020001" {
+		t.Errorf("digest format changed: %s", got)
+	}
+}
+
+func TestLRUCache_Lease(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	key := []byte("key")
+
+	_, token, status := lru.LookupOrLease(key)
+	if status != LeaseGranted || token == 0 {
+		t.Fatalf("first miss should get lease, status: %d", status)
+	}
+	// other callers wait for the loader
+	if _, other, status := lru.LookupOrLease(key); status != LeaseWait || other != 0 {
+		t.Errorf("second miss expected LeaseWait, got: %d", status)
+	}
+	if err := lru.InsertWithLease(key, token, "v1", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _, status := lru.LookupOrLease(key); status != LeaseHit || entry != "v1" {
+		t.Errorf("expected hit of v1, got: %v, %d", entry, status)
+	}
+	if err := lru.InsertWithLease(key, token, "again", 5, nil); err != ErrLeaseInvalid {
+		t.Errorf("used lease should be invalid, got: %v", err)
+	}
+
+	// invalidation while loading: loader must not write back what it read before
+	lru.Remove(key)
+	_, token, _ = lru.LookupOrLease(key)
+	entry, _, status := lru.LookupOrLease(key)
+	if status != LeaseWait || entry != "v1" {
+		t.Errorf("waiter expected stale v1, got: %v, %d", entry, status)
+	}
+	lru.Remove(key)
+	if err := lru.InsertWithLease(key, token, "slow", 4, nil); err != ErrLeaseInvalid {
+		t.Errorf("lease should be invalidated by Remove, got: %v", err)
+	}
+	if lru.Lookup(key) != nil {
+		t.Errorf("stale set should not be cached")
+	}
+
+	// a plain Insert also invalidate
+	_, token, _ = lru.LookupOrLease(key)
+	lru.Insert(key, "fresh", 5, nil)
+	if err := lru.InsertWithLease(key, token, "slow", 4, nil); err != ErrLeaseInvalid {
+		t.Errorf("lease should be invalidated by Insert, got: %v", err)
+	}
+	if entry, _ := lru.Get("key"); entry != "fresh" {
+		t.Errorf("expected fresh, got: %v", entry)
+	}
+
+	// released or expired lease go to the next caller
+	lru.Remove(key)
+	_, token, _ = lru.LookupOrLease(key)
+	lru.ReleaseLease(key, token)
+	if _, _, status := lru.LookupOrLease(key); status != LeaseGranted {
+		t.Errorf("released lease should be granted again, got: %d", status)
+	}
+	lru.SetLeaseTimeout(10 * time.Millisecond)
+	lru.Remove([]byte("other"))
+	_, token, _ = lru.LookupOrLease([]byte("other"))
+	time.Sleep(20 * time.Millisecond)
+	if _, _, status := lru.LookupOrLease([]byte("other")); status != LeaseGranted {
+		t.Errorf("expired lease should be granted again, got: %d", status)
+	}
+	if err := lru.InsertWithLease([]byte("other"), token, "late", 4, nil); err != ErrLeaseInvalid {
+		t.Errorf("expired lease should be invalid, got: %v", err)
+	}
+
+	// keys never leased, and tombstones, are not kept as stale values
+	lru.SetLeaseTimeout(time.Second)
+	lru.Put("plain", "value")
+	lru.Remove([]byte("plain"))
+	lru.LookupOrLease([]byte("plain"))
+	if entry, _, status := lru.LookupOrLease([]byte("plain")); status != LeaseWait || entry != nil {
+		t.Errorf("key never leased expected no stale value, got: %v, %d", entry, status)
+	}
+	_, token, _ = lru.LookupOrLease([]byte("gone"))
+	lru.InsertNotFoundWithLease([]byte("gone"), token)
+	lru.Remove([]byte("gone"))
+	lru.LookupOrLease([]byte("gone"))
+	if entry, _, status := lru.LookupOrLease([]byte("gone")); status != LeaseWait || entry != nil {
+		t.Errorf("tombstone should not be a stale value, got: %v, %d", entry, status)
+	}
+
+	// hits and waits don't take ids
+	lru.Put("key", "v")
+	lru.LookupOrLease([]byte("waiting"))
+	id := lru.NewId()
+	lru.LookupOrLease(key)
+	lru.LookupOrLease([]byte("waiting"))
+	if next := lru.NewId(); next != id+1 {
+		t.Errorf("lookups took %d ids", next-id-1)
+	}
+}
+
+func TestLRUCache_NegativeCaching(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	lru.SetNegativeCaching(NegativeCacheOptions{NotFoundTTL: 20 * time.Millisecond, ErrorTTL: 10 * time.Millisecond, MaxErrorTTL: 25 * time.Millisecond, Charge: 10})
+	lru.Insert([]byte("real"), "value", 5, nil)
+
+	lru.InsertNotFound([]byte("missing"))
+	tombstone, ok := lru.Lookup([]byte("missing")).(*Tombstone)
+	if !ok || !tombstone.NotFound() {
+		t.Fatalf("expected not found tombstone, got: %v", lru.Lookup([]byte("missing")))
+	}
+	if total := lru.TotalCharge(); total != 5+uint64(len("missing"))+10 {
+		t.Errorf("unexpected total charge: %d", total)
+	}
+
+	// tombstones are not visited unless asked
+	count := 0
+	lru.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		count++
+	})
+	all := 0
+	lru.ApplyToAllCacheEntriesWithTombstones(func(key []byte, entry interface{}) {
+		all++
+	})
+	if count != 1 || all != 2 {
+		t.Errorf("visited %d entries, %d with tombstones", count, all)
+	}
+
+	// merge treat tombstone as missing value
+	lru.InsertNotFound([]byte("counter"))
+	if old := lru.Merge([]byte("counter"), 1, 4, IntMergeOperator, IntChargeOperator); old != nil {
+		t.Errorf("merge into tombstone got old: %v", old)
+	}
+	if value := lru.Lookup([]byte("counter")); value != 1 {
+		t.Errorf("expected 1 after merge, got: %v", value)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if value := lru.Lookup([]byte("missing")); value != nil {
+		t.Errorf("expired tombstone should be a miss, got: %v", value)
+	}
+	if total := lru.TotalCharge(); total != 5+IntChargeOperator(nil, 0, 0) {
+		t.Errorf("expired not found tombstone should be removed, total charge: %d", total)
+	}
+
+	// consecutive errors back off, up to MaxErrorTTL
+	key := []byte("flaky")
+	err := errors.New("db down")
+	var ttls []time.Duration
+	for i := 0; i < 3; i++ {
+		tombstone := lru.InsertError(key, err)
+		ttls = append(ttls, tombstone.Expires.Sub(time.Now()))
+		if found, ok := lru.Lookup(key).(*Tombstone); !ok || found.Err != err || found.Failures != i+1 {
+			t.Fatalf("expected error tombstone with %d failures, got: %v", i+1, found)
+		}
+	}
+	if ttls[0] > 10*time.Millisecond || ttls[1] <= 10*time.Millisecond || ttls[2] <= 20*time.Millisecond || ttls[2] > 25*time.Millisecond {
+		t.Errorf("unexpected backoff: %v", ttls)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if lru.Lookup(key) != nil {
+		t.Errorf("expired error tombstone should be a miss")
+	}
+	// still remembered for backoff
+	if tombstone := lru.InsertError(key, err); tombstone.Failures != 4 {
+		t.Errorf("expected 4 failures, got %d", tombstone.Failures)
+	}
+	lru.Insert(key, "loaded", 6, nil)
+	if tombstone := lru.InsertError(key, err); tombstone.Failures != 1 {
+		t.Errorf("success should reset backoff, got %d failures", tombstone.Failures)
+	}
+}
+
+func TestLRUCache_DirtyEntries(t *testing.T) {
+	lru := NewLRUCache(100, 0)
+	a := lru.InsertDirty([]byte("a"), "a", 50, nil)
+	b := lru.InsertDirty([]byte("b"), "b", 50, nil)
+
+	// without flusher dirty entries are passed over
+	lru.Insert([]byte("c"), "c", 50, nil)
+	if lru.Lookup([]byte("a")) != "a" || lru.Lookup([]byte("b")) != "b" || lru.Lookup([]byte("c")) != nil {
+		t.Fatalf("dirty entries should not be evicted")
+	}
+	if lru.DirtyCharge() != 100 {
+		t.Errorf("expected dirty charge 100, got %d", lru.DirtyCharge())
+	}
+
+	var flushed []string
+	lru.SetFlusher(func(key []byte, entry interface{}, version uint64) error {
+		if string(key) == "b" {
+			return errors.New("can't write b")
+		}
+		flushed = append(flushed, string(key))
+		return nil
+	}, 0)
+	// b is the oldest, but it fails to flush and is passed over
+	lru.Lookup([]byte("a"))
+	lru.Insert([]byte("d"), "d", 50, nil)
+	if len(flushed) != 1 || flushed[0] != "a" || lru.Lookup([]byte("a")) != nil || lru.Lookup([]byte("b")) != "b" {
+		t.Errorf("b failed to flush, a should be flushed and evicted, flushed: %v", flushed)
+	}
+
+	if lru.MarkClean([]byte("b"), a) {
+		t.Errorf("MarkClean with id of another write should fail")
+	}
+	if !lru.MarkClean([]byte("b"), b) || lru.DirtyCharge() != 0 {
+		t.Errorf("b should be clean, dirty charge: %d", lru.DirtyCharge())
+	}
+
+	// back pressure: dirty bytes over bound block InsertDirty until some are clean
+	lru.SetFlusher(nil, 60)
+	x := lru.InsertDirty([]byte("x"), "x", 40, nil)
+	done := make(chan struct{})
+	go func() {
+		lru.InsertDirty([]byte("y"), "y", 40, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("InsertDirty over dirty bound should wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	lru.MarkClean([]byte("x"), x)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("InsertDirty not woken by MarkClean")
+	}
+	// a newer write of the same key replace the old dirty one, it doesn't wait
+	lru.InsertDirty([]byte("y"), "y2", 40, nil)
+	if lru.DirtyCharge() != 40 {
+		t.Errorf("expected dirty charge 40, got %d", lru.DirtyCharge())
+	}
+}
+
+func TestLRUCache_DirtyFlushFailing(t *testing.T) {
+	lru := NewLRUCache(100, 0)
+	lru.SetFlusher(func(key []byte, entry interface{}, version uint64) error {
+		return errors.New("store is down")
+	}, 0)
+	// dirty bytes are bound by capacity when flusher never succeeds
+	for i := 0; i < 10; i++ {
+		lru.InsertDirty([]byte("key"+strconv.Itoa(i)), i, 10, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lru.InsertDirtyContext(ctx, []byte("over"), "over", 10, nil); err != context.DeadlineExceeded {
+		t.Errorf("InsertDirtyContext over capacity expected deadline error, got: %v", err)
+	}
+	if lru.Lookup([]byte("over")) != nil || lru.TotalCharge() != 100 || lru.DirtyCharge() != 100 {
+		t.Errorf("usage grow past capacity, charge: %d, dirty: %d", lru.TotalCharge(), lru.DirtyCharge())
+	}
+
+	// metadata is charged to dirty bytes too
+	lru = NewLRUCache(100+metadataCharge([]byte("a")), 0)
+	lru.SetMetadataChargePolicy(FullChargeCacheMetadata)
+	lru.InsertDirty([]byte("a"), "a", 100, nil)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lru.InsertDirtyContext(ctx, []byte("b"), "b", 1, nil); err != context.DeadlineExceeded {
+		t.Errorf("dirty bound should count metadata, got: %v", err)
+	}
+}
+
+func TestLRUCache_DirtyRewrite(t *testing.T) {
+	lru := NewLRUCache(100, 0)
+	flushed := map[string]interface{}{}
+	key := []byte("a")
+
+	// every kind of write over an unflushed entry keep it dirty
+	lru.InsertDirty(key, 1, 10, nil)
+	lru.Merge(key, 1, 10, IntMergeOperator, IntChargeOperator)
+	lru.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, Action) {
+		return old.(int) + 1, 10, ActionReplace
+	})
+	_, version := lru.LookupVersioned(key)
+	lru.CompareAndSwap(key, version, 4, 10)
+	if err := lru.Txn().Insert(key, 5, 10, nil).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if lru.DirtyCharge() != 10 {
+		t.Fatalf("rewritten entry lost dirty flag, dirty charge: %d", lru.DirtyCharge())
+	}
+	lru.SetFlusher(func(key []byte, entry interface{}, version uint64) error {
+		if string(key) == "stuck" {
+			return errors.New("can't write stuck")
+		}
+		flushed[string(key)] = entry
+		return nil
+	}, 0)
+	for i := 0; i < 10; i++ {
+		lru.Insert([]byte("filler"+strconv.Itoa(i)), i, 10, nil)
+	}
+	if flushed["a"] != 5 || lru.Lookup(key) != nil {
+		t.Errorf("rewritten entry should be flushed with last value on eviction, flushed: %v", flushed)
+	}
+
+	// prune flush dirty entries, the ones can't be are kept
+	lru.InsertDirty([]byte("p"), "p", 10, nil)
+	lru.InsertDirty([]byte("stuck"), "s", 10, nil)
+	lru.Prune()
+	if flushed["p"] != "p" || lru.Lookup([]byte("p")) != nil {
+		t.Errorf("dirty entry not flushed by prune, flushed: %v", flushed)
+	}
+	if lru.Lookup([]byte("stuck")) != "s" || lru.TotalCharge() != 10 || lru.DirtyCharge() != 10 {
+		t.Errorf("entry failed to flush should survive prune, charge: %d", lru.TotalCharge())
+	}
+}
+
+func TestLRUCache_Compute(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 2)
+	type counter struct{ n, max int }
+	key := []byte("counter")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				lru.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, Action) {
+					c := counter{max: 5000}
+					if exists {
+						c = old.(counter)
+					}
+					// capped; stop changing it
+					if c.n >= c.max {
+						return nil, 0, ActionKeep
+					}
+					c.n++
+					return c, 16, ActionReplace
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if entry, ok := lru.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, Action) {
+		return nil, 0, ActionKeep
+	}); !ok || entry.(counter).n != 5000 {
+		t.Errorf("expected counter capped at 5000, got: %v", entry)
+	}
+
+	// delete when it reach the cap
+	entry, ok := lru.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, Action) {
+		if old.(counter).n == old.(counter).max {
+			return nil, 0, ActionDelete
+		}
+		return nil, 0, ActionKeep
+	})
+	if entry != nil || ok || lru.Lookup(key) != nil {
+		t.Errorf("entry should be deleted, got: %v", entry)
+	}
+
+	// tombstone is a missing entry
+	lru.InsertNotFound(key)
+	lru.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, Action) {
+		if exists || old != nil {
+			t.Errorf("tombstone should not exist, got: %v", old)
+		}
+		return "v", 1, ActionReplace
+	})
+	if lru.Lookup(key) != "v" {
+		t.Errorf("expected v, got: %v", lru.Lookup(key))
+	}
+}
+
+func TestLRUCache_CompareAndSwap(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 2)
+	key := []byte("key")
+
+	if _, version := lru.LookupVersioned(key); version != 0 {
+		t.Errorf("missing key should have version 0, got %d", version)
+	}
+	v1, ok := lru.CompareAndSwap(key, 0, "a", 1)
+	if !ok || v1 == 0 {
+		t.Fatalf("swap of missing key with 0 should succeed")
+	}
+	if _, ok := lru.CompareAndSwap(key, 0, "b", 1); ok {
+		t.Errorf("swap with 0 should fail when key exists")
+	}
+	lru.Insert(key, "c", 1, nil)
+	entry, v2 := lru.LookupVersioned(key)
+	if entry != "c" || v2 <= v1 {
+		t.Errorf("insert should give a new version, got %d after %d", v2, v1)
+	}
+	if current, ok := lru.CompareAndSwap(key, v1, "d", 1); ok || current != v2 {
+		t.Errorf("swap with stale version should fail with current %d, got %d", v2, current)
+	}
+	if lru.CompareAndDelete(key, v1) || !lru.CompareAndDelete(key, v2) || lru.Lookup(key) != nil {
+		t.Errorf("delete should succeed only with current version")
+	}
+
+	// versions are ids of the cache
+	if id := lru.NewId(); id <= v2 {
+		t.Errorf("NewId %d should be after versions", id)
+	}
+
+	// tombstone is a missing key
+	lru.InsertNotFound(key)
+	if entry, version := lru.LookupVersioned(key); entry != nil || version != 0 {
+		t.Errorf("tombstone should be missing, got %v of version %d", entry, version)
+	}
+	if _, ok := lru.CompareAndSwap(key, 0, "e", 1); !ok || lru.Lookup(key) != "e" {
+		t.Errorf("swap with 0 should replace tombstone")
+	}
+
+	// nothing cached is not a success
+	off := NewLRUCache(0, 1)
+	if version, ok := off.CompareAndSwap(key, 0, "a", 1); ok || version != 0 {
+		t.Errorf("swap into cache of capacity 0 should fail, got version %d", version)
+	}
+
+	// optimistic increments from many goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				for {
+					entry, version := lru.LookupVersioned([]byte("n"))
+					n, _ := entry.(int)
+					if _, ok := lru.CompareAndSwap([]byte("n"), version, n+1, 8); ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := lru.Lookup([]byte("n")); n != 4000 {
+		t.Errorf("expected 4000, got %v", n)
+	}
+}
+
+func TestLRUCache_Txn(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 4)
+	lru.Insert([]byte("c"), "c", 1, nil)
+	err := lru.Txn().
+		Insert([]byte("a"), "a", 1, nil).
+		Merge([]byte("n"), 1, 4, IntMergeOperator, IntChargeOperator).
+		Merge([]byte("n"), 2, 4, IntMergeOperator, IntChargeOperator).
+		Remove([]byte("c")).
+		IfVersion([]byte("b"), 0).
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lru.Lookup([]byte("a")) != "a" || lru.Lookup([]byte("n")) != 3 || lru.Lookup([]byte("c")) != nil {
+		t.Errorf("txn not applied")
+	}
+
+	// failed condition apply nothing
+	_, version := lru.LookupVersioned([]byte("a"))
+	lru.Insert([]byte("a"), "changed", 1, nil)
+	err = lru.Txn().Insert([]byte("x"), "x", 1, nil).Remove([]byte("n")).IfVersion([]byte("a"), version).Commit()
+	if err != ErrTxnConflict || lru.Lookup([]byte("x")) != nil || lru.Lookup([]byte("n")) != 3 {
+		t.Errorf("conflicting txn should apply nothing, err: %v", err)
+	}
+
+	// move amounts between accounts; total seen by ApplyToAllCacheEntries never change
+	accounts := [][]byte{[]byte("acc0"), []byte("acc1"), []byte("acc2"), []byte("acc3")}
+	for _, key := range accounts {
+		lru.Insert(key, 100, 8, nil)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				from, to := accounts[(i+j)%4], accounts[(i+j+1)%4]
+				for {
+					a, va := lru.LookupVersioned(from)
+					b, vb := lru.LookupVersioned(to)
+					err := lru.Txn().IfVersion(from, va).IfVersion(to, vb).
+						Insert(from, a.(int)-1, 8, nil).Insert(to, b.(int)+1, 8, nil).Commit()
+					if err == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			total := 0
+			lru.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+				if bytes.HasPrefix(key, []byte("acc")) {
+					total += entry.(int)
+				}
+			})
+			if total != 400 {
+				t.Errorf("half applied transaction seen, total: %d", total)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-done
+}
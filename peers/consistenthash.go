@@ -0,0 +1,76 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/GerSure/lrucache"
+)
+
+/**
+HashRing map keys to peers by consistent hashing; every peer has
+replicas virtual nodes on the ring.
+*/
+type HashRing struct {
+	replicas int
+	hashes   []uint32 // sorted
+	owners   map[uint32]string
+}
+
+func NewHashRing(replicas int) *HashRing {
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
+
+func (this *HashRing) IsEmpty() bool {
+	return len(this.hashes) == 0
+}
+
+func (this *HashRing) Add(peers ...string) {
+	for _, peer := range peers {
+		for i := 0; i < this.replicas; i++ {
+			hash := lrucache.HashSlice([]byte(strconv.Itoa(i) + peer))
+			if _, ok := this.owners[hash]; ok {
+				// collision of virtual node, first peer keep it
+				continue
+			}
+			this.hashes = append(this.hashes, hash)
+			this.owners[hash] = peer
+		}
+	}
+	sort.Slice(this.hashes, func(i, j int) bool { return this.hashes[i] < this.hashes[j] })
+}
+
+/**
+return peer owning key, "" if ring is empty
+*/
+func (this *HashRing) Get(key string) string {
+	if this.IsEmpty() {
+		return ""
+	}
+	hash := lrucache.HashSlice([]byte(key))
+	i := sort.Search(len(this.hashes), func(i int) bool { return this.hashes[i] >= hash })
+	if i == len(this.hashes) {
+		i = 0
+	}
+	return this.owners[this.hashes[i]]
+}
@@ -0,0 +1,235 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+/**
+Getter load value of key when no peer has it; return ErrNotFound if key doesn't exist
+*/
+type Getter interface {
+	Get(key string) ([]byte, error)
+}
+
+type GetterFunc func(key string) ([]byte, error)
+
+func (this GetterFunc) Get(key string) ([]byte, error) {
+	return this(key)
+}
+
+type counter uint64
+
+func (this *counter) add(n uint64) {
+	atomic.AddUint64((*uint64)(this), n)
+}
+
+func (this *counter) get() uint64 {
+	return atomic.LoadUint64((*uint64)(this))
+}
+
+type groupStats struct {
+	gets           counter
+	cacheHits      counter
+	peerLoads      counter
+	peerErrors     counter
+	loads          counter
+	loadsDeduped   counter
+	localLoads     counter
+	localLoadErrs  counter
+	serverRequests counter
+	hotPushes      counter
+	hotReceived    counter
+	hotHits        counter
+}
+
+type GroupStats struct {
+	Gets           uint64 // any Get request, including from peers
+	CacheHits      uint64 // main or hot cache hit
+	PeerLoads      uint64 // remote load or remote cache hit
+	PeerErrors     uint64
+	Loads          uint64 // gets - cacheHits
+	LoadsDeduped   uint64 // after singleflight
+	LocalLoads     uint64 // total good local loads
+	LocalLoadErrs  uint64 // total bad local loads
+	ServerRequests uint64 // gets that came over the network from peers
+	HotPushes      uint64 // copies of hot keys this owner pushed to peers
+	HotReceived    uint64 // hot keys pushed to us by owners
+	HotHits        uint64 // gets served by pushed copies; load shed from owners
+}
+
+/**
+Group is a cache namespace spread over peers. keys owned by this peer are kept in
+main cache; popular keys owned by other peers are kept in a small hot cache.
+*/
+type Group struct {
+	name       string
+	getter     Getter
+	peers      PeerPicker
+	main_cache *lrucache.LRUCache
+	hot_cache  *lrucache.LRUCache
+	loader     flightGroup
+	stats      groupStats
+
+	// hot key replication
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+/**
+cache_bytes is shared by main cache (7/8) and hot cache (1/8); group is registered in pool,
+so peers can fetch from it.
+*/
+func NewGroup(name string, cache_bytes uint64, getter Getter, pool *HTTPPool) *Group {
+	group := &Group{
+		name:       name,
+		getter:     getter,
+		peers:      pool,
+		main_cache: lrucache.NewLRUCache(cache_bytes-cache_bytes/8, 0),
+		hot_cache:  lrucache.NewLRUCache(cache_bytes/8, 0),
+	}
+	pool.register(group)
+	return group
+}
+
+func (this *Group) Name() string {
+	return this.name
+}
+
+/**
+returned value is shared with cache, caller must not modify it
+*/
+func (this *Group) Get(key string) ([]byte, error) {
+	this.stats.gets.add(1)
+	if value, ok := this.lookupCache(key); ok {
+		this.stats.cacheHits.add(1)
+		return value, nil
+	}
+	this.stats.loads.add(1)
+	return this.load(key)
+}
+
+/**
+Remove key from local caches only; other peers may still have it in hot cache
+*/
+func (this *Group) Remove(key string) {
+	this.main_cache.Remove([]byte(key))
+	this.hot_cache.Remove([]byte(key))
+}
+
+func (this *Group) Stats() GroupStats {
+	return GroupStats{
+		Gets:           this.stats.gets.get(),
+		CacheHits:      this.stats.cacheHits.get(),
+		PeerLoads:      this.stats.peerLoads.get(),
+		PeerErrors:     this.stats.peerErrors.get(),
+		Loads:          this.stats.loads.get(),
+		LoadsDeduped:   this.stats.loadsDeduped.get(),
+		LocalLoads:     this.stats.localLoads.get(),
+		LocalLoadErrs:  this.stats.localLoadErrs.get(),
+		ServerRequests: this.stats.serverRequests.get(),
+		HotPushes:      this.stats.hotPushes.get(),
+		HotReceived:    this.stats.hotReceived.get(),
+		HotHits:        this.stats.hotHits.get(),
+	}
+}
+
+func (this *Group) MainCache() *lrucache.LRUCache {
+	return this.main_cache
+}
+
+func (this *Group) HotCache() *lrucache.LRUCache {
+	return this.hot_cache
+}
+
+func (this *Group) lookupCache(key string) ([]byte, bool) {
+	if value, ok := this.main_cache.Lookup([]byte(key)).([]byte); ok {
+		return value, true
+	}
+	switch entry := this.hot_cache.Lookup([]byte(key)).(type) {
+	case []byte:
+		return entry, true
+	case *pushedEntry:
+		if time.Now().Before(entry.expires) {
+			this.stats.hotHits.add(1)
+			return entry.value, true
+		}
+		this.hot_cache.Remove([]byte(key))
+	}
+	return nil, false
+}
+
+/**
+load key once per key at a time, from owner peer or from getter
+*/
+func (this *Group) load(key string) ([]byte, error) {
+	value, err := this.loader.Do(key, func() (interface{}, error) {
+		// another caller may have filled cache while we wait for flight
+		if value, ok := this.lookupCache(key); ok {
+			this.stats.cacheHits.add(1)
+			return value, nil
+		}
+		this.stats.loadsDeduped.add(1)
+		if peer, ok := this.peers.PickPeer(key); ok {
+			value, err := peer.Get(this.name, key)
+			if err == nil {
+				this.stats.peerLoads.add(1)
+				// about one in ten remote keys go to hot cache
+				if rand.Intn(10) == 0 {
+					this.populateCache(this.hot_cache, key, value)
+				}
+				return value, nil
+			}
+			if err == ErrNotFound {
+				return nil, err
+			}
+			// owner is down; load locally but don't cache key we don't own
+			this.stats.peerErrors.add(1)
+			return this.getLocally(key)
+		}
+		value, err := this.getLocally(key)
+		if err == nil {
+			this.populateCache(this.main_cache, key, value)
+		}
+		return value, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]byte), nil
+}
+
+func (this *Group) getLocally(key string) ([]byte, error) {
+	value, err := this.getter.Get(key)
+	if err != nil {
+		this.stats.localLoadErrs.add(1)
+		return nil, err
+	}
+	this.stats.localLoads.add(1)
+	return value, nil
+}
+
+func (this *Group) populateCache(cache *lrucache.LRUCache, key string, value []byte) {
+	cache.Insert([]byte(key), value, uint64(len(key)+len(value)), nil)
+}
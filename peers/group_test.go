@@ -0,0 +1,260 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testPeer struct {
+	pool   *HTTPPool
+	group  *Group
+	server *http.Server
+}
+
+/**
+start n peers on loopback, all of them own group "test"
+*/
+func startPeers(t *testing.T, n int, getter func(peer int, key string) ([]byte, error)) []*testPeer {
+	var listeners []net.Listener
+	var urls []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		urls = append(urls, "http://"+l.Addr().String())
+	}
+
+	var peers []*testPeer
+	for i := 0; i < n; i++ {
+		i := i
+		pool := NewHTTPPool(urls[i])
+		pool.Set(urls...)
+		group := NewGroup("test", 1024*1024, GetterFunc(func(key string) ([]byte, error) {
+			return getter(i, key)
+		}), pool)
+		server := &http.Server{Handler: pool}
+		go server.Serve(listeners[i])
+		peers = append(peers, &testPeer{pool: pool, group: group, server: server})
+	}
+	return peers
+}
+
+func stopPeers(peers []*testPeer) {
+	for _, peer := range peers {
+		peer.server.Close()
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing(50)
+	if ring.Get("key") != "" {
+		t.Errorf("empty ring should own nothing")
+	}
+	ring.Add("a", "b", "c")
+	owners := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owners[ring.Get(strconv.Itoa(i))]++
+	}
+	for _, peer := range []string{"a", "b", "c"} {
+		if owners[peer] < 500 {
+			t.Errorf("peer %s own only %d of 3000 keys", peer, owners[peer])
+		}
+	}
+
+	// adding a peer only move keys to the new peer
+	bigger := NewHashRing(50)
+	bigger.Add("a", "b", "c", "d")
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		if owner := bigger.Get(key); owner != "d" && owner != ring.Get(key) {
+			t.Fatalf("key %s moved from %s to %s", key, ring.Get(key), owner)
+		}
+	}
+}
+
+func TestGroup_LoadOnceByOwner(t *testing.T) {
+	var mutex sync.Mutex
+	loads := map[string][]int{}
+	peers := startPeers(t, 3, func(peer int, key string) ([]byte, error) {
+		mutex.Lock()
+		loads[key] = append(loads[key], peer)
+		mutex.Unlock()
+		if key == "missing" {
+			return nil, ErrNotFound
+		}
+		return []byte("value-" + key), nil
+	})
+	defer stopPeers(peers)
+
+	for round := 0; round < 2; round++ {
+		for _, peer := range peers {
+			for i := 0; i < 30; i++ {
+				key := strconv.Itoa(i)
+				value, err := peer.group.Get(key)
+				if err != nil || string(value) != "value-"+key {
+					t.Fatalf("get key %s from %s, value: %s, err: %v", key, peer.pool.Self(), value, err)
+				}
+			}
+		}
+	}
+
+	for key, by := range loads {
+		if len(by) != 1 {
+			t.Errorf("key %s loaded %d times", key, len(by))
+			continue
+		}
+		if owner := peers[0].pool.Owner(key); owner != peers[by[0]].pool.Self() {
+			t.Errorf("key %s loaded by %s, owner is %s", key, peers[by[0]].pool.Self(), owner)
+		}
+	}
+
+	for _, peer := range peers {
+		if _, err := peer.group.Get("missing"); err != ErrNotFound {
+			t.Errorf("missing key expected ErrNotFound, got: %v", err)
+		}
+	}
+
+	// a peer without the group is not a miss
+	getter := peers[0].pool.getters[peers[1].pool.Self()]
+	if _, err := getter.Get("unknown", "1"); err == nil || err == ErrNotFound {
+		t.Errorf("unknown group expected peer error, got: %v", err)
+	}
+}
+
+func TestGroup_SingleFlight(t *testing.T) {
+	var loads int32
+	peers := startPeers(t, 2, func(peer int, key string) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte(key), nil
+	})
+	defer stopPeers(peers)
+
+	// find a key owned by peer 1, and get it from peer 0
+	var key string
+	for i := 0; ; i++ {
+		key = strconv.Itoa(i)
+		if peers[0].pool.Owner(key) == peers[1].pool.Self() {
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := peers[0].group.Get(key); err != nil || string(value) != key {
+				t.Errorf("get key %s, value: %s, err: %v", key, value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("concurrent gets loaded key %d times", loads)
+	}
+	if stats := peers[1].group.Stats(); stats.ServerRequests != 1 {
+		t.Errorf("owner served %d requests, expected 1", stats.ServerRequests)
+	}
+}
+
+func TestGroup_HotKeyReplication(t *testing.T) {
+	peers := startPeers(t, 3, func(peer int, key string) ([]byte, error) {
+		return []byte("value-" + key), nil
+	})
+	defer stopPeers(peers)
+	options := HotKeyOptions{Interval: 50 * time.Millisecond, Threshold: 100, TTL: 150 * time.Millisecond, SampleRate: 1}
+	for _, peer := range peers {
+		peer.group.EnableHotKeyReplication(options)
+		defer peer.group.Close()
+	}
+
+	var key string
+	for i := 0; ; i++ {
+		key = "celebrity" + strconv.Itoa(i)
+		if peers[0].pool.Owner(key) == peers[0].pool.Self() {
+			break
+		}
+	}
+	for i := 0; i < 200; i++ {
+		peers[0].group.Get(key)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	// owner count a push when all peers answered
+	for peers[0].group.Stats().HotPushes < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("hot key not pushed, owner stats: %+v", peers[0].group.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if peers[1].group.Stats().HotReceived == 0 || peers[2].group.Stats().HotReceived == 0 {
+		t.Errorf("every peer should receive hot key")
+	}
+
+	requests := peers[0].group.Stats().ServerRequests
+	for i := 0; i < 10; i++ {
+		if value, err := peers[1].group.Get(key); err != nil || string(value) != "value-"+key {
+			t.Fatalf("get hot key: %s, %v", value, err)
+		}
+	}
+	if got := peers[0].group.Stats().ServerRequests; got != requests {
+		t.Errorf("hot key gets reached owner: %d requests", got-requests)
+	}
+	if hits := peers[1].group.Stats().HotHits; hits != 10 {
+		t.Errorf("expected 10 hot hits, got %d", hits)
+	}
+
+	// not hot any more; pushed copy expire and gets go to owner again
+	time.Sleep(300 * time.Millisecond)
+	peers[2].group.Get(key)
+	if got := peers[0].group.Stats().ServerRequests; got != requests+1 {
+		t.Errorf("expired copy should be loaded from owner, owner requests: %d", got-requests)
+	}
+}
+
+func TestGroup_HotKeyReplicationRestart(t *testing.T) {
+	peers := startPeers(t, 1, func(peer int, key string) ([]byte, error) {
+		return []byte("value-" + key), nil
+	})
+	defer stopPeers(peers)
+	group := peers[0].group
+	group.EnableHotKeyReplication(HotKeyOptions{Interval: 10 * time.Millisecond})
+	group.EnableHotKeyReplication(HotKeyOptions{Interval: 20 * time.Millisecond})
+
+	// Close stop the only loop running; a leaked one would keep it waiting
+	closed := make(chan struct{})
+	go func() {
+		group.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close blocked by a leaked replication loop")
+	}
+}
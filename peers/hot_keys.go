@@ -0,0 +1,137 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"time"
+)
+
+type HotKeyOptions struct {
+	Interval time.Duration // detection period, default 1s
+	// a key is hot when its sampled count reach Threshold; counts are halved every
+	// Interval, so a steady rate of r gets per Interval count about 2r. default 1000
+	Threshold  uint64
+	TTL        time.Duration // lifetime of pushed copies, default 3*Interval
+	SampleRate uint32        // one of SampleRate hits of main cache is counted, default 16
+	MaxTracked int           // keys counted per shard of main cache, default 64
+	MaxKeys    int           // hot keys pushed per Interval, default 16
+}
+
+func (this *HotKeyOptions) setDefault() {
+	if this.Interval == 0 {
+		this.Interval = time.Second
+	}
+	if this.Threshold == 0 {
+		this.Threshold = 1000
+	}
+	if this.TTL == 0 {
+		this.TTL = 3 * this.Interval
+	}
+	if this.SampleRate == 0 {
+		this.SampleRate = 16
+	}
+	if this.MaxTracked == 0 {
+		this.MaxTracked = 64
+	}
+	if this.MaxKeys == 0 {
+		this.MaxKeys = 16
+	}
+}
+
+/**
+PeerPusher copy value of a hot key to every other peer, return how many got it
+*/
+type PeerPusher interface {
+	PushToPeers(group string, key string, value []byte, ttl time.Duration) int
+}
+
+// hot key pushed by its owner, served until expires
+type pushedEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+/**
+EnableHotKeyReplication let this peer, as owner, count gets of its main cache and push
+hot keys to all peers' hot cache; peers serve them locally until TTL, so the owner only
+sees one push per Interval instead of every get. peers must be a PeerPusher, like HTTPPool.
+calling it again restart replication with the new options.
+pushed copies are accepted from any client, so peers must only be reachable inside
+the peer network, like their gets.
+*/
+func (this *Group) EnableHotKeyReplication(options HotKeyOptions) {
+	options.setDefault()
+	pusher, ok := this.peers.(PeerPusher)
+	if !ok {
+		return
+	}
+	this.Close()
+	this.main_cache.SetAccessSampling(options.SampleRate, options.MaxTracked)
+	this.stop = make(chan struct{})
+	this.wg.Add(1)
+	go func() {
+		defer this.wg.Done()
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.stop:
+				return
+			case <-ticker.C:
+			}
+			this.pushHotKeys(pusher, &options)
+		}
+	}()
+}
+
+/**
+Close stop hot key replication
+*/
+func (this *Group) Close() {
+	if this.stop != nil {
+		close(this.stop)
+		this.wg.Wait()
+		this.stop = nil
+	}
+}
+
+func (this *Group) pushHotKeys(pusher PeerPusher, options *HotKeyOptions) {
+	hot := this.main_cache.HotKeys(options.Threshold)
+	if len(hot) > options.MaxKeys {
+		hot = hot[:options.MaxKeys]
+	}
+	for _, hk := range hot {
+		entry, _, ok := this.main_cache.Peek(hk.Key)
+		value, is_bytes := entry.([]byte)
+		if !ok || !is_bytes {
+			continue
+		}
+		pushed := pusher.PushToPeers(this.name, string(hk.Key), value, options.TTL)
+		this.stats.hotPushes.add(uint64(pushed))
+	}
+	this.main_cache.DecayAccessCounts()
+}
+
+/**
+receiveHot store a copy pushed by owner of key
+*/
+func (this *Group) receiveHot(key string, value []byte, ttl time.Duration) {
+	this.stats.hotReceived.add(1)
+	entry := &pushedEntry{value: value, expires: time.Now().Add(ttl)}
+	this.hot_cache.Insert([]byte(key), entry, uint64(len(key)+len(value)), nil)
+}
@@ -0,0 +1,267 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBasePath = "/_lrucache/"
+	defaultReplicas = 50
+	hotTTLHeader    = "X-Lrucache-Hot-Ttl" // milliseconds
+)
+
+var ErrNotFound = errors.New("peers: key not found")
+
+/**
+PeerGetter fetch value of key in group from a remote peer
+*/
+type PeerGetter interface {
+	Get(group string, key string) ([]byte, error)
+}
+
+/**
+PeerPicker choose the peer owning key; ok is false if this process own it
+*/
+type PeerPicker interface {
+	PickPeer(key string) (peer PeerGetter, ok bool)
+}
+
+/**
+HTTPPool is the PeerPicker of a set of http peers, it also serve
+requests of other peers for groups registered in it.
+*/
+type HTTPPool struct {
+	self      string // base url of this peer, like http://10.0.0.1:8000
+	base_path string
+	client    *http.Client
+
+	mutex   sync.RWMutex
+	ring    *HashRing
+	getters map[string]*httpGetter
+	groups  map[string]*Group
+}
+
+func NewHTTPPool(self string) *HTTPPool {
+	return &HTTPPool{
+		self:      self,
+		base_path: DefaultBasePath,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		ring:      NewHashRing(defaultReplicas),
+		groups:    make(map[string]*Group),
+	}
+}
+
+func (this *HTTPPool) Self() string {
+	return this.self
+}
+
+/**
+replace peer set; self should be included
+*/
+func (this *HTTPPool) Set(peers ...string) {
+	ring := NewHashRing(defaultReplicas)
+	ring.Add(peers...)
+	getters := make(map[string]*httpGetter, len(peers))
+	for _, peer := range peers {
+		getters[peer] = &httpGetter{client: this.client, base_url: peer + this.base_path}
+	}
+	this.mutex.Lock()
+	this.ring = ring
+	this.getters = getters
+	this.mutex.Unlock()
+}
+
+/**
+SetMembers replace peer set by Meta (base url) of members; it can be MemberlistConfig.OnChange
+*/
+func (this *HTTPPool) SetMembers(members []Member) {
+	peers := make([]string, 0, len(members))
+	for _, m := range members {
+		if m.State.live() && m.Meta != "" {
+			peers = append(peers, m.Meta)
+		}
+	}
+	this.Set(peers...)
+}
+
+func (this *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	peer := this.ring.Get(key)
+	if peer == "" || peer == this.self {
+		return nil, false
+	}
+	return this.getters[peer], true
+}
+
+/**
+Owner return base url of the peer owning key
+*/
+func (this *HTTPPool) Owner(key string) string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.ring.Get(key)
+}
+
+func (this *HTTPPool) register(group *Group) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if _, ok := this.groups[group.name]; ok {
+		panic("duplicate registration of group " + group.name)
+	}
+	this.groups[group.name] = group
+}
+
+func (this *HTTPPool) Group(name string) *Group {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.groups[name]
+}
+
+/**
+PushToPeers PUT value of hot key to every peer but self, in parallel
+*/
+func (this *HTTPPool) PushToPeers(group string, key string, value []byte, ttl time.Duration) int {
+	this.mutex.RLock()
+	var getters []*httpGetter
+	for peer, getter := range this.getters {
+		if peer != this.self {
+			getters = append(getters, getter)
+		}
+	}
+	this.mutex.RUnlock()
+
+	var pushed int32
+	var wg sync.WaitGroup
+	for _, getter := range getters {
+		wg.Add(1)
+		go func(getter *httpGetter) {
+			defer wg.Done()
+			if getter.Push(group, key, value, ttl) == nil {
+				atomic.AddInt32(&pushed, 1)
+			}
+		}(getter)
+	}
+	wg.Wait()
+	return int(pushed)
+}
+
+/**
+serve GET <base_path><group>/<key>, and PUT of hot keys pushed by their owner.
+PUT is not authenticated: the pool must sit behind the peer network boundary
+*/
+func (this *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, this.base_path) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(r.URL.Path[len(this.base_path):], "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	group := this.Group(parts[0])
+	if group == nil {
+		// not a miss: caller load the key itself, e.g. while a deploy roll out the group
+		http.Error(w, "no such group: "+parts[0], http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodPut {
+		ttl, err := strconv.ParseInt(r.Header.Get(hotTTLHeader), 10, 64)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "bad ttl", http.StatusBadRequest)
+			return
+		}
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group.receiveHot(parts[1], value, time.Duration(ttl)*time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	group.stats.serverRequests.add(1)
+	value, err := group.Get(parts[1])
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+type httpGetter struct {
+	client   *http.Client
+	base_url string
+}
+
+func (this *httpGetter) Get(group string, key string) ([]byte, error) {
+	u := this.base_url + url.PathEscape(group) + "/" + url.PathEscape(key)
+	res, err := this.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("peer %s returned %s: %s", this.base_url, res.Status, strings.TrimSpace(string(body)))
+}
+
+func (this *httpGetter) Push(group string, key string, value []byte, ttl time.Duration) error {
+	u := this.base_url + url.PathEscape(group) + "/" + url.PathEscape(key)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(hotTTLHeader, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	res, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer %s returned %s", this.base_url, res.Status)
+	}
+	return nil
+}
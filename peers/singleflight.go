@@ -0,0 +1,59 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import "sync"
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+/**
+flightGroup make sure a function of one key is executing only once at a time;
+duplicate callers wait and get the same result.
+*/
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (this *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	this.mutex.Lock()
+	if this.calls == nil {
+		this.calls = make(map[string]*flightCall)
+	}
+	if c, ok := this.calls[key]; ok {
+		this.mutex.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	this.calls[key] = c
+	this.mutex.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	this.mutex.Lock()
+	delete(this.calls, key)
+	this.mutex.Unlock()
+	return c.val, c.err
+}
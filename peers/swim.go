@@ -0,0 +1,755 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSeeds   = errors.New("peers: no seed reachable")
+	errBadPacket = errors.New("peers: bad gossip packet")
+)
+
+type MemberState byte
+
+const (
+	StateAlive MemberState = iota
+	StateSuspect
+	StateDead
+	StateLeft // dead by graceful Leave
+)
+
+func (this MemberState) String() string {
+	switch this {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+// alive and suspect members own keys; suspect is only a doubt, not a failure
+func (this MemberState) live() bool {
+	return this == StateAlive || this == StateSuspect
+}
+
+type Member struct {
+	Name        string // gossip address, unique in cluster
+	Meta        string // what the application know member by, like http base url of HTTPPool
+	Incarnation uint32 // only the member itself increase it, to refute suspicion
+	State       MemberState
+}
+
+type MemberlistConfig struct {
+	Meta             string
+	ProbeInterval    time.Duration // one member is probed per interval, default 1s
+	ProbeTimeout     time.Duration // wait of direct ack before indirect probes, default ProbeInterval/2
+	IndirectChecks   int           // members asked to probe on our behalf, default 3
+	SuspicionTimeout time.Duration // suspect become dead after it, default 5*ProbeInterval
+	RetransmitMult   int           // update is gossiped RetransmitMult*log10(n+1) times, default 4
+	GossipInterval   time.Duration // queued updates are sent to GossipNodes members, default ProbeInterval/5
+	GossipNodes      int           // default 3
+	// full state is exchanged with a random member, dead ones included, at this interval;
+	// it repair what gossip missed and heal partitions. default 10*ProbeInterval
+	PushPullInterval time.Duration
+	ReclaimTimeout    time.Duration // dead members are forgotten after it, default 10*SuspicionTimeout
+	// OnChange is called with live members (self included) when the set or their meta change;
+	// HTTPPool.SetMembers can be used here
+	OnChange func(members []Member)
+	Seed     int64 // seed of random probe order, 0 use time
+}
+
+func (this *MemberlistConfig) setDefault() {
+	if this.ProbeInterval == 0 {
+		this.ProbeInterval = time.Second
+	}
+	if this.ProbeTimeout == 0 {
+		this.ProbeTimeout = this.ProbeInterval / 2
+	}
+	if this.IndirectChecks == 0 {
+		this.IndirectChecks = 3
+	}
+	if this.SuspicionTimeout == 0 {
+		this.SuspicionTimeout = 5 * this.ProbeInterval
+	}
+	if this.RetransmitMult == 0 {
+		this.RetransmitMult = 4
+	}
+	if this.GossipInterval == 0 {
+		this.GossipInterval = this.ProbeInterval / 5
+	}
+	if this.GossipNodes == 0 {
+		this.GossipNodes = 3
+	}
+	if this.PushPullInterval == 0 {
+		this.PushPullInterval = 10 * this.ProbeInterval
+	}
+	if this.ReclaimTimeout == 0 {
+		this.ReclaimTimeout = 10 * this.SuspicionTimeout
+	}
+	if this.Seed == 0 {
+		this.Seed = time.Now().UnixNano()
+	}
+}
+
+/**
+PacketTransport send unreliable datagrams to members by name
+*/
+type PacketTransport interface {
+	LocalAddr() string
+	WriteTo(buf []byte, addr string) error
+	Close() error
+}
+
+type member struct {
+	Member
+	state_change time.Time
+}
+
+type broadcast struct {
+	update    Member
+	transmits int
+}
+
+type probe struct {
+	target   string
+	seq      uint32
+	start    time.Time
+	indirect bool // ping-req sent
+	acked    bool
+}
+
+// ping sent for a ping-req of another member
+type relay struct {
+	requester string
+	seq       uint32
+	deadline  time.Time
+}
+
+/**
+Memberlist maintain live members by SWIM: every ProbeInterval one member is pinged,
+if it doesn't ack in ProbeTimeout some others are asked to ping it (ping-req); without
+any ack it's suspected, and declared dead after SuspicionTimeout unless it refute by a
+higher incarnation. membership updates are piggybacked on probe packets.
+
+all state change happen in handle and tick, so it can be driven by real
+UDP (NewMemberlist) or by SimNetwork with a virtual clock.
+*/
+type Memberlist struct {
+	config    MemberlistConfig
+	transport PacketTransport
+
+	mutex          sync.Mutex
+	rand           *rand.Rand
+	self           *member
+	members        map[string]*member
+	probe_list     []string
+	probe_index    int
+	probe          *probe
+	next_probe     time.Time
+	next_gossip    time.Time
+	next_push_pull time.Time
+	seq            uint32
+	relays         map[uint32]*relay
+	broadcasts     map[string]*broadcast
+	changed        bool
+	left           bool
+
+	notify_mutex sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newMemberlist(transport PacketTransport, config MemberlistConfig) *Memberlist {
+	config.setDefault()
+	self := &member{Member: Member{Name: transport.LocalAddr(), Meta: config.Meta, State: StateAlive}}
+	return &Memberlist{
+		config:     config,
+		transport:  transport,
+		rand:       rand.New(rand.NewSource(config.Seed)),
+		self:       self,
+		members:    map[string]*member{self.Name: self},
+		relays:     make(map[uint32]*relay),
+		broadcasts: make(map[string]*broadcast),
+		changed:    true,
+		stop:       make(chan struct{}),
+	}
+}
+
+/**
+NewMemberlist start gossip over UDP; call Join to enter a cluster
+*/
+func NewMemberlist(transport *UDPTransport, config MemberlistConfig) *Memberlist {
+	this := newMemberlist(transport, config)
+	tick := this.config.ProbeTimeout / 5
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	this.wg.Add(2)
+	go func() {
+		defer this.wg.Done()
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, _, err := transport.ReadFrom(buf)
+			if err != nil {
+				select {
+				case <-this.stop:
+					return
+				default:
+					continue
+				}
+			}
+			this.handle(buf[:n], time.Now())
+		}
+	}()
+	go func() {
+		defer this.wg.Done()
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.stop:
+				return
+			case now := <-ticker.C:
+				this.tick(now)
+			}
+		}
+	}()
+	this.notify()
+	return this
+}
+
+func (this *Memberlist) LocalMember() Member {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.self.Member
+}
+
+/**
+Members return live members sorted by name, self included
+*/
+func (this *Memberlist) Members() []Member {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.collect(func(m *member) bool { return m.State.live() })
+}
+
+/**
+AllMembers also return suspect, dead and left members not reclaimed yet
+*/
+func (this *Memberlist) AllMembers() []Member {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.collect(func(m *member) bool { return true })
+}
+
+/**
+Join send our full state to seeds, they answer with theirs; the rest converge by gossip
+*/
+func (this *Memberlist) Join(seeds ...string) error {
+	this.mutex.Lock()
+	buf := this.encodeState(kindSync)
+	this.mutex.Unlock()
+	sent := 0
+	for _, seed := range seeds {
+		if seed == this.self.Name {
+			continue
+		}
+		if this.transport.WriteTo(buf, seed) == nil {
+			sent++
+		}
+	}
+	if sent == 0 && len(seeds) > 0 {
+		return ErrNoSeeds
+	}
+	return nil
+}
+
+/**
+Leave tell live members we are going, they remove us without suspicion;
+nothing is probed after it
+*/
+func (this *Memberlist) Leave() {
+	this.mutex.Lock()
+	this.left = true
+	this.self.State = StateLeft
+	this.changed = true
+	update := this.self.Member
+	var targets []string
+	for name, m := range this.members {
+		if name != this.self.Name && m.State.live() {
+			targets = append(targets, name)
+		}
+	}
+	this.mutex.Unlock()
+	buf := encodePacket(&packet{kind: kindGossip, from: update.Name, updates: []Member{update}})
+	for _, target := range targets {
+		this.transport.WriteTo(buf, target)
+	}
+	this.notify()
+}
+
+/**
+Close stop gossip of NewMemberlist, without Leave others will find us dead
+*/
+func (this *Memberlist) Close() error {
+	close(this.stop)
+	err := this.transport.Close()
+	this.wg.Wait()
+	return err
+}
+
+func (this *Memberlist) collect(filter func(m *member) bool) []Member {
+	members := make([]Member, 0, len(this.members))
+	for _, m := range this.members {
+		if filter(m) {
+			members = append(members, m.Member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+/**
+notify call OnChange outside mutex; notify_mutex keep calls in order and every call
+see state at least as new as the previous one
+*/
+func (this *Memberlist) notify() {
+	if this.config.OnChange == nil {
+		return
+	}
+	this.notify_mutex.Lock()
+	defer this.notify_mutex.Unlock()
+	this.mutex.Lock()
+	if !this.changed {
+		this.mutex.Unlock()
+		return
+	}
+	this.changed = false
+	members := this.collect(func(m *member) bool { return m.State.live() })
+	this.mutex.Unlock()
+	this.config.OnChange(members)
+}
+
+/*********** protocol *************/
+
+/**
+tick run failure detection; called often enough to notice ProbeTimeout
+*/
+func (this *Memberlist) tick(now time.Time) {
+	this.mutex.Lock()
+	if !this.left {
+		this.checkProbe(now)
+		if !now.Before(this.next_probe) {
+			this.startProbe(now)
+			this.next_probe = now.Add(this.config.ProbeInterval)
+		}
+		this.checkSuspects(now)
+		if !now.Before(this.next_gossip) {
+			this.gossip()
+			this.next_gossip = now.Add(this.config.GossipInterval)
+		}
+		if !now.Before(this.next_push_pull) {
+			this.pushPull()
+			this.next_push_pull = now.Add(this.config.PushPullInterval)
+		}
+	}
+	for seq, r := range this.relays {
+		if now.After(r.deadline) {
+			delete(this.relays, seq)
+		}
+	}
+	this.mutex.Unlock()
+	this.notify()
+}
+
+func (this *Memberlist) checkProbe(now time.Time) {
+	p := this.probe
+	if p == nil || p.acked {
+		return
+	}
+	if !p.indirect && now.Sub(p.start) >= this.config.ProbeTimeout {
+		p.indirect = true
+		helpers := this.randomMembers(this.config.IndirectChecks, func(m *member) bool {
+			return m.State == StateAlive && m.Name != p.target
+		})
+		for _, helper := range helpers {
+			this.send(helper, &packet{kind: kindPingReq, seq: p.seq, target: p.target})
+		}
+	}
+	if now.Sub(p.start) >= this.config.ProbeInterval {
+		this.probe = nil
+		if m, ok := this.members[p.target]; ok && m.State == StateAlive {
+			this.merge(Member{Name: m.Name, Meta: m.Meta, Incarnation: m.Incarnation, State: StateSuspect}, now)
+			// it may only be our link; give it the chance to refute at once
+			this.send(m.Name, &packet{kind: kindGossip})
+		}
+	}
+}
+
+/**
+probe members in a shuffled round robin, so every member is probed in bounded time
+*/
+func (this *Memberlist) startProbe(now time.Time) {
+	if this.probe != nil && !this.probe.acked {
+		return
+	}
+	this.probe = nil
+	for tries := 0; tries < 2; tries++ {
+		for this.probe_index < len(this.probe_list) {
+			name := this.probe_list[this.probe_index]
+			this.probe_index++
+			if m, ok := this.members[name]; ok && m.State.live() {
+				this.seq++
+				this.probe = &probe{target: name, seq: this.seq, start: now}
+				this.send(name, &packet{kind: kindPing, seq: this.seq, target: name})
+				return
+			}
+		}
+		this.probe_list = this.probe_list[:0]
+		for name, m := range this.members {
+			if name != this.self.Name && m.State.live() {
+				this.probe_list = append(this.probe_list, name)
+			}
+		}
+		sort.Strings(this.probe_list)
+		this.rand.Shuffle(len(this.probe_list), func(i, j int) {
+			this.probe_list[i], this.probe_list[j] = this.probe_list[j], this.probe_list[i]
+		})
+		this.probe_index = 0
+	}
+}
+
+func (this *Memberlist) checkSuspects(now time.Time) {
+	for name, m := range this.members {
+		switch {
+		case m.State == StateSuspect && now.Sub(m.state_change) >= this.config.SuspicionTimeout:
+			this.merge(Member{Name: name, Meta: m.Meta, Incarnation: m.Incarnation, State: StateDead}, now)
+		case !m.State.live() && name != this.self.Name && now.Sub(m.state_change) >= this.config.ReclaimTimeout:
+			delete(this.members, name)
+		}
+	}
+}
+
+/**
+gossip send queued updates to a few random members, beside piggybacking on probes
+*/
+func (this *Memberlist) gossip() {
+	if len(this.broadcasts) == 0 {
+		return
+	}
+	targets := this.randomMembers(this.config.GossipNodes, func(m *member) bool { return m.State.live() })
+	for _, target := range targets {
+		this.send(target, &packet{kind: kindGossip})
+	}
+}
+
+/**
+pushPull exchange full state with one member; if a dead one is alive behind a
+healed partition, it refute and both sides learn each other again
+*/
+func (this *Memberlist) pushPull() {
+	target := this.randomMembers(1, func(m *member) bool { return m.State != StateLeft })
+	if len(target) > 0 {
+		this.transport.WriteTo(this.encodeState(kindSync), target[0])
+	}
+}
+
+func (this *Memberlist) randomMembers(k int, filter func(m *member) bool) []string {
+	var names []string
+	for name, m := range this.members {
+		if name != this.self.Name && filter(m) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	this.rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if len(names) > k {
+		names = names[:k]
+	}
+	return names
+}
+
+/**
+handle one received packet
+*/
+func (this *Memberlist) handle(buf []byte, now time.Time) {
+	p, err := decodePacket(buf)
+	if err != nil {
+		return
+	}
+	this.mutex.Lock()
+	for _, u := range p.updates {
+		this.merge(u, now)
+	}
+	if !this.left {
+		switch p.kind {
+		case kindPing:
+			this.send(p.from, &packet{kind: kindAck, seq: p.seq})
+		case kindPingReq:
+			this.seq++
+			this.relays[this.seq] = &relay{requester: p.from, seq: p.seq, deadline: now.Add(this.config.ProbeInterval)}
+			this.send(p.target, &packet{kind: kindPing, seq: this.seq, target: p.target})
+		case kindAck:
+			if this.probe != nil && this.probe.seq == p.seq {
+				this.probe.acked = true
+			} else if r, ok := this.relays[p.seq]; ok {
+				delete(this.relays, p.seq)
+				this.send(r.requester, &packet{kind: kindAck, seq: r.seq})
+			}
+		case kindSync:
+			this.transport.WriteTo(this.encodeState(kindSyncAck), p.from)
+		}
+	}
+	this.mutex.Unlock()
+	this.notify()
+}
+
+/**
+merge apply an update by SWIM rules: higher incarnation win; at the same incarnation
+dead beat suspect beat alive. accepted updates are gossiped further.
+*/
+func (this *Memberlist) merge(u Member, now time.Time) {
+	if u.Name == this.self.Name {
+		if this.left {
+			return
+		}
+		if u.Incarnation > this.self.Incarnation || (u.Incarnation == this.self.Incarnation && u.State != StateAlive) {
+			// refute; others believe an older or failed version of us
+			this.self.Incarnation = u.Incarnation + 1
+			this.queueBroadcast(this.self.Member)
+		}
+		return
+	}
+
+	m, ok := this.members[u.Name]
+	if !ok {
+		m = &member{Member: u, state_change: now}
+		this.members[u.Name] = m
+		if u.State.live() {
+			this.changed = true
+			this.queueBroadcast(u)
+		}
+		return
+	}
+
+	accept := false
+	switch u.State {
+	case StateAlive:
+		accept = u.Incarnation > m.Incarnation
+	case StateSuspect:
+		accept = u.Incarnation > m.Incarnation || (u.Incarnation == m.Incarnation && m.State == StateAlive)
+	case StateDead, StateLeft:
+		accept = u.Incarnation > m.Incarnation || (u.Incarnation == m.Incarnation && m.State.live())
+	}
+	if !accept {
+		return
+	}
+	if m.State.live() != u.State.live() || (u.Meta != "" && u.Meta != m.Meta) {
+		this.changed = true
+	}
+	if u.Meta == "" {
+		u.Meta = m.Meta
+	}
+	if m.State != u.State {
+		m.state_change = now
+	}
+	m.Member = u
+	this.queueBroadcast(u)
+	if this.probe != nil && this.probe.target == u.Name && u.State == StateAlive {
+		// refuted while we probe it, it's talking to somebody
+		this.probe.acked = true
+	}
+}
+
+func (this *Memberlist) queueBroadcast(u Member) {
+	// newer update of a member replace the queued one
+	this.broadcasts[u.Name] = &broadcast{update: u}
+}
+
+func (this *Memberlist) retransmitLimit() int {
+	return this.config.RetransmitMult * int(math.Ceil(math.Log10(float64(len(this.members)+1))))
+}
+
+/**
+send packet with as many least gossiped updates as fit in a datagram
+*/
+func (this *Memberlist) send(to string, p *packet) {
+	p.from = this.self.Name
+	if len(this.broadcasts) > 0 {
+		queued := make([]*broadcast, 0, len(this.broadcasts))
+		for _, b := range this.broadcasts {
+			queued = append(queued, b)
+		}
+		sort.Slice(queued, func(i, j int) bool {
+			if queued[i].transmits != queued[j].transmits {
+				return queued[i].transmits < queued[j].transmits
+			}
+			return queued[i].update.Name < queued[j].update.Name
+		})
+		size := p.size()
+		limit := this.retransmitLimit()
+		for _, b := range queued {
+			if size+updateSize(&b.update) > gossipPacketSize {
+				break
+			}
+			size += updateSize(&b.update)
+			p.updates = append(p.updates, b.update)
+			b.transmits++
+			if b.transmits >= limit {
+				delete(this.broadcasts, b.update.Name)
+			}
+		}
+	}
+	this.transport.WriteTo(encodePacket(p), to)
+}
+
+func (this *Memberlist) encodeState(kind byte) []byte {
+	p := &packet{kind: kind, from: this.self.Name}
+	for _, m := range this.members {
+		p.updates = append(p.updates, m.Member)
+	}
+	return encodePacket(p)
+}
+
+/*********** packet *************/
+
+const (
+	kindPing byte = iota + 1
+	kindPingReq
+	kindAck
+	kindSync    // full state, receiver answer with its own
+	kindSyncAck // full state
+	kindGossip  // only updates
+
+	gossipPacketSize = 1400      // keep probes in one ethernet frame
+	maxPacketSize    = 64 * 1024 // full state
+)
+
+/**
+packet: | kind 1 | seq 4 | from | target | count 2 | update... |
+update: | state 1 | incarnation 4 | name | meta |
+string: | len 2 | bytes |
+*/
+type packet struct {
+	kind    byte
+	seq     uint32
+	from    string
+	target  string
+	updates []Member
+}
+
+func (this *packet) size() int {
+	size := 1 + 4 + 2 + len(this.from) + 2 + len(this.target) + 2
+	for i := range this.updates {
+		size += updateSize(&this.updates[i])
+	}
+	return size
+}
+
+func updateSize(u *Member) int {
+	return 1 + 4 + 2 + len(u.Name) + 2 + len(u.Meta)
+}
+
+func encodePacket(p *packet) []byte {
+	buf := make([]byte, p.size())
+	buf[0] = p.kind
+	binary.BigEndian.PutUint32(buf[1:], p.seq)
+	off := putString(buf, 5, p.from)
+	off = putString(buf, off, p.target)
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(p.updates)))
+	off += 2
+	for i := range p.updates {
+		u := &p.updates[i]
+		buf[off] = byte(u.State)
+		binary.BigEndian.PutUint32(buf[off+1:], u.Incarnation)
+		off = putString(buf, off+5, u.Name)
+		off = putString(buf, off, u.Meta)
+	}
+	return buf
+}
+
+func putString(buf []byte, off int, s string) int {
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(s)))
+	return off + 2 + copy(buf[off+2:], s)
+}
+
+func decodePacket(buf []byte) (*packet, error) {
+	d := decoder{buf: buf}
+	p := &packet{kind: d.readByte(), seq: d.readUint32(), from: d.readString(), target: d.readString()}
+	count := int(d.readUint16())
+	if d.err != nil || count > len(buf) {
+		return nil, errBadPacket
+	}
+	p.updates = make([]Member, 0, count)
+	for i := 0; i < count; i++ {
+		u := Member{State: MemberState(d.readByte()), Incarnation: d.readUint32(), Name: d.readString(), Meta: d.readString()}
+		if u.State > StateLeft {
+			return nil, errBadPacket
+		}
+		p.updates = append(p.updates, u)
+	}
+	if d.err != nil || p.from == "" {
+		return nil, errBadPacket
+	}
+	return p, nil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (this *decoder) next(n int) []byte {
+	if this.err != nil || len(this.buf) < n {
+		this.err = errBadPacket
+		return make([]byte, n)
+	}
+	b := this.buf[:n]
+	this.buf = this.buf[n:]
+	return b
+}
+
+func (this *decoder) readByte() byte {
+	return this.next(1)[0]
+}
+
+func (this *decoder) readUint16() uint16 {
+	return binary.BigEndian.Uint16(this.next(2))
+}
+
+func (this *decoder) readUint32() uint32 {
+	return binary.BigEndian.Uint32(this.next(4))
+}
+
+func (this *decoder) readString() string {
+	return string(this.next(int(this.readUint16())))
+}
@@ -0,0 +1,242 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type simCluster struct {
+	network *SimNetwork
+	lists   map[string]*Memberlist
+	pools   map[string]*HTTPPool
+	names   []string
+}
+
+func newSimCluster(seed int64, n int) *simCluster {
+	cluster := &simCluster{
+		network: NewSimNetwork(seed),
+		lists:   make(map[string]*Memberlist),
+		pools:   make(map[string]*HTTPPool),
+	}
+	for i := 0; i < n; i++ {
+		cluster.start("node" + strconv.Itoa(i))
+	}
+	return cluster
+}
+
+func (this *simCluster) start(name string) *Memberlist {
+	pool := NewHTTPPool("http://" + name)
+	list := this.network.NewMemberlist(name, MemberlistConfig{
+		Meta:          pool.Self(),
+		ProbeInterval: 100 * time.Millisecond,
+		OnChange:      pool.SetMembers,
+	})
+	if _, ok := this.lists[name]; !ok {
+		this.names = append(this.names, name)
+	}
+	this.lists[name] = list
+	this.pools[name] = pool
+	if name != this.names[0] {
+		list.Join(this.names[0])
+	}
+	return list
+}
+
+/**
+converged report whether every member in names see exactly names as live members
+*/
+func (this *simCluster) converged(names ...string) bool {
+	for _, name := range names {
+		members := this.lists[name].Members()
+		if len(members) != len(names) {
+			return false
+		}
+		for i, m := range members {
+			if m.Name != names[i] || m.State != StateAlive {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func without(names []string, name string) []string {
+	var res []string
+	for _, n := range names {
+		if n != name {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func TestMemberlist_JoinAndOwnership(t *testing.T) {
+	cluster := newSimCluster(1, 8)
+	if !cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) }) {
+		t.Fatalf("not converged: %+v", cluster.lists["node7"].AllMembers())
+	}
+	// every peer agree on the owner of keys
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		owner := cluster.pools["node0"].Owner(key)
+		for _, name := range cluster.names {
+			if got := cluster.pools[name].Owner(key); got != owner {
+				t.Fatalf("owner of %s: %s say %s, node0 say %s", key, name, got, owner)
+			}
+		}
+	}
+}
+
+func TestMemberlist_FailureDetection(t *testing.T) {
+	cluster := newSimCluster(2, 5)
+	cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) })
+
+	cluster.network.Kill("node3")
+	start := cluster.network.Now()
+	suspected := false
+	rest := without(cluster.names, "node3")
+	if !cluster.network.RunUntil(10*time.Second, func() bool {
+		for _, m := range cluster.lists["node0"].AllMembers() {
+			if m.Name == "node3" && m.State == StateSuspect {
+				suspected = true
+			}
+		}
+		return cluster.converged(rest...)
+	}) {
+		t.Fatalf("dead member not removed: %+v", cluster.lists["node0"].AllMembers())
+	}
+	if !suspected {
+		t.Errorf("member should be suspected before dead")
+	}
+	// one probe round to notice, then suspicion timeout
+	if elapsed := cluster.network.Now().Sub(start); elapsed < 500*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("failure detected after %v", elapsed)
+	}
+	for _, name := range rest {
+		if owner := cluster.pools[name].Owner("anykey"); owner == "http://node3" {
+			t.Errorf("%s still route keys to dead member", name)
+		}
+	}
+
+	// restarted process join with incarnation 0, refute its death
+	cluster.start("node3")
+	if !cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) }) {
+		t.Fatalf("restarted member not alive again: %+v", cluster.lists["node0"].AllMembers())
+	}
+	if cluster.lists["node3"].LocalMember().Incarnation == 0 {
+		t.Errorf("restarted member should refute by higher incarnation")
+	}
+}
+
+func TestMemberlist_Leave(t *testing.T) {
+	cluster := newSimCluster(3, 5)
+	cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) })
+
+	cluster.lists["node2"].Leave()
+	cluster.network.Run(50 * time.Millisecond)
+	if !cluster.converged(without(cluster.names, "node2")...) {
+		t.Errorf("left member should be removed without suspicion: %+v", cluster.lists["node0"].AllMembers())
+	}
+	for _, m := range cluster.lists["node0"].AllMembers() {
+		if m.Name == "node2" && m.State != StateLeft {
+			t.Errorf("expected left state, got %s", m.State)
+		}
+	}
+}
+
+func TestMemberlist_PacketLoss(t *testing.T) {
+	cluster := newSimCluster(4, 6)
+	cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) })
+
+	// indirect probes and refutation keep everybody alive
+	cluster.network.SetLoss(0.05)
+	for i := 0; i < 60; i++ {
+		cluster.network.Run(time.Second)
+		for _, name := range cluster.names {
+			if n := len(cluster.lists[name].Members()); n != len(cluster.names) {
+				t.Fatalf("%s has %d live members at %v: %+v", name, n, cluster.network.Now(), cluster.lists[name].AllMembers())
+			}
+		}
+	}
+	if _, dropped := cluster.network.Stats(); dropped == 0 {
+		t.Errorf("no packet dropped")
+	}
+}
+
+func TestMemberlist_PartitionHeal(t *testing.T) {
+	cluster := newSimCluster(5, 6)
+	cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) })
+
+	left, right := cluster.names[:3], cluster.names[3:]
+	cluster.network.Partition(left, right)
+	if !cluster.network.RunUntil(10*time.Second, func() bool {
+		return cluster.converged(left...) && cluster.converged(right...)
+	}) {
+		t.Fatalf("partitions not detected: %+v", cluster.lists["node0"].AllMembers())
+	}
+
+	cluster.network.Heal()
+	if !cluster.network.RunUntil(10*time.Second, func() bool { return cluster.converged(cluster.names...) }) {
+		t.Fatalf("partition not healed: %+v", cluster.lists["node0"].AllMembers())
+	}
+}
+
+func TestMemberlist_Deterministic(t *testing.T) {
+	run := func() (uint64, uint64) {
+		cluster := newSimCluster(6, 5)
+		cluster.network.SetLoss(0.05)
+		cluster.network.Run(5 * time.Second)
+		cluster.network.Kill("node1")
+		cluster.network.Run(5 * time.Second)
+		return cluster.network.Stats()
+	}
+	sent1, dropped1 := run()
+	sent2, dropped2 := run()
+	if sent1 != sent2 || dropped1 != dropped2 {
+		t.Errorf("runs differ: sent %d/%d dropped %d/%d", sent1, sent2, dropped1, dropped2)
+	}
+}
+
+func TestMemberlist_UDP(t *testing.T) {
+	var lists []*Memberlist
+	for i := 0; i < 3; i++ {
+		transport, err := NewUDPTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := NewMemberlist(transport, MemberlistConfig{ProbeInterval: 50 * time.Millisecond})
+		defer list.Close()
+		lists = append(lists, list)
+	}
+	for _, list := range lists[1:] {
+		if err := list.Join(lists[0].LocalMember().Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(lists[0].Members()) == 3 && len(lists[1].Members()) == 3 && len(lists[2].Members()) == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("udp members not converged: %+v", lists[2].Members())
+}
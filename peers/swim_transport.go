@@ -0,0 +1,273 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package peers
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+var errTransportClosed = errors.New("peers: transport closed")
+
+/**
+UDPTransport bind addr, which is also the member name others reach us by
+*/
+type UDPTransport struct {
+	addr string
+	conn *net.UDPConn
+}
+
+func NewUDPTransport(addr string) (*UDPTransport, error) {
+	udp_addr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udp_addr)
+	if err != nil {
+		return nil, err
+	}
+	if udp_addr.Port == 0 {
+		// name must be reachable, port 0 get the real one
+		host, _, _ := net.SplitHostPort(addr)
+		_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+		addr = net.JoinHostPort(host, port)
+	}
+	return &UDPTransport{addr: addr, conn: conn}, nil
+}
+
+func (this *UDPTransport) LocalAddr() string {
+	return this.addr
+}
+
+func (this *UDPTransport) WriteTo(buf []byte, addr string) error {
+	udp_addr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = this.conn.WriteToUDP(buf, udp_addr)
+	return err
+}
+
+func (this *UDPTransport) ReadFrom(buf []byte) (int, string, error) {
+	n, addr, err := this.conn.ReadFromUDP(buf)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, addr.String(), nil
+}
+
+func (this *UDPTransport) Close() error {
+	return this.conn.Close()
+}
+
+/*********** simulated network *************/
+
+type simPacket struct {
+	at   time.Time
+	from string
+	to   string
+	buf  []byte
+}
+
+type simNode struct {
+	list *Memberlist
+	down bool
+}
+
+/**
+SimNetwork run memberlists on a virtual clock in one goroutine; with the same seed
+every run deliver, drop and probe exactly the same, so tests are deterministic.
+*/
+type SimNetwork struct {
+	Latency time.Duration // one way delay, default 1ms
+	Step    time.Duration // clock resolution of Run, default 10ms
+
+	rand       *rand.Rand
+	now        time.Time
+	loss       float64
+	nodes      map[string]*simNode
+	partitions map[string]int
+	queue      []*simPacket // by delivery time, then send order
+	sent       uint64
+	dropped    uint64
+}
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		Latency:    time.Millisecond,
+		Step:       10 * time.Millisecond,
+		rand:       rand.New(rand.NewSource(seed)),
+		now:        time.Unix(0, 0),
+		nodes:      make(map[string]*simNode),
+		partitions: make(map[string]int),
+	}
+}
+
+/**
+NewMemberlist add a member named name; an existing one with that name is
+replaced, like a restarted process
+*/
+func (this *SimNetwork) NewMemberlist(name string, config MemberlistConfig) *Memberlist {
+	if config.Seed == 0 {
+		config.Seed = this.rand.Int63()
+	}
+	list := newMemberlist(&simTransport{network: this, addr: name}, config)
+	this.nodes[name] = &simNode{list: list}
+	list.notify()
+	return list
+}
+
+func (this *SimNetwork) Now() time.Time {
+	return this.now
+}
+
+// SetLoss drop rate of packets, 0..1
+func (this *SimNetwork) SetLoss(rate float64) {
+	this.loss = rate
+}
+
+/**
+Kill crash member: it doesn't receive, send or tick any more
+*/
+func (this *SimNetwork) Kill(name string) {
+	if node, ok := this.nodes[name]; ok {
+		node.down = true
+	}
+}
+
+/**
+Partition split members into groups which can't reach each other;
+members not listed are in group 0
+*/
+func (this *SimNetwork) Partition(groups ...[]string) {
+	this.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, name := range group {
+			this.partitions[name] = i + 1
+		}
+	}
+}
+
+func (this *SimNetwork) Heal() {
+	this.partitions = make(map[string]int)
+}
+
+// Stats return packets sent and dropped
+func (this *SimNetwork) Stats() (sent, dropped uint64) {
+	return this.sent, this.dropped
+}
+
+/**
+Run advance virtual clock by d; each step deliver due packets then tick every live member
+*/
+func (this *SimNetwork) Run(d time.Duration) {
+	end := this.now.Add(d)
+	for this.now.Before(end) {
+		this.now = this.now.Add(this.Step)
+		this.deliver()
+		for _, name := range this.names() {
+			if node := this.nodes[name]; !node.down {
+				node.list.tick(this.now)
+			}
+		}
+	}
+}
+
+/**
+RunUntil run until cond is true or d passed, return cond
+*/
+func (this *SimNetwork) RunUntil(d time.Duration, cond func() bool) bool {
+	end := this.now.Add(d)
+	for this.now.Before(end) {
+		if cond() {
+			return true
+		}
+		this.Run(this.Step)
+	}
+	return cond()
+}
+
+func (this *SimNetwork) names() []string {
+	names := make([]string, 0, len(this.nodes))
+	for name := range this.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *SimNetwork) deliver() {
+	// packets sent while delivering wait for later steps
+	for len(this.queue) > 0 && !this.queue[0].at.After(this.now) {
+		p := this.queue[0]
+		this.queue = this.queue[1:]
+		node, ok := this.nodes[p.to]
+		if !ok || node.down || !this.reachable(p.from, p.to) {
+			this.dropped++
+			continue
+		}
+		node.list.handle(p.buf, this.now)
+	}
+}
+
+func (this *SimNetwork) reachable(from, to string) bool {
+	return this.partitions[from] == this.partitions[to]
+}
+
+func (this *SimNetwork) send(from, to string, buf []byte) error {
+	if node, ok := this.nodes[from]; ok && node.down {
+		return errTransportClosed
+	}
+	this.sent++
+	if this.loss > 0 && this.rand.Float64() < this.loss {
+		this.dropped++
+		return nil
+	}
+	p := &simPacket{
+		at:   this.now.Add(this.Latency),
+		from: from,
+		to:   to,
+		buf:  append([]byte(nil), buf...),
+	}
+	i := sort.Search(len(this.queue), func(i int) bool { return this.queue[i].at.After(p.at) })
+	this.queue = append(this.queue, nil)
+	copy(this.queue[i+1:], this.queue[i:])
+	this.queue[i] = p
+	return nil
+}
+
+type simTransport struct {
+	network *SimNetwork
+	addr    string
+}
+
+func (this *simTransport) LocalAddr() string {
+	return this.addr
+}
+
+func (this *simTransport) WriteTo(buf []byte, addr string) error {
+	return this.network.send(this.addr, addr, buf)
+}
+
+func (this *simTransport) Close() error {
+	this.network.Kill(this.addr)
+	return nil
+}
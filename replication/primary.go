@@ -0,0 +1,391 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+var ErrClosed = errors.New("replication: closed")
+
+// events of cache buffered between two mutations, see appendEvictions
+const evictionBuffer = 4096
+
+type PrimaryOptions struct {
+	Codec       lrucache.EntryCodec // default lrucache.StringCodec
+	BacklogSize int                 // ops kept for partial resync, default 10000
+}
+
+/**
+Primary own a LRUCache and stream its mutations to replicas. all mutations must go
+through Primary; every mutation get a sequence number and is kept in a bounded backlog,
+a replica reconnecting within backlog only get the tail, otherwise a full snapshot.
+reads of primary change its lru order but are not replicated, so entries evicted by
+primary are replicated as removes instead of letting replicas choose their own victims;
+a replica need the capacity of primary, which it get by snapshot.
+*/
+type Primary struct {
+	cache   *lrucache.LRUCache
+	codec   lrucache.EntryCodec
+	id      uint64
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	seq     uint64 // last op
+	backlog []*op  // op of seq s is at backlog[s%len]
+	count   int    // ops in backlog
+	// every event of cache; evicted keys are logged as removes
+	evictions *lrucache.Watch
+
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+func NewPrimary(cache *lrucache.LRUCache, options PrimaryOptions) *Primary {
+	if options.Codec == nil {
+		options.Codec = lrucache.StringCodec{}
+	}
+	if options.BacklogSize <= 0 {
+		options.BacklogSize = 10000
+	}
+	primary := &Primary{
+		cache:     cache,
+		codec:     options.Codec,
+		id:        uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()) | 1,
+		backlog:   make([]*op, options.BacklogSize),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	primary.cond = sync.NewCond(&primary.mutex)
+	primary.watchEvictions()
+	return primary
+}
+
+func (this *Primary) Cache() *lrucache.LRUCache {
+	return this.cache
+}
+
+/**
+Seq return sequence number of last mutation
+*/
+func (this *Primary) Seq() uint64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.seq
+}
+
+/*********** mutations *************/
+
+/**
+entry must be encodable by codec, otherwise it's not inserted
+*/
+func (this *Primary) Insert(key []byte, entry interface{}, charge uint64, deleter lrucache.DeleteCallback) error {
+	value, err := this.codec.Encode(entry)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cache.Insert(key, entry, charge, deleter)
+	this.appendEvictions(key)
+	this.append(&op{typ: opInsert, key: key, num: charge, value: value})
+	if _, _, ok := this.cache.Peek(key); !ok {
+		// larger than capacity, evicted at once
+		this.append(&op{typ: opRemove, key: key})
+	}
+	return nil
+}
+
+func (this *Primary) Remove(key []byte) interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	old := this.cache.Remove(key)
+	this.appendEvictions(nil)
+	this.append(&op{typ: opRemove, key: key})
+	return old
+}
+
+/**
+result of merge is replicated as insert, so replicas don't need the operators
+*/
+func (this *Primary) Merge(key []byte, entry interface{}, charge uint64, merge_opt lrucache.MergeOperator, charge_opt lrucache.ChargeOperator) interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	old := this.cache.Merge(key, entry, charge, merge_opt, charge_opt)
+	this.appendEvictions(key)
+	this.appendCurrent(key)
+	return old
+}
+
+func (this *Primary) Prune() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cache.Prune()
+	this.append(&op{typ: opPrune})
+	// nothing is left to evict; a fresh watch, events of prune may have overflowed it
+	this.evictions.Close()
+	this.watchEvictions()
+}
+
+func (this *Primary) SetCapacity(capacity uint64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cache.SetCapacity(capacity)
+	this.appendEvictions(nil)
+	this.append(&op{typ: opSetCapacity, num: capacity})
+}
+
+/**
+log current value of key as insert, or remove if it's not cached; must hold mutex
+*/
+func (this *Primary) appendCurrent(key []byte) {
+	entry, charge, ok := this.cache.Peek(key)
+	if ok {
+		if value, err := this.codec.Encode(entry); err == nil {
+			this.append(&op{typ: opInsert, key: key, num: charge, value: value})
+			return
+		}
+	}
+	this.append(&op{typ: opRemove, key: key})
+}
+
+/**
+log keys evicted since last call as removes, except key the caller log itself.
+they go before the op causing them: replica then has room for it and never pick
+a victim by its own lru order, which primary reads made different.
+events are in C before the mutation causing them return; must hold mutex
+*/
+func (this *Primary) appendEvictions(key []byte) {
+	for {
+		select {
+		case event, ok := <-this.evictions.C:
+			if !ok {
+				this.resync()
+				return
+			}
+			if event.Type == lrucache.EventEvicted && (key == nil || !bytes.Equal(event.Key, key)) {
+				this.append(&op{typ: opRemove, key: event.Key})
+			}
+		default:
+			return
+		}
+	}
+}
+
+/**
+evictions overflowed, some were not logged: start a new id, so every replica
+get a full snapshot when it reconnects; must hold mutex
+*/
+func (this *Primary) resync() {
+	this.id = uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()) | 1
+	this.watchEvictions()
+	for conn := range this.conns {
+		conn.Close()
+	}
+}
+
+func (this *Primary) watchEvictions() {
+	this.evictions = this.cache.WatchPrefix(nil, lrucache.WatchOptions{
+		Buffer:   evictionBuffer,
+		Overflow: lrucache.CloseOnOverflow,
+	})
+}
+
+/**
+must hold mutex
+*/
+func (this *Primary) append(o *op) {
+	this.seq++
+	o.seq = this.seq
+	this.backlog[o.seq%uint64(len(this.backlog))] = o
+	if this.count < len(this.backlog) {
+		this.count++
+	}
+	this.cond.Broadcast()
+}
+
+// oldest seq in backlog; must hold mutex
+func (this *Primary) first() uint64 {
+	return this.seq - uint64(this.count) + 1
+}
+
+/*********** serve replicas *************/
+
+func (this *Primary) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+func (this *Primary) Serve(l net.Listener) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	this.listeners[l] = struct{}{}
+	this.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			this.mutex.Lock()
+			delete(this.listeners, l)
+			closed := this.closed
+			this.mutex.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			return err
+		}
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		this.conns[conn] = struct{}{}
+		this.wg.Add(1)
+		this.mutex.Unlock()
+		go this.serveReplica(conn)
+	}
+}
+
+func (this *Primary) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	this.evictions.Close()
+	for l := range this.listeners {
+		l.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+	this.wg.Wait()
+	return nil
+}
+
+type replicaConn struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	dead   bool // guarded by Primary.mutex
+}
+
+func (this *Primary) serveReplica(conn net.Conn) {
+	defer this.wg.Done()
+	defer func() {
+		conn.Close()
+		this.mutex.Lock()
+		delete(this.conns, conn)
+		this.mutex.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hs, err := readOp(reader)
+	if err != nil || hs.typ != opHandshake {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	rc := &replicaConn{conn: conn, writer: bufio.NewWriter(conn)}
+
+	// replica send nothing after handshake; a read return when it's gone
+	go func() {
+		reader.ReadByte()
+		this.mutex.Lock()
+		rc.dead = true
+		this.cond.Broadcast()
+		this.mutex.Unlock()
+	}()
+
+	var next uint64
+	var snapshot []*op
+	this.mutex.Lock()
+	if hs.num == this.id && hs.seq <= this.seq && hs.seq+1 >= this.first() {
+		next = hs.seq + 1
+		snapshot = []*op{{typ: opContinue, seq: hs.seq, num: this.id}}
+	} else {
+		snapshot = this.snapshot()
+		next = this.seq + 1
+	}
+	this.mutex.Unlock()
+
+	for _, o := range snapshot {
+		writeOp(rc.writer, o)
+	}
+	if rc.writer.Flush() != nil {
+		return
+	}
+
+	for {
+		this.mutex.Lock()
+		for next > this.seq && !this.closed && !rc.dead {
+			this.cond.Wait()
+		}
+		if this.closed || rc.dead || next < this.first() {
+			// replica is too slow, it will get a snapshot after reconnect
+			this.mutex.Unlock()
+			return
+		}
+		ops := make([]*op, 0, this.seq-next+1)
+		for s := next; s <= this.seq; s++ {
+			ops = append(ops, this.backlog[s%uint64(len(this.backlog))])
+		}
+		next = this.seq + 1
+		this.mutex.Unlock()
+
+		for _, o := range ops {
+			writeOp(rc.writer, o)
+		}
+		if rc.writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+/**
+full resync frames of current content, oldest first so replica get the same lru order;
+must hold mutex
+*/
+func (this *Primary) snapshot() []*op {
+	capacity := make([]byte, 8)
+	binary.BigEndian.PutUint64(capacity, this.cache.Capacity())
+	ops := []*op{{typ: opSnapshotBegin, seq: this.seq, num: this.id, value: capacity}}
+	this.cache.ApplyToAllCacheEntriesInLRUOrder(func(key []byte, entry interface{}, charge uint64) {
+		value, err := this.codec.Encode(entry)
+		if err != nil {
+			return
+		}
+		ops = append(ops, &op{typ: opSnapshotEntry, key: key, num: charge, value: value})
+	})
+	return append(ops, &op{typ: opSnapshotEnd, seq: this.seq})
+}
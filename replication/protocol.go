@@ -0,0 +1,99 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	opInsert      byte = 1
+	opRemove      byte = 2
+	opPrune       byte = 3
+	opSetCapacity byte = 4
+
+	// primary -> replica, start of full resync; seq of snapshot, num is primary id, value is capacity
+	opSnapshotBegin byte = 10
+	opSnapshotEntry byte = 11
+	opSnapshotEnd   byte = 12
+	// primary -> replica, partial resync accepted; num is primary id
+	opContinue byte = 13
+	// replica -> primary, first frame; seq is last applied, num is primary id it came from
+	opHandshake byte = 20
+
+	frameHeaderSize = 1 + 8 + 8 + 4
+	maxFrameSize    = 512 * 1024 * 1024
+)
+
+var ErrBadFrame = errors.New("replication: bad frame")
+
+/**
+op is one replicated mutation or control message;
+frame: | len 4 | type 1 | seq 8 | num 8 | key_len 4 | key | value |
+num is charge of insert or capacity of set capacity.
+*/
+type op struct {
+	typ   byte
+	seq   uint64
+	num   uint64
+	key   []byte
+	value []byte
+}
+
+func writeOp(w *bufio.Writer, o *op) error {
+	var hdr [4 + frameHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(frameHeaderSize+len(o.key)+len(o.value)))
+	hdr[4] = o.typ
+	binary.BigEndian.PutUint64(hdr[5:], o.seq)
+	binary.BigEndian.PutUint64(hdr[13:], o.num)
+	binary.BigEndian.PutUint32(hdr[21:], uint32(len(o.key)))
+	w.Write(hdr[:])
+	w.Write(o.key)
+	_, err := w.Write(o.value)
+	return err
+}
+
+func readOp(r *bufio.Reader) (*op, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < frameHeaderSize || n > maxFrameSize {
+		return nil, ErrBadFrame
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	key_len := binary.BigEndian.Uint32(frame[17:])
+	if uint64(key_len) > uint64(n-frameHeaderSize) {
+		return nil, ErrBadFrame
+	}
+	body := frame[frameHeaderSize:]
+	return &op{
+		typ:   frame[0],
+		seq:   binary.BigEndian.Uint64(frame[1:]),
+		num:   binary.BigEndian.Uint64(frame[9:]),
+		key:   body[:key_len],
+		value: body[key_len:],
+	}, nil
+}
@@ -0,0 +1,253 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+type ReplicaOptions struct {
+	Codec         lrucache.EntryCodec // must be same as primary, default lrucache.StringCodec
+	RetryInterval time.Duration       // wait before reconnect, default 1s
+}
+
+type ReplicaStats struct {
+	Seq          uint64 // last applied op of primary
+	FullSyncs    uint64
+	PartialSyncs uint64
+}
+
+/**
+Replica follow a Primary and apply its mutations to cache; cache must be
+read only for everyone else.
+*/
+type Replica struct {
+	addr    string
+	cache   *lrucache.LRUCache
+	options ReplicaOptions
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	primary_id uint64 // 0 means content is not a consistent copy of any primary
+	stats      ReplicaStats
+	conn       net.Conn
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+func NewReplica(primary_addr string, cache *lrucache.LRUCache, options ReplicaOptions) *Replica {
+	if options.Codec == nil {
+		options.Codec = lrucache.StringCodec{}
+	}
+	if options.RetryInterval == 0 {
+		options.RetryInterval = time.Second
+	}
+	replica := &Replica{
+		addr:    primary_addr,
+		cache:   cache,
+		options: options,
+	}
+	replica.cond = sync.NewCond(&replica.mutex)
+	replica.wg.Add(1)
+	go replica.loop()
+	return replica
+}
+
+func (this *Replica) Cache() *lrucache.LRUCache {
+	return this.cache
+}
+
+func (this *Replica) Lookup(key []byte) interface{} {
+	return this.cache.Lookup(key)
+}
+
+func (this *Replica) Stats() ReplicaStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stats
+}
+
+/**
+WaitFor block until op seq of primary is applied; return false on timeout
+*/
+func (this *Replica) WaitFor(seq uint64, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		this.mutex.Lock()
+		this.cond.Broadcast()
+		this.mutex.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for this.stats.Seq < seq || this.primary_id == 0 {
+		if this.closed || !time.Now().Before(deadline) {
+			return false
+		}
+		this.cond.Wait()
+	}
+	return true
+}
+
+/**
+Disconnect drop current connection, replica reconnect after RetryInterval
+*/
+func (this *Replica) Disconnect() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.conn != nil {
+		this.conn.Close()
+	}
+}
+
+func (this *Replica) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	if this.conn != nil {
+		this.conn.Close()
+	}
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+	this.wg.Wait()
+	return nil
+}
+
+func (this *Replica) loop() {
+	defer this.wg.Done()
+	for {
+		this.sync()
+		this.mutex.Lock()
+		closed := this.closed
+		this.mutex.Unlock()
+		if closed {
+			return
+		}
+		time.Sleep(this.options.RetryInterval)
+	}
+}
+
+/**
+connect, resync and apply ops until connection is lost
+*/
+func (this *Replica) sync() {
+	conn, err := net.DialTimeout("tcp", this.addr, this.options.RetryInterval)
+	if err != nil {
+		return
+	}
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	this.conn = conn
+	hs := &op{typ: opHandshake, seq: this.stats.Seq, num: this.primary_id}
+	this.mutex.Unlock()
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	writeOp(writer, hs)
+	if writer.Flush() != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	var snapshot_seq uint64
+	var snapshot_id uint64
+	for {
+		o, err := readOp(reader)
+		if err != nil {
+			return
+		}
+		if !this.apply(o, &snapshot_seq, &snapshot_id) {
+			return
+		}
+	}
+}
+
+/**
+return false if stream is broken and connection must be dropped
+*/
+func (this *Replica) apply(o *op, snapshot_seq, snapshot_id *uint64) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	switch o.typ {
+	case opContinue:
+		if o.num != this.primary_id || o.seq != this.stats.Seq {
+			return false
+		}
+		this.stats.PartialSyncs++
+		return true
+	case opSnapshotBegin:
+		// until snapshot end, content is not a copy of primary
+		this.primary_id = 0
+		*snapshot_seq = o.seq
+		*snapshot_id = o.num
+		this.cache.Prune()
+		if len(o.value) == 8 {
+			this.cache.SetCapacity(binary.BigEndian.Uint64(o.value))
+		}
+		return true
+	case opSnapshotEntry:
+		return this.insert(o)
+	case opSnapshotEnd:
+		this.primary_id = *snapshot_id
+		this.stats.Seq = *snapshot_seq
+		this.stats.FullSyncs++
+		this.cond.Broadcast()
+		return true
+	}
+
+	if this.primary_id == 0 || o.seq != this.stats.Seq+1 {
+		return false
+	}
+	switch o.typ {
+	case opInsert:
+		if !this.insert(o) {
+			return false
+		}
+	case opRemove:
+		this.cache.Remove(o.key)
+	case opPrune:
+		this.cache.Prune()
+	case opSetCapacity:
+		this.cache.SetCapacity(o.num)
+	default:
+		return false
+	}
+	this.stats.Seq = o.seq
+	this.cond.Broadcast()
+	return true
+}
+
+func (this *Replica) insert(o *op) bool {
+	entry, err := this.options.Codec.Decode(o.value)
+	if err != nil {
+		// can't keep a consistent copy, do a full resync
+		this.primary_id = 0
+		return false
+	}
+	this.cache.Insert(o.key, entry, o.num, nil)
+	return true
+}
@@ -0,0 +1,148 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replication
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+func dump(cache *lrucache.LRUCache) map[string]string {
+	content := map[string]string{}
+	cache.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		content[string(key)] = entry.(string)
+	})
+	return content
+}
+
+func expectSame(t *testing.T, primary *Primary, replica *Replica) {
+	if !replica.WaitFor(primary.Seq(), 5*time.Second) {
+		t.Fatalf("replica not catch up, primary seq:%d, replica:%+v", primary.Seq(), replica.Stats())
+	}
+	p, r := dump(primary.Cache()), dump(replica.Cache())
+	if len(p) != len(r) {
+		t.Fatalf("primary has %d entries, replica has %d", len(p), len(r))
+	}
+	for key, value := range p {
+		if r[key] != value {
+			t.Errorf("key %s primary: %s, replica: %s", key, value, r[key])
+		}
+	}
+	if primary.Cache().TotalCharge() != replica.Cache().TotalCharge() {
+		t.Errorf("total charge primary: %d, replica: %d", primary.Cache().TotalCharge(), replica.Cache().TotalCharge())
+	}
+}
+
+func TestReplication(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := NewPrimary(lrucache.NewLRUCache(1024*1024, 1), PrimaryOptions{BacklogSize: 50})
+	go primary.Serve(l)
+	defer primary.Close()
+
+	// content before replica start come by snapshot
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(i)
+		primary.Insert([]byte(key), "value"+key, 10, nil)
+	}
+	replica := NewReplica(l.Addr().String(), lrucache.NewLRUCache(1024, 0), ReplicaOptions{RetryInterval: 50 * time.Millisecond})
+	defer replica.Close()
+	expectSame(t, primary, replica)
+	if stats := replica.Stats(); stats.FullSyncs != 1 {
+		t.Errorf("expected one full sync, stats:%+v", stats)
+	}
+	if replica.Cache().Capacity() != 1024*1024 {
+		t.Errorf("replica capacity not synced: %d", replica.Cache().Capacity())
+	}
+
+	// streamed ops
+	primary.Remove([]byte("0"))
+	append_opt := func(old_entry, new_entry interface{}) interface{} {
+		old, _ := old_entry.(string)
+		return old + new_entry.(string)
+	}
+	charge_opt := func(entry interface{}, old_charge, new_charge uint64) uint64 {
+		return old_charge + new_charge
+	}
+	primary.Merge([]byte("1"), "+", 1, append_opt, charge_opt)
+	primary.Merge([]byte("new"), "x", 1, append_opt, charge_opt)
+	expectSame(t, primary, replica)
+
+	// short disconnect resume from backlog
+	replica.Disconnect()
+	for i := 0; i < 10; i++ {
+		primary.Insert([]byte("tail"+strconv.Itoa(i)), "v", 1, nil)
+	}
+	expectSame(t, primary, replica)
+	if stats := replica.Stats(); stats.PartialSyncs != 1 || stats.FullSyncs != 1 {
+		t.Errorf("expected a partial sync, stats:%+v", stats)
+	}
+
+	// more ops than backlog while disconnected need a snapshot
+	replica.Disconnect()
+	for i := 0; i < 100; i++ {
+		primary.Insert([]byte("lost"+strconv.Itoa(i)), "v", 1, nil)
+	}
+	primary.SetCapacity(2000)
+	expectSame(t, primary, replica)
+	if stats := replica.Stats(); stats.FullSyncs < 2 {
+		t.Errorf("expected second full sync, stats:%+v", stats)
+	}
+
+	primary.Prune()
+	expectSame(t, primary, replica)
+	if replica.Cache().Capacity() != 2000 {
+		t.Errorf("replica capacity expected: 2000, got: %d", replica.Cache().Capacity())
+	}
+}
+
+func TestReplication_Evictions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := NewPrimary(lrucache.NewLRUCache(100, 0), PrimaryOptions{})
+	go primary.Serve(l)
+	defer primary.Close()
+	for i := 0; i < 10; i++ {
+		primary.Insert([]byte("k"+strconv.Itoa(i)), "v", 10, nil)
+	}
+	// reads are not replicated; k0 is newest on primary only
+	primary.Cache().Lookup([]byte("k0"))
+	replica := NewReplica(l.Addr().String(), lrucache.NewLRUCache(100, 0), ReplicaOptions{RetryInterval: 50 * time.Millisecond})
+	defer replica.Close()
+	expectSame(t, primary, replica)
+
+	// replica drop what primary evicted, not its own oldest
+	primary.Cache().Lookup([]byte("k1"))
+	primary.Insert([]byte("new1"), "v", 10, nil)
+	primary.Insert([]byte("new2"), "v", 20, nil)
+	expectSame(t, primary, replica)
+	if replica.Lookup([]byte("k0")) == nil || replica.Lookup([]byte("k1")) == nil {
+		t.Errorf("entries read on primary should stay on replica")
+	}
+
+	primary.SetCapacity(50)
+	expectSame(t, primary, replica)
+}
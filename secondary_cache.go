@@ -0,0 +1,279 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/**
+SecondaryCache receive entries evicted from LRUCache in serialized form;
+Lookup miss of LRUCache will consult it and promote hit back into memory.
+it's called with shard lock held, so implementation must not call back into LRUCache.
+*/
+type SecondaryCache interface {
+	Insert(key []byte, value []byte) error
+	Lookup(key []byte) ([]byte, bool)
+	Erase(key []byte)
+	// Clear erase all entries, called by Prune
+	Clear()
+	// ErasePrefix erase entries whose key start with prefix, return number erased
+	ErasePrefix(prefix []byte) int
+}
+
+/**
+EntryCodec serialize cache entries for SecondaryCache
+*/
+type EntryCodec interface {
+	Encode(entry interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+var ErrUnsupportedEntry = errors.New("unsupported entry type")
+
+// entries created by Put
+type StringCodec struct{}
+
+func (StringCodec) Encode(entry interface{}) ([]byte, error) {
+	s, ok := entry.(string)
+	if !ok {
+		return nil, ErrUnsupportedEntry
+	}
+	return []byte(s), nil
+}
+
+func (StringCodec) Decode(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(entry interface{}) ([]byte, error) {
+	b, ok := entry.([]byte)
+	if !ok {
+		return nil, ErrUnsupportedEntry
+	}
+	return b, nil
+}
+
+func (BytesCodec) Decode(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+/**
+secondary value layout: | charge 8 | codec data |
+*/
+func encodeSecondaryValue(codec EntryCodec, entry interface{}, charge uint64) ([]byte, error) {
+	data, err := codec.Encode(entry)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint64(value, charge)
+	copy(value[8:], data)
+	return value, nil
+}
+
+func decodeSecondaryValue(codec EntryCodec, value []byte) (interface{}, uint64, error) {
+	if len(value) < 8 {
+		return nil, 0, errors.New("secondary value too short")
+	}
+	entry, err := codec.Decode(value[8:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry, binary.LittleEndian.Uint64(value), nil
+}
+
+/************* file secondary cache *************/
+
+const secondaryFileSuffix = ".lru"
+
+var ErrChecksumMismatch = errors.New("secondary cache checksum mismatch")
+
+type fileEntry struct {
+	key  string
+	name string
+	size uint64
+}
+
+/**
+FileSecondaryCache keep every entry in its own file under dir;
+it has its own capacity and lru, every file is protected by crc32.
+file layout: | crc32 4 | key_len 4 | key | value |, crc covers all after itself.
+*/
+type FileSecondaryCache struct {
+	dir      string
+	capacity uint64
+	usage    uint64
+	mutex    sync.Mutex
+	lru      *list.List // front is newest
+	index    map[string]*list.Element
+	next_id  uint64
+}
+
+/**
+files left in dir by last process are removed, their index is lost
+*/
+func NewFileSecondaryCache(dir string, capacity uint64) (*FileSecondaryCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+secondaryFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stale {
+		os.Remove(name)
+	}
+	return &FileSecondaryCache{
+		dir:      dir,
+		capacity: capacity,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}, nil
+}
+
+func (this *FileSecondaryCache) Insert(key []byte, value []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	size := uint64(8 + len(key) + len(value))
+	if size > this.capacity {
+		return ErrEntryTooLarge
+	}
+	this.erase(string(key))
+
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(key)))
+	copy(data[8:], key)
+	copy(data[8+len(key):], value)
+	binary.LittleEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+
+	this.next_id++
+	name := filepath.Join(this.dir, fmt.Sprintf("%016x%s", this.next_id, secondaryFileSuffix))
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		os.Remove(name)
+		return err
+	}
+	this.index[string(key)] = this.lru.PushFront(&fileEntry{key: string(key), name: name, size: size})
+	this.usage += size
+
+	for this.usage > this.capacity {
+		this.erase(this.lru.Back().Value.(*fileEntry).key)
+	}
+	return nil
+}
+
+/**
+corrupted file is dropped and reported as miss
+*/
+func (this *FileSecondaryCache) Lookup(key []byte) ([]byte, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	elem, ok := this.index[string(key)]
+	if !ok {
+		return nil, false
+	}
+	value, err := readSecondaryFile(elem.Value.(*fileEntry).name, key)
+	if err != nil {
+		this.erase(string(key))
+		return nil, false
+	}
+	this.lru.MoveToFront(elem)
+	return value, true
+}
+
+func (this *FileSecondaryCache) Erase(key []byte) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.erase(string(key))
+}
+
+func (this *FileSecondaryCache) TotalCharge() uint64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.usage
+}
+
+func (this *FileSecondaryCache) ErasePrefix(prefix []byte) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	erased := 0
+	for key := range this.index {
+		if strings.HasPrefix(key, string(prefix)) {
+			this.erase(key)
+			erased++
+		}
+	}
+	return erased
+}
+
+func (this *FileSecondaryCache) Clear() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for key := range this.index {
+		this.erase(key)
+	}
+}
+
+/**
+remove all files of cache
+*/
+func (this *FileSecondaryCache) Close() error {
+	this.Clear()
+	return nil
+}
+
+func (this *FileSecondaryCache) erase(key string) {
+	elem, ok := this.index[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*fileEntry)
+	os.Remove(e.name)
+	this.lru.Remove(elem)
+	delete(this.index, key)
+	this.usage -= e.size
+}
+
+func readSecondaryFile(name string, key []byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || crc32.ChecksumIEEE(data[4:]) != binary.LittleEndian.Uint32(data) {
+		return nil, ErrChecksumMismatch
+	}
+	key_len := int(binary.LittleEndian.Uint32(data[4:]))
+	if 8+key_len > len(data) || string(data[8:8+key_len]) != string(key) {
+		return nil, ErrChecksumMismatch
+	}
+	return data[8+key_len:], nil
+}
+
+var _ SecondaryCache = (*FileSecondaryCache)(nil)
@@ -0,0 +1,159 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestLRUCache_SecondaryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrucache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secondary, err := NewFileSecondaryCache(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru := NewLRUCache(100, 0)
+	lru.SetSecondaryCache(secondary, StringCodec{})
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		lru.Insert([]byte(key), "value"+key, 10, nil)
+	}
+	if lru.TotalCharge() > 100 {
+		t.Errorf("total charge %v over capacity", lru.TotalCharge())
+	}
+	if secondary.TotalCharge() == 0 {
+		t.Fatalf("evicted entries not in secondary cache")
+	}
+
+	// every entry is in memory or in secondary cache
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if value, ok := lru.Get(key); !ok || value != "value"+key {
+			t.Errorf("key:%s expected: value%s, got: %s", key, key, value)
+		}
+	}
+
+	// removed entry must not come back from secondary cache
+	lru.Remove([]byte("0"))
+	if _, ok := lru.Get("0"); ok {
+		t.Errorf("removed key come back from secondary cache")
+	}
+
+	lru.Merge([]byte("1"), "+", 1, func(old_entry, new_entry interface{}) interface{} {
+		old, _ := old_entry.(string)
+		return old + new_entry.(string)
+	}, func(entry interface{}, old_charge, new_charge uint64) uint64 {
+		return old_charge + new_charge
+	})
+	if value, _ := lru.Get("1"); value != "value1+" {
+		t.Errorf("merge on demoted entry expected: value1+, got: %s", value)
+	}
+
+	// pruned cache is empty, in secondary too
+	if secondary.TotalCharge() == 0 {
+		t.Fatalf("no entry left in secondary cache to prune")
+	}
+	lru.Prune()
+	if secondary.TotalCharge() != 0 {
+		t.Errorf("secondary cache not cleared by prune: %d", secondary.TotalCharge())
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := lru.Get(strconv.Itoa(i)); ok {
+			t.Errorf("pruned key %d come back from secondary cache", i)
+		}
+	}
+}
+
+func TestFileSecondaryCache_Checksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrucache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secondary, err := NewFileSecondaryCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary.Insert([]byte("a"), []byte("aaaaaaaaaa"))
+	secondary.Insert([]byte("b"), []byte("bbbbbbbbbb"))
+	if value, ok := secondary.Lookup([]byte("a")); !ok || string(value) != "aaaaaaaaaa" {
+		t.Errorf("lookup expected: aaaaaaaaaa, got: %s", value)
+	}
+
+	// corrupt file of "b"
+	name := secondary.index["b"].Value.(*fileEntry).name
+	ioutil.WriteFile(name, []byte("broken file"), 0644)
+	if _, ok := secondary.Lookup([]byte("b")); ok {
+		t.Errorf("corrupted entry should miss")
+	}
+	if secondary.TotalCharge() != uint64(8+1+10) {
+		t.Errorf("total charge expected: 19, got: %v", secondary.TotalCharge())
+	}
+
+	// capacity 100 hold 5 entries of 19 bytes; "a" is oldest after these
+	for i := 0; i < 5; i++ {
+		secondary.Insert([]byte(strconv.Itoa(i)), []byte("xxxxxxxxxx"))
+	}
+	if _, ok := secondary.Lookup([]byte("a")); ok {
+		t.Errorf("oldest entry should be evicted")
+	}
+	secondary.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("close left %d files", len(files))
+	}
+}
+
+func TestLRUCache_SecondaryRemovePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrucache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secondary, err := NewFileSecondaryCache(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru := NewLRUCache(100, 0)
+	lru.SetSecondaryCache(secondary, StringCodec{})
+	for i := 0; i < 50; i++ {
+		lru.Insert([]byte("user:"+strconv.Itoa(i)), "value", 10, nil)
+		lru.Insert([]byte("item:"+strconv.Itoa(i)), "value", 10, nil)
+	}
+	if removed := lru.RemovePrefix([]byte("user:")); removed != 50 {
+		t.Errorf("RemovePrefix expected: 50, got: %d", removed)
+	}
+	for i := 0; i < 50; i++ {
+		if _, ok := lru.Get("user:" + strconv.Itoa(i)); ok {
+			t.Errorf("key user:%d come back from secondary cache", i)
+		}
+		if _, ok := lru.Get("item:" + strconv.Itoa(i)); !ok {
+			t.Errorf("key item:%d without prefix is removed", i)
+		}
+	}
+}
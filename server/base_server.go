@@ -0,0 +1,115 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+/**
+baseServer own listeners and connections of a protocol server
+*/
+type baseServer struct {
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	connected int64
+	total     uint64
+}
+
+func (this *baseServer) init() {
+	this.listeners = make(map[net.Listener]struct{})
+	this.conns = make(map[net.Conn]struct{})
+}
+
+/**
+accept connections until l is closed; every connection is handled in its own goroutine
+*/
+func (this *baseServer) serve(l net.Listener, handle func(conn net.Conn)) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	this.listeners[l] = struct{}{}
+	this.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			this.mutex.Lock()
+			closed := this.closed
+			delete(this.listeners, l)
+			this.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		this.mutex.Lock()
+		if this.closed {
+			this.mutex.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		this.conns[conn] = struct{}{}
+		this.wg.Add(1)
+		this.mutex.Unlock()
+		atomic.AddInt64(&this.connected, 1)
+		atomic.AddUint64(&this.total, 1)
+		go func() {
+			defer this.release(conn)
+			handle(conn)
+		}()
+	}
+}
+
+func (this *baseServer) release(conn net.Conn) {
+	conn.Close()
+	this.mutex.Lock()
+	delete(this.conns, conn)
+	this.mutex.Unlock()
+	atomic.AddInt64(&this.connected, -1)
+	this.wg.Done()
+}
+
+/**
+close all listeners and connections, wait connections to exit
+*/
+func (this *baseServer) Close() error {
+	this.mutex.Lock()
+	this.closed = true
+	for l := range this.listeners {
+		l.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+	return nil
+}
@@ -0,0 +1,548 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+const (
+	memcacheMaxKeyLength = 250
+	// relative exptime larger than this is an unix timestamp
+	memcacheMaxRelativeExptime = 60 * 60 * 24 * 30
+	// charge of item besides key and value
+	memcacheItemOverhead = 48
+	// largest value accepted by set, like memcached's default item size
+	memcacheMaxItemSize = 1024 * 1024
+	memcacheLockStripes  = 256
+)
+
+/**
+memcacheItem is the cache entry of memcache server mode
+*/
+type memcacheItem struct {
+	flags   uint32
+	exptime int64 // unix seconds, 0 never expire
+	value   []byte
+}
+
+func (this *memcacheItem) expired(now int64) bool {
+	return this.exptime != 0 && this.exptime <= now
+}
+
+type MemcacheStats struct {
+	CmdGet    uint64
+	CmdSet    uint64
+	CmdTouch  uint64
+	GetHits   uint64
+	GetMisses uint64
+}
+
+/**
+MemcacheServer serve a LRUCache over memcached text protocol.
+entries are stored as *memcacheItem, cas unique is the entry version of LRUCache;
+every store of an item change it, touch too.
+*/
+type MemcacheServer struct {
+	cache *lrucache.LRUCache
+	start time.Time
+	stats MemcacheStats
+	// serialize read-modify-write commands of same key
+	locks [memcacheLockStripes]sync.Mutex
+	// delayed flush_all; a new flush_all replace it, Close stop it
+	flush_mutex sync.Mutex
+	flush_timer *time.Timer
+	baseServer
+}
+
+func NewMemcacheServer(cache *lrucache.LRUCache) *MemcacheServer {
+	server := &MemcacheServer{
+		cache: cache,
+		start: time.Now(),
+	}
+	server.init()
+	return server
+}
+
+/**
+Close close connections like baseServer, and cancel a delayed flush_all
+*/
+func (this *MemcacheServer) Close() error {
+	err := this.baseServer.Close()
+	this.flush_mutex.Lock()
+	if this.flush_timer != nil {
+		this.flush_timer.Stop()
+		this.flush_timer = nil
+	}
+	this.flush_mutex.Unlock()
+	return err
+}
+
+func (this *MemcacheServer) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+func (this *MemcacheServer) Serve(l net.Listener) error {
+	return this.serve(l, func(conn net.Conn) {
+		c := &memcacheConn{
+			server: this,
+			reader: bufio.NewReader(conn),
+			writer: bufio.NewWriter(conn),
+		}
+		c.serve()
+	})
+}
+
+type memcacheConn struct {
+	server *MemcacheServer
+	reader *bufio.Reader
+	writer *bufio.Writer
+	quit   bool
+}
+
+func (this *memcacheConn) serve() {
+	for !this.quit {
+		line, err := this.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			this.writer.WriteString("CLIENT_ERROR line too long\r\n")
+			this.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		args := bytes.Fields(line)
+		if len(args) > 0 {
+			// args point into reader buffer, which is reused by next read
+			for i := range args {
+				args[i] = append([]byte(nil), args[i]...)
+			}
+			if !this.server.dispatch(this, args) {
+				this.writer.Flush()
+				return
+			}
+		}
+		if this.reader.Buffered() == 0 {
+			if this.writer.Flush() != nil {
+				return
+			}
+		}
+	}
+	this.writer.Flush()
+}
+
+func (this *memcacheConn) reply(noreply bool, s string) {
+	if !noreply {
+		this.writer.WriteString(s)
+		this.writer.WriteString("\r\n")
+	}
+}
+
+/**
+return false if connection must be closed
+*/
+func (this *MemcacheServer) dispatch(c *memcacheConn, args [][]byte) bool {
+	switch string(args[0]) {
+	case "get", "gets":
+		return this.cmdGet(c, args)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return this.cmdStore(c, args)
+	case "incr", "decr":
+		return this.cmdIncr(c, args)
+	case "delete":
+		return this.cmdDelete(c, args)
+	case "touch":
+		return this.cmdTouch(c, args)
+	case "flush_all":
+		return this.cmdFlushAll(c, args)
+	case "stats":
+		return this.cmdStats(c, args)
+	case "version":
+		c.reply(false, "VERSION 1.0.0-lrucached")
+	case "quit":
+		c.quit = true
+	default:
+		c.reply(false, "ERROR")
+	}
+	return true
+}
+
+func validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > memcacheMaxKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isNoreply(args [][]byte, n int) bool {
+	return len(args) == n+1 && string(args[n]) == "noreply"
+}
+
+func (this *MemcacheServer) lock(key []byte) *sync.Mutex {
+	return &this.locks[lrucache.HashSlice(key)%memcacheLockStripes]
+}
+
+/**
+lookup item; expired item is removed and reported as miss
+*/
+func (this *MemcacheServer) lookup(key []byte) *memcacheItem {
+	item, _ := this.lookupVersioned(key)
+	return item
+}
+
+func (this *MemcacheServer) lookupVersioned(key []byte) (*memcacheItem, uint64) {
+	entry, version := this.cache.LookupVersioned(key)
+	item, ok := entry.(*memcacheItem)
+	if !ok {
+		return nil, 0
+	}
+	if item.expired(time.Now().Unix()) {
+		this.cache.CompareAndDelete(key, version)
+		return nil, 0
+	}
+	return item, version
+}
+
+func (this *MemcacheServer) store(key []byte, item *memcacheItem) {
+	this.cache.Insert(key, item, itemCharge(key, item), nil)
+}
+
+func itemCharge(key []byte, item *memcacheItem) uint64 {
+	return uint64(len(key)+len(item.value)) + memcacheItemOverhead
+}
+
+func parseExptime(s []byte) (int64, bool) {
+	exptime, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case exptime < 0:
+		// already expired
+		return 1, true
+	case exptime == 0:
+		return 0, true
+	case exptime <= memcacheMaxRelativeExptime:
+		return time.Now().Unix() + exptime, true
+	}
+	return exptime, true
+}
+
+/*********** commands *************/
+
+func (this *MemcacheServer) cmdGet(c *memcacheConn, args [][]byte) bool {
+	if len(args) < 2 {
+		c.reply(false, "ERROR")
+		return true
+	}
+	with_cas := string(args[0]) == "gets"
+	for _, key := range args[1:] {
+		atomic.AddUint64(&this.stats.CmdGet, 1)
+		item, version := this.lookupVersioned(key)
+		if item == nil {
+			atomic.AddUint64(&this.stats.GetMisses, 1)
+			continue
+		}
+		atomic.AddUint64(&this.stats.GetHits, 1)
+		if with_cas {
+			fmt.Fprintf(c.writer, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), version)
+		} else {
+			fmt.Fprintf(c.writer, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+		}
+		c.writer.Write(item.value)
+		c.writer.WriteString("\r\n")
+	}
+	c.reply(false, "END")
+	return true
+}
+
+/**
+<cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n<data>\r\n
+*/
+func (this *MemcacheServer) cmdStore(c *memcacheConn, args [][]byte) bool {
+	cmd := string(args[0])
+	n := 5
+	if cmd == "cas" {
+		n = 6
+	}
+	if len(args) != n && !isNoreply(args, n) {
+		c.reply(false, "ERROR")
+		return true
+	}
+	noreply := isNoreply(args, n)
+	key := args[1]
+	flags, err1 := strconv.ParseUint(string(args[2]), 10, 32)
+	exptime, ok := parseExptime(args[3])
+	length, err2 := strconv.Atoi(string(args[4]))
+	var cas uint64
+	var err3 error
+	if cmd == "cas" {
+		cas, err3 = strconv.ParseUint(string(args[5]), 10, 64)
+	}
+	if err2 == nil && length < 0 {
+		// nothing to swallow, the stream can't be resynced
+		c.reply(false, "CLIENT_ERROR bad data chunk")
+		return false
+	}
+	if err1 != nil || !ok || err2 != nil || err3 != nil || !validKey(key) {
+		c.reply(false, "CLIENT_ERROR bad command line format")
+		return err2 == nil && length <= memcacheMaxItemSize && this.skipData(c, length)
+	}
+	if length > memcacheMaxItemSize {
+		// client may wait for the reply before sending a payload this large
+		c.reply(false, "SERVER_ERROR object too large for cache")
+		c.writer.Flush()
+		return this.skipData(c, length)
+	}
+
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return false
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		c.reply(false, "CLIENT_ERROR bad data chunk")
+		return true
+	}
+	atomic.AddUint64(&this.stats.CmdSet, 1)
+	c.reply(noreply, this.storeItem(cmd, key, uint32(flags), exptime, data[:length], cas))
+	return true
+}
+
+func (this *MemcacheServer) skipData(c *memcacheConn, length int) bool {
+	_, err := io.CopyN(ioutil.Discard, c.reader, int64(length+2))
+	return err == nil
+}
+
+func (this *MemcacheServer) storeItem(cmd string, key []byte, flags uint32, exptime int64, value []byte, cas uint64) string {
+	lock := this.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old := this.lookup(key)
+	item := &memcacheItem{flags: flags, exptime: exptime, value: value}
+	switch cmd {
+	case "add":
+		if old != nil {
+			return "NOT_STORED"
+		}
+	case "replace":
+		if old == nil {
+			return "NOT_STORED"
+		}
+	case "append", "prepend":
+		if old == nil {
+			return "NOT_STORED"
+		}
+		// append/prepend ignore flags and exptime
+		item.flags = old.flags
+		item.exptime = old.exptime
+		joined := make([]byte, 0, len(old.value)+len(value))
+		if cmd == "append" {
+			joined = append(append(joined, old.value...), value...)
+		} else {
+			joined = append(append(joined, value...), old.value...)
+		}
+		item.value = joined
+	case "cas":
+		if old == nil {
+			return "NOT_FOUND"
+		}
+		if _, ok := this.cache.CompareAndSwap(key, cas, item, itemCharge(key, item)); !ok {
+			return "EXISTS"
+		}
+		return "STORED"
+	}
+	this.store(key, item)
+	return "STORED"
+}
+
+/**
+incr|decr <key> <value> [noreply]; decr never go below 0, incr wrap at 64 bit
+*/
+func (this *MemcacheServer) cmdIncr(c *memcacheConn, args [][]byte) bool {
+	if len(args) != 3 && !isNoreply(args, 3) {
+		c.reply(false, "ERROR")
+		return true
+	}
+	noreply := isNoreply(args, 3)
+	key := args[1]
+	delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		c.reply(false, "CLIENT_ERROR invalid numeric delta argument")
+		return true
+	}
+
+	lock := this.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	old := this.lookup(key)
+	if old == nil {
+		c.reply(noreply, "NOT_FOUND")
+		return true
+	}
+	n, err := strconv.ParseUint(string(old.value), 10, 64)
+	if err != nil {
+		c.reply(noreply, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+		return true
+	}
+	if string(args[0]) == "incr" {
+		n += delta
+	} else if delta > n {
+		n = 0
+	} else {
+		n -= delta
+	}
+	value := []byte(strconv.FormatUint(n, 10))
+	this.store(key, &memcacheItem{flags: old.flags, exptime: old.exptime, value: value})
+	c.reply(noreply, string(value))
+	return true
+}
+
+func (this *MemcacheServer) cmdDelete(c *memcacheConn, args [][]byte) bool {
+	if len(args) != 2 && !isNoreply(args, 2) {
+		c.reply(false, "ERROR")
+		return true
+	}
+	key := args[1]
+	lock := this.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if this.lookup(key) == nil {
+		c.reply(isNoreply(args, 2), "NOT_FOUND")
+		return true
+	}
+	this.cache.Remove(key)
+	c.reply(isNoreply(args, 2), "DELETED")
+	return true
+}
+
+/**
+touch <key> <exptime> [noreply]
+*/
+func (this *MemcacheServer) cmdTouch(c *memcacheConn, args [][]byte) bool {
+	if len(args) != 3 && !isNoreply(args, 3) {
+		c.reply(false, "ERROR")
+		return true
+	}
+	key := args[1]
+	exptime, ok := parseExptime(args[2])
+	if !ok {
+		c.reply(false, "CLIENT_ERROR invalid exptime argument")
+		return true
+	}
+	atomic.AddUint64(&this.stats.CmdTouch, 1)
+	lock := this.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	old := this.lookup(key)
+	if old == nil {
+		c.reply(isNoreply(args, 3), "NOT_FOUND")
+		return true
+	}
+	this.store(key, &memcacheItem{flags: old.flags, exptime: exptime, value: old.value})
+	c.reply(isNoreply(args, 3), "TOUCHED")
+	return true
+}
+
+/**
+flush_all [delay] [noreply]
+*/
+func (this *MemcacheServer) cmdFlushAll(c *memcacheConn, args [][]byte) bool {
+	noreply := string(args[len(args)-1]) == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	var delay int64
+	if len(args) == 2 {
+		d, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || d < 0 {
+			c.reply(false, "CLIENT_ERROR bad command line format")
+			return true
+		}
+		delay = d
+	} else if len(args) > 2 {
+		c.reply(false, "ERROR")
+		return true
+	}
+	this.flush_mutex.Lock()
+	if this.flush_timer != nil {
+		this.flush_timer.Stop()
+		this.flush_timer = nil
+	}
+	if delay > 0 {
+		this.flush_timer = time.AfterFunc(time.Duration(delay)*time.Second, this.cache.Prune)
+	} else {
+		this.cache.Prune()
+	}
+	this.flush_mutex.Unlock()
+	c.reply(noreply, "OK")
+	return true
+}
+
+func (this *MemcacheServer) cmdStats(c *memcacheConn, args [][]byte) bool {
+	if len(args) > 1 {
+		// no sub stats supported
+		c.reply(false, "END")
+		return true
+	}
+	var items uint64
+	this.cache.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		items++
+	})
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(c.writer, "STAT %s %v\r\n", name, value)
+	}
+	now := time.Now()
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(this.start).Seconds()))
+	stat("time", now.Unix())
+	stat("version", "1.0.0-lrucached")
+	stat("curr_connections", atomic.LoadInt64(&this.connected))
+	stat("total_connections", atomic.LoadUint64(&this.total))
+	stat("cmd_get", atomic.LoadUint64(&this.stats.CmdGet))
+	stat("cmd_set", atomic.LoadUint64(&this.stats.CmdSet))
+	stat("cmd_touch", atomic.LoadUint64(&this.stats.CmdTouch))
+	stat("get_hits", atomic.LoadUint64(&this.stats.GetHits))
+	stat("get_misses", atomic.LoadUint64(&this.stats.GetMisses))
+	stat("curr_items", items)
+	stat("bytes", this.cache.TotalCharge())
+	stat("limit_maxbytes", this.cache.Capacity())
+	c.reply(false, "END")
+	return true
+}
@@ -0,0 +1,172 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+func TestMemcacheServer_Commands(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewMemcacheServer(lrucache.NewLRUCache(1024*1024, 1))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip(t, conn,
+		"set foo 5 0 3\r\nbar\r\n"+
+			"get foo missing\r\n"+
+			"add foo 0 0 1\r\nx\r\n"+
+			"replace missing 0 0 1\r\nx\r\n"+
+			"append foo 0 0 2\r\n!!\r\n"+
+			"prepend foo 0 0 2\r\n<<\r\n"+
+			"get foo\r\n",
+		"STORED\r\nVALUE foo 5 3\r\nbar\r\nEND\r\n"+
+			"NOT_STORED\r\nNOT_STORED\r\nSTORED\r\nSTORED\r\n"+
+			"VALUE foo 5 7\r\n<<bar!!\r\nEND\r\n")
+
+	roundTrip(t, conn,
+		"set n 0 0 2\r\n10\r\nincr n 5\r\ndecr n 100\r\nincr missing 1\r\nincr foo 1\r\n"+
+			"delete n\r\ndelete n\r\nset quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n",
+		"STORED\r\n15\r\n0\r\nNOT_FOUND\r\nCLIENT_ERROR cannot increment or decrement non-numeric value\r\n"+
+			"DELETED\r\nNOT_FOUND\r\nVALUE quiet 0 1\r\nq\r\nEND\r\n")
+
+	// cas with unique from gets
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("gets foo\r\n"))
+	r := bufio.NewReader(conn)
+	line, _ := r.ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		t.Fatalf("gets reply: %q", line)
+	}
+	r.ReadString('\n')
+	r.ReadString('\n')
+	unique := fields[4]
+	conn.Write([]byte("cas foo 0 0 1 " + unique + "\r\nA\r\ncas foo 0 0 1 " + unique + "\r\nB\r\ncas none 0 0 1 1\r\nC\r\n"))
+	for _, expected := range []string{"STORED\r\n", "EXISTS\r\n", "NOT_FOUND\r\n"} {
+		if line, _ := r.ReadString('\n'); line != expected {
+			t.Errorf("cas expected: %q, got: %q", expected, line)
+		}
+	}
+
+	// negative exptime expire at once; touch extend it
+	conn.Write([]byte("set gone 0 -1 1\r\nx\r\nget gone\r\ntouch foo 100\r\nflush_all\r\nget foo\r\n"))
+	for _, expected := range []string{"STORED\r\n", "END\r\n", "TOUCHED\r\n", "OK\r\n", "END\r\n"} {
+		if line, _ := r.ReadString('\n'); line != expected {
+			t.Errorf("expected: %q, got: %q", expected, line)
+		}
+	}
+
+	conn.Write([]byte("stats\r\n"))
+	var stats = map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || line == "END\r\n" {
+			break
+		}
+		fields := strings.Fields(line)
+		stats[fields[1]] = fields[2]
+	}
+	if stats["curr_items"] != "0" || stats["limit_maxbytes"] != "1048576" || stats["get_hits"] == "" {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+}
+
+func TestMemcacheServer_BadLength(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewMemcacheServer(lrucache.NewLRUCache(1024*1024, 1))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// too large value is swallowed, connection keep working
+	big := strings.Repeat("x", memcacheMaxItemSize+1)
+	roundTrip(t, conn,
+		"set big 0 0 "+strconv.Itoa(len(big))+"\r\n"+big+"\r\nset k 0 0 1\r\nv\r\nget big k\r\n",
+		"SERVER_ERROR object too large for cache\r\nSTORED\r\nVALUE k 0 1\r\nv\r\nEND\r\n")
+	roundTrip(t, conn, "set k 0 0 9999999999\r\n", "SERVER_ERROR object too large for cache\r\n")
+
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	roundTrip(t, conn2, "set k 0 0 -1\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	conn3, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+	roundTrip(t, conn3, "get k\r\n", "VALUE k 0 1\r\nv\r\nEND\r\n")
+}
+
+func TestMemcacheServer_DelayedFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := lrucache.NewLRUCache(1024*1024, 1)
+	srv := NewMemcacheServer(cache)
+	go srv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a new flush_all replace the pending one
+	roundTrip(t, conn, "flush_all 1\r\nflush_all 100\r\nset k 0 0 1\r\nv\r\n", "OK\r\nOK\r\nSTORED\r\n")
+	srv.flush_mutex.Lock()
+	timer := srv.flush_timer
+	srv.flush_mutex.Unlock()
+	time.Sleep(1100 * time.Millisecond)
+	roundTrip(t, conn, "get k\r\n", "VALUE k 0 1\r\nv\r\nEND\r\n")
+
+	// closed server leave no flush behind
+	srv.Close()
+	if timer == nil || timer.Stop() {
+		t.Errorf("delayed flush_all not stopped by Close")
+	}
+	if cache.Lookup([]byte("k")) == nil {
+		t.Errorf("k should not be flushed")
+	}
+}
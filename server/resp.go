@@ -0,0 +1,227 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+)
+
+var (
+	ErrProtocol = errors.New("protocol error")
+)
+
+const maxBulkLength = 512 * 1024 * 1024
+
+/**
+respReader read client commands: array of bulk strings, or inline command line
+*/
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReader(r)}
+}
+
+// data already received; 0 means reply should be flushed before blocking
+func (this *respReader) Buffered() int {
+	return this.r.Buffered()
+}
+
+func (this *respReader) ReadCommand() ([][]byte, error) {
+	line, err := this.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return splitInline(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n <= 0 || n > 1024*1024 {
+		return nil, ErrProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		arg, err := this.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (this *respReader) readBulk() ([]byte, error) {
+	line, err := this.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, ErrProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxBulkLength {
+		return nil, ErrProtocol
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(this.r, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, ErrProtocol
+	}
+	return buf[:n], nil
+}
+
+/**
+read one line without \r\n
+*/
+func (this *respReader) readLine() ([]byte, error) {
+	line, err := this.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := len(line) - 1
+	if n > 0 && line[n-1] == '\r' {
+		n--
+	}
+	return line[:n], nil
+}
+
+func splitInline(line []byte) [][]byte {
+	var args [][]byte
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' {
+			if start >= 0 {
+				args = append(args, line[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		args = append(args, line[start:])
+	}
+	// line is reused by bufio.Reader
+	for i := range args {
+		args[i] = append([]byte(nil), args[i]...)
+	}
+	return args
+}
+
+/**
+respWriter write replies in RESP2 or RESP3
+*/
+type respWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func newRESPWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w), proto: 2}
+}
+
+func (this *respWriter) Flush() error {
+	return this.w.Flush()
+}
+
+func (this *respWriter) WriteSimple(s string) {
+	this.w.WriteByte('+')
+	this.w.WriteString(s)
+	this.w.WriteString("\r\n")
+}
+
+func (this *respWriter) WriteError(s string) {
+	this.w.WriteByte('-')
+	this.w.WriteString(s)
+	this.w.WriteString("\r\n")
+}
+
+func (this *respWriter) WriteInt(n int64) {
+	this.w.WriteByte(':')
+	this.w.WriteString(strconv.FormatInt(n, 10))
+	this.w.WriteString("\r\n")
+}
+
+func (this *respWriter) WriteBulk(b []byte) {
+	this.w.WriteByte('$')
+	this.w.WriteString(strconv.Itoa(len(b)))
+	this.w.WriteString("\r\n")
+	this.w.Write(b)
+	this.w.WriteString("\r\n")
+}
+
+func (this *respWriter) WriteBulkString(s string) {
+	this.w.WriteByte('$')
+	this.w.WriteString(strconv.Itoa(len(s)))
+	this.w.WriteString("\r\n")
+	this.w.WriteString(s)
+	this.w.WriteString("\r\n")
+}
+
+func (this *respWriter) WriteNull() {
+	if this.proto >= 3 {
+		this.w.WriteString("_\r\n")
+	} else {
+		this.w.WriteString("$-1\r\n")
+	}
+}
+
+func (this *respWriter) WriteArrayHeader(n int) {
+	this.w.WriteByte('*')
+	this.w.WriteString(strconv.Itoa(n))
+	this.w.WriteString("\r\n")
+}
+
+/**
+RESP3 map; RESP2 client get a flat array of key value pairs
+*/
+func (this *respWriter) WriteMapHeader(n int) {
+	if this.proto >= 3 {
+		this.w.WriteByte('%')
+		this.w.WriteString(strconv.Itoa(n))
+	} else {
+		this.w.WriteByte('*')
+		this.w.WriteString(strconv.Itoa(n * 2))
+	}
+	this.w.WriteString("\r\n")
+}
+
+/**
+RESP3 out of band push; RESP2 client get an array
+*/
+func (this *respWriter) WritePushHeader(n int) {
+	if this.proto >= 3 {
+		this.w.WriteByte('>')
+	} else {
+		this.w.WriteByte('*')
+	}
+	this.w.WriteString(strconv.Itoa(n))
+	this.w.WriteString("\r\n")
+}
@@ -0,0 +1,801 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+var (
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errOverflow   = errors.New("ERR increment or decrement would overflow")
+)
+
+type respCommand func(c *respConn, args [][]byte)
+
+type ServerStats struct {
+	ConnectedClients int64
+	TotalConnections uint64
+	TotalCommands    uint64
+	KeyspaceHits     uint64
+	KeyspaceMisses   uint64
+}
+
+/**
+RESPServer serve a LRUCache over redis RESP2/RESP3 protocol.
+string values are stored as string entry with charge len(key)+len(value), like LRUCache.Put;
+INCRBY store int64 entry by Compute, a value which isn't an integer is left untouched.
+GETV, CAS and CAD expose entry versions for optimistic concurrency across processes.
+*/
+type RESPServer struct {
+	cache    *lrucache.LRUCache
+	commands map[string]respCommand
+	tracking *trackingTable
+	start    time.Time
+	stats    ServerStats
+	baseServer
+}
+
+func NewRESPServer(cache *lrucache.LRUCache) *RESPServer {
+	server := &RESPServer{
+		cache:    cache,
+		start:    time.Now(),
+		tracking: newTrackingTable(),
+	}
+	server.init()
+	server.commands = map[string]respCommand{
+		"PING":     server.cmdPing,
+		"ECHO":     server.cmdEcho,
+		"HELLO":    server.cmdHello,
+		"QUIT":     server.cmdQuit,
+		"COMMAND":  server.cmdCommand,
+		"GET":      server.cmdGet,
+		"SET":      server.cmdSet,
+		"DEL":      server.cmdDel,
+		"EXISTS":   server.cmdExists,
+		"INCR":     server.cmdIncrBy,
+		"INCRBY":   server.cmdIncrBy,
+		"DECR":     server.cmdIncrBy,
+		"DECRBY":   server.cmdIncrBy,
+		"MGET":     server.cmdMGet,
+		"MSET":     server.cmdMSet,
+		"DBSIZE":   server.cmdDBSize,
+		"KEYS":     server.cmdKeys,
+		"FLUSHALL": server.cmdFlushAll,
+		"FLUSHDB":  server.cmdFlushAll,
+		"INFO":     server.cmdInfo,
+		"CONFIG":   server.cmdConfig,
+		"CLIENT":   server.cmdClient,
+		"GETV":     server.cmdGetV,
+		"CAS":      server.cmdCAS,
+		"CAD":      server.cmdCAD,
+	}
+	return server
+}
+
+/**
+listen on "tcp" or "unix" address and serve until Close
+*/
+func (this *RESPServer) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return this.Serve(l)
+}
+
+func (this *RESPServer) Serve(l net.Listener) error {
+	return this.serve(l, func(conn net.Conn) {
+		newRESPConn(this, conn).serve()
+	})
+}
+
+func (this *RESPServer) Stats() ServerStats {
+	return ServerStats{
+		ConnectedClients: atomic.LoadInt64(&this.connected),
+		TotalConnections: atomic.LoadUint64(&this.total),
+		TotalCommands:    atomic.LoadUint64(&this.stats.TotalCommands),
+		KeyspaceHits:     atomic.LoadUint64(&this.stats.KeyspaceHits),
+		KeyspaceMisses:   atomic.LoadUint64(&this.stats.KeyspaceMisses),
+	}
+}
+
+/*********** connection *************/
+
+type respConn struct {
+	server *RESPServer
+	conn   net.Conn
+	reader *respReader
+	writer *respWriter
+	wmutex sync.Mutex // writer is shared by commands and invalidate pushes
+	quit   bool
+
+	// client side caching; pending keys are pushed by pushLoop
+	push_mutex  sync.Mutex
+	tracking    bool
+	pushing     bool // pushLoop started
+	pending     []string
+	pending_all bool
+	push_signal chan struct{}
+	done        chan struct{}
+}
+
+func newRESPConn(server *RESPServer, conn net.Conn) *respConn {
+	return &respConn{
+		server:      server,
+		conn:        conn,
+		reader:      newRESPReader(conn),
+		writer:      newRESPWriter(conn),
+		push_signal: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+/**
+commands are executed in order; replies of pipelined commands are
+flushed together when no more request is buffered
+*/
+func (this *respConn) serve() {
+	defer func() {
+		this.setTracking(false)
+		close(this.done)
+	}()
+	for !this.quit {
+		args, err := this.reader.ReadCommand()
+		if err != nil {
+			if err == ErrProtocol {
+				this.wmutex.Lock()
+				this.writer.WriteError("ERR Protocol error")
+				this.writer.Flush()
+				this.wmutex.Unlock()
+			}
+			return
+		}
+		// an invalidate push can't get between a read and its reply
+		this.wmutex.Lock()
+		if len(args) > 0 {
+			this.server.dispatch(this, args)
+		}
+		if this.reader.Buffered() == 0 {
+			if this.writer.Flush() != nil {
+				this.wmutex.Unlock()
+				return
+			}
+		}
+		this.wmutex.Unlock()
+	}
+	this.wmutex.Lock()
+	this.writer.Flush()
+	this.wmutex.Unlock()
+}
+
+func (this *respConn) setTracking(on bool) {
+	this.push_mutex.Lock()
+	start := on && !this.pushing
+	if start {
+		this.pushing = true
+	}
+	this.tracking = on
+	this.pending = nil
+	this.pending_all = false
+	this.push_mutex.Unlock()
+	if start {
+		go this.pushLoop()
+	}
+	if !on {
+		// tracked keys would pin this connection until they are written
+		this.server.tracking.untrack(this)
+	}
+}
+
+func (this *respConn) pushInvalidate(key string) {
+	this.push_mutex.Lock()
+	if !this.tracking {
+		this.push_mutex.Unlock()
+		return
+	}
+	this.pending = append(this.pending, key)
+	this.push_mutex.Unlock()
+	this.signal()
+}
+
+func (this *respConn) pushInvalidateAll() {
+	this.push_mutex.Lock()
+	if !this.tracking {
+		this.push_mutex.Unlock()
+		return
+	}
+	this.pending = nil
+	this.pending_all = true
+	this.push_mutex.Unlock()
+	this.signal()
+}
+
+func (this *respConn) signal() {
+	select {
+	case this.push_signal <- struct{}{}:
+	default:
+	}
+}
+
+/**
+pushLoop write pending invalidations as one push: >2 invalidate [keys], null for all keys.
+writes never wait for a slow tracking client, keys are batched meanwhile
+*/
+func (this *respConn) pushLoop() {
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-this.push_signal:
+		}
+		this.push_mutex.Lock()
+		keys, all := this.pending, this.pending_all
+		this.pending = nil
+		this.pending_all = false
+		this.push_mutex.Unlock()
+		if len(keys) == 0 && !all {
+			continue
+		}
+
+		this.wmutex.Lock()
+		this.writer.WritePushHeader(2)
+		this.writer.WriteBulkString("invalidate")
+		if all {
+			this.writer.WriteNull()
+		} else {
+			this.writer.WriteArrayHeader(len(keys))
+			for _, key := range keys {
+				this.writer.WriteBulkString(key)
+			}
+		}
+		this.writer.Flush()
+		this.wmutex.Unlock()
+	}
+}
+
+func (this *RESPServer) dispatch(c *respConn, args [][]byte) {
+	atomic.AddUint64(&this.stats.TotalCommands, 1)
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := this.commands[name]
+	if !ok {
+		c.writer.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	cmd(c, args)
+}
+
+func wrongArgs(c *respConn, args [][]byte) {
+	c.writer.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(args[0]))))
+}
+
+/*********** commands *************/
+
+func (this *RESPServer) cmdPing(c *respConn, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.writer.WriteSimple("PONG")
+	case 2:
+		c.writer.WriteBulk(args[1])
+	default:
+		wrongArgs(c, args)
+	}
+}
+
+func (this *RESPServer) cmdEcho(c *respConn, args [][]byte) {
+	if len(args) != 2 {
+		wrongArgs(c, args)
+		return
+	}
+	c.writer.WriteBulk(args[1])
+}
+
+func (this *RESPServer) cmdHello(c *respConn, args [][]byte) {
+	if len(args) >= 2 {
+		proto, err := strconv.Atoi(string(args[1]))
+		if err != nil || proto < 2 || proto > 3 {
+			c.writer.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		c.writer.proto = proto
+	}
+	c.writer.WriteMapHeader(3)
+	c.writer.WriteBulkString("server")
+	c.writer.WriteBulkString("lrucached")
+	c.writer.WriteBulkString("proto")
+	c.writer.WriteInt(int64(c.writer.proto))
+	c.writer.WriteBulkString("mode")
+	c.writer.WriteBulkString("standalone")
+}
+
+func (this *RESPServer) cmdQuit(c *respConn, args [][]byte) {
+	c.writer.WriteSimple("OK")
+	c.quit = true
+}
+
+// redis-cli ask for command docs on start
+func (this *RESPServer) cmdCommand(c *respConn, args [][]byte) {
+	c.writer.WriteArrayHeader(0)
+}
+
+func (this *RESPServer) cmdGet(c *respConn, args [][]byte) {
+	if len(args) != 2 {
+		wrongArgs(c, args)
+		return
+	}
+	this.track(c, args[1])
+	this.writeValue(c, this.cache.Lookup(args[1]))
+}
+
+func (this *RESPServer) cmdSet(c *respConn, args [][]byte) {
+	if len(args) != 3 {
+		if len(args) > 3 {
+			c.writer.WriteError("ERR syntax error")
+		} else {
+			wrongArgs(c, args)
+		}
+		return
+	}
+	this.set(args[1], args[2])
+	c.writer.WriteSimple("OK")
+}
+
+func (this *RESPServer) cmdDel(c *respConn, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(c, args)
+		return
+	}
+	var n int64
+	for _, key := range args[1:] {
+		if this.cache.Remove(key) != nil {
+			n++
+		}
+		this.tracking.invalidate(key)
+	}
+	c.writer.WriteInt(n)
+}
+
+/**
+GETV key; reply [value, version], or null if key is missing
+*/
+func (this *RESPServer) cmdGetV(c *respConn, args [][]byte) {
+	if len(args) != 2 {
+		wrongArgs(c, args)
+		return
+	}
+	this.track(c, args[1])
+	entry, version := this.cache.LookupVersioned(args[1])
+	if entry == nil {
+		this.writeValue(c, nil)
+		return
+	}
+	c.writer.WriteArrayHeader(2)
+	this.writeValue(c, entry)
+	c.writer.WriteInt(int64(version))
+}
+
+/**
+CAS key version value; set key only if its version is still version (0: key is missing),
+reply new version, or null if it was changed
+*/
+func (this *RESPServer) cmdCAS(c *respConn, args [][]byte) {
+	if len(args) != 4 {
+		wrongArgs(c, args)
+		return
+	}
+	expected, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		c.writer.WriteError(errNotInteger.Error())
+		return
+	}
+	key, value := args[1], args[3]
+	version, ok := this.cache.CompareAndSwap(key, expected, string(value), uint64(len(key)+len(value)))
+	if !ok {
+		c.writer.WriteNull()
+		return
+	}
+	this.tracking.invalidate(key)
+	c.writer.WriteInt(int64(version))
+}
+
+/**
+CAD key version; delete key only if its version is still version, reply 1 if deleted
+*/
+func (this *RESPServer) cmdCAD(c *respConn, args [][]byte) {
+	if len(args) != 3 {
+		wrongArgs(c, args)
+		return
+	}
+	expected, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		c.writer.WriteError(errNotInteger.Error())
+		return
+	}
+	if !this.cache.CompareAndDelete(args[1], expected) {
+		c.writer.WriteInt(0)
+		return
+	}
+	this.tracking.invalidate(args[1])
+	c.writer.WriteInt(1)
+}
+
+func (this *RESPServer) cmdExists(c *respConn, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(c, args)
+		return
+	}
+	var n int64
+	for _, key := range args[1:] {
+		if this.cache.Lookup(key) != nil {
+			n++
+		}
+	}
+	c.writer.WriteInt(n)
+}
+
+func (this *RESPServer) cmdIncrBy(c *respConn, args [][]byte) {
+	name := strings.ToUpper(string(args[0]))
+	var delta int64 = 1
+	switch name {
+	case "INCR", "DECR":
+		if len(args) != 2 {
+			wrongArgs(c, args)
+			return
+		}
+	default:
+		if len(args) != 3 {
+			wrongArgs(c, args)
+			return
+		}
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			c.writer.WriteError(errNotInteger.Error())
+			return
+		}
+		delta = n
+	}
+	if name == "DECR" || name == "DECRBY" {
+		if delta == math.MinInt64 {
+			c.writer.WriteError("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+	res, err := this.incrBy(args[1], delta)
+	if err != nil {
+		c.writer.WriteError(err.Error())
+		return
+	}
+	this.tracking.invalidate(args[1])
+	c.writer.WriteInt(res)
+}
+
+func (this *RESPServer) cmdMGet(c *respConn, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(c, args)
+		return
+	}
+	c.writer.WriteArrayHeader(len(args) - 1)
+	for _, key := range args[1:] {
+		this.track(c, key)
+		this.writeValue(c, this.cache.Lookup(key))
+	}
+}
+
+func (this *RESPServer) cmdMSet(c *respConn, args [][]byte) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		wrongArgs(c, args)
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		this.set(args[i], args[i+1])
+	}
+	c.writer.WriteSimple("OK")
+}
+
+func (this *RESPServer) cmdDBSize(c *respConn, args [][]byte) {
+	var n int64
+	this.cache.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		n++
+	})
+	c.writer.WriteInt(n)
+}
+
+func (this *RESPServer) cmdKeys(c *respConn, args [][]byte) {
+	if len(args) != 2 {
+		wrongArgs(c, args)
+		return
+	}
+	pattern := args[1]
+	var keys [][]byte
+	this.cache.ApplyToAllCacheEntries(func(key []byte, entry interface{}) {
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	})
+	c.writer.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		c.writer.WriteBulk(key)
+	}
+}
+
+func (this *RESPServer) cmdFlushAll(c *respConn, args [][]byte) {
+	this.cache.Prune()
+	this.tracking.invalidateAll()
+	c.writer.WriteSimple("OK")
+}
+
+func (this *RESPServer) cmdInfo(c *respConn, args [][]byte) {
+	stats := this.Stats()
+	compression := this.cache.CompressionStats()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Server\r\n")
+	fmt.Fprintf(&buf, "lrucached_version:1.0.0\r\n")
+	fmt.Fprintf(&buf, "uptime_in_seconds:%d\r\n", int64(time.Since(this.start).Seconds()))
+	fmt.Fprintf(&buf, "\r\n# Clients\r\n")
+	fmt.Fprintf(&buf, "connected_clients:%d\r\n", stats.ConnectedClients)
+	fmt.Fprintf(&buf, "tracking_total_keys:%d\r\n", this.tracking.size())
+	fmt.Fprintf(&buf, "\r\n# Memory\r\n")
+	fmt.Fprintf(&buf, "used_memory:%d\r\n", this.cache.TotalCharge())
+	fmt.Fprintf(&buf, "maxmemory:%d\r\n", this.cache.Capacity())
+	fmt.Fprintf(&buf, "maxmemory_policy:allkeys-lru\r\n")
+	fmt.Fprintf(&buf, "compressed_entries:%d\r\n", compression.CompressedEntries)
+	fmt.Fprintf(&buf, "compression_ratio:%.2f\r\n", compression.Ratio())
+	fmt.Fprintf(&buf, "\r\n# Stats\r\n")
+	fmt.Fprintf(&buf, "total_connections_received:%d\r\n", stats.TotalConnections)
+	fmt.Fprintf(&buf, "total_commands_processed:%d\r\n", stats.TotalCommands)
+	fmt.Fprintf(&buf, "keyspace_hits:%d\r\n", stats.KeyspaceHits)
+	fmt.Fprintf(&buf, "keyspace_misses:%d\r\n", stats.KeyspaceMisses)
+	c.writer.WriteBulk(buf.Bytes())
+}
+
+func (this *RESPServer) cmdConfig(c *respConn, args [][]byte) {
+	if len(args) < 3 {
+		wrongArgs(c, args)
+		return
+	}
+	sub := strings.ToUpper(string(args[1]))
+	param := strings.ToLower(string(args[2]))
+	switch {
+	case sub == "GET" && len(args) == 3:
+		if param != "maxmemory" {
+			c.writer.WriteMapHeader(0)
+			return
+		}
+		c.writer.WriteMapHeader(1)
+		c.writer.WriteBulkString("maxmemory")
+		c.writer.WriteBulkString(strconv.FormatUint(this.cache.Capacity(), 10))
+	case sub == "SET" && len(args) == 4:
+		if param != "maxmemory" {
+			c.writer.WriteError(fmt.Sprintf("ERR Unsupported CONFIG parameter: %s", args[2]))
+			return
+		}
+		capacity, err := strconv.ParseUint(string(args[3]), 10, 64)
+		if err != nil {
+			c.writer.WriteError("ERR Invalid argument for CONFIG SET 'maxmemory'")
+			return
+		}
+		this.cache.SetCapacity(capacity)
+		c.writer.WriteSimple("OK")
+	default:
+		c.writer.WriteError("ERR syntax error")
+	}
+}
+
+/**
+CLIENT TRACKING ON|OFF; invalidations are pushed on the same connection, so RESP3 is required
+*/
+func (this *RESPServer) cmdClient(c *respConn, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(c, args)
+		return
+	}
+	switch strings.ToUpper(string(args[1])) {
+	case "TRACKING":
+		if len(args) != 3 {
+			wrongArgs(c, args)
+			return
+		}
+		switch strings.ToUpper(string(args[2])) {
+		case "ON":
+			if c.writer.proto < 3 {
+				c.writer.WriteError("ERR client tracking need RESP3, switch with HELLO 3")
+				return
+			}
+			c.setTracking(true)
+		case "OFF":
+			c.setTracking(false)
+		default:
+			c.writer.WriteError("ERR syntax error")
+			return
+		}
+		c.writer.WriteSimple("OK")
+	default:
+		c.writer.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
+
+/*********** cache access *************/
+
+/**
+connection with tracking on is told when key changes; tracked before read,
+so a write racing with the read is always pushed
+*/
+func (this *RESPServer) track(c *respConn, key []byte) {
+	// under push_mutex, so a connection turning tracking off untrack after it
+	var evicted string
+	var conns map[*respConn]struct{}
+	c.push_mutex.Lock()
+	if c.tracking {
+		evicted, conns = this.tracking.track(c, key)
+	}
+	c.push_mutex.Unlock()
+	for other := range conns {
+		other.pushInvalidate(evicted)
+	}
+}
+
+func (this *RESPServer) set(key, value []byte) {
+	// key and value are owned by command, no copy needed
+	this.cache.Insert(key, string(value), uint64(len(key)+len(value)), nil)
+	this.tracking.invalidate(key)
+}
+
+func (this *RESPServer) writeValue(c *respConn, entry interface{}) {
+	if entry == nil {
+		atomic.AddUint64(&this.stats.KeyspaceMisses, 1)
+		c.writer.WriteNull()
+		return
+	}
+	atomic.AddUint64(&this.stats.KeyspaceHits, 1)
+	switch v := entry.(type) {
+	case string:
+		c.writer.WriteBulkString(v)
+	case []byte:
+		c.writer.WriteBulk(v)
+	case int64:
+		c.writer.WriteBulkString(strconv.FormatInt(v, 10))
+	default:
+		c.writer.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+}
+
+/**
+string entry holding an integer is converted to int64 by merge
+*/
+func (this *RESPServer) incrBy(key []byte, delta int64) (int64, error) {
+	var n int64
+	var err error
+	this.cache.Compute(key, func(old interface{}, exists bool) (interface{}, uint64, lrucache.Action) {
+		switch v := old.(type) {
+		case int64:
+			n = v
+		case string:
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = errNotInteger
+			}
+		default:
+			if exists {
+				err = errNotInteger
+			}
+		}
+		if err == nil && (delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta) {
+			err = errOverflow
+		}
+		if err != nil {
+			// untouched: no new version, no event
+			return nil, 0, lrucache.ActionKeep
+		}
+		n += delta
+		return n, uint64(len(key)) + lrucache.Int64ChargeOperator(nil, 0, 0), lrucache.ActionReplace
+	})
+	return n, err
+}
+
+/**
+globMatch match key against pattern like KEYS of redis: * and ? match any byte, '/' too;
+[abc], [^abc] and [a-z] match a set; \ escape next byte
+*/
+func globMatch(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			var ok bool
+			if ok, pattern = globClass(pattern[1:], key[0]); !ok {
+				return false
+			}
+			key = key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+	return len(key) == 0
+}
+
+/**
+globClass match c against set following '[', and return pattern after ']'
+*/
+func globClass(pattern []byte, c byte) (bool, []byte) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			pattern = pattern[1:]
+			match = match || pattern[0] == c
+		case len(pattern) > 2 && pattern[1] == '-':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			match = match || c >= low && c <= high
+			pattern = pattern[2:]
+		default:
+			match = match || pattern[0] == c
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return match != not, pattern
+}
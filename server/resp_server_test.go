@@ -0,0 +1,275 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GerSure/lrucache"
+)
+
+func startRESPServer(t *testing.T, network, addr string) (*RESPServer, net.Listener) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewRESPServer(lrucache.NewLRUCache(1024*1024, 1))
+	go srv.Serve(l)
+	return srv, l
+}
+
+/**
+send all commands in one write, then read exactly len(expected) bytes of replies
+*/
+func roundTrip(t *testing.T, conn net.Conn, request, expected string) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply error: %v, got: %q", err, reply)
+	}
+	if string(reply) != expected {
+		t.Errorf("request: %q\nexpected: %q\ngot: %q", request, expected, reply)
+	}
+}
+
+func TestRESPServer_Pipeline(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip(t, conn,
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"+
+			"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"+
+			"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"+
+			"*3\r\n$6\r\nEXISTS\r\n$3\r\nkey\r\n$7\r\nmissing\r\n"+
+			"PING\r\n",
+		"+OK\r\n$5\r\nvalue\r\n$-1\r\n:1\r\n+PONG\r\n")
+
+	roundTrip(t, conn,
+		"INCRBY counter 10\r\nINCRBY counter -3\r\nGET counter\r\nINCR key\r\nSET num 5\r\nINCR num\r\n",
+		":10\r\n:7\r\n$1\r\n7\r\n-ERR value is not an integer or out of range\r\n+OK\r\n:6\r\n")
+
+	roundTrip(t, conn,
+		"MSET a 1 b 2\r\nMGET a b c\r\nDEL a c\r\nDBSIZE\r\n",
+		"+OK\r\n*3\r\n$1\r\n1\r\n$1\r\n2\r\n$-1\r\n:1\r\n:4\r\n")
+
+	roundTrip(t, conn,
+		"CONFIG SET maxmemory 100\r\nCONFIG GET maxmemory\r\nFLUSHALL\r\nDBSIZE\r\nNOSUCH\r\n",
+		"+OK\r\n*2\r\n$9\r\nmaxmemory\r\n$3\r\n100\r\n+OK\r\n:0\r\n-ERR unknown command 'NOSUCH'\r\n")
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "INFO\r\n")
+	r := bufio.NewReader(conn)
+	header, _ := r.ReadString('\n')
+	n, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if !strings.HasPrefix(header, "$") || err != nil {
+		t.Fatalf("INFO reply expected bulk, got: %q", header)
+	}
+	info := make([]byte, n+2)
+	io.ReadFull(r, info)
+	if !strings.Contains(string(info), "maxmemory:100\r\n") || !strings.Contains(string(info), "used_memory:0\r\n") {
+		t.Errorf("INFO missing memory fields:\n%s", info)
+	}
+}
+
+func TestRESPServer_KeysAndOverflow(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// * and ? match '/' like redis
+	roundTrip(t, conn,
+		"MSET a/b 1 a/c/d 2 ab 3\r\nKEYS a/*/d\r\nKEYS a?b\r\nKEYS a[^/]\r\nKEYS a[\r\nKEYS a\\/b\r\n",
+		"+OK\r\n*1\r\n$5\r\na/c/d\r\n*1\r\n$3\r\na/b\r\n*1\r\n$2\r\nab\r\n*0\r\n*1\r\n$3\r\na/b\r\n")
+
+	roundTrip(t, conn,
+		"SET n 9223372036854775806\r\nINCR n\r\nINCR n\r\nGET n\r\nDECRBY n -9223372036854775808\r\nSET m -9223372036854775807\r\nDECR m\r\nDECR m\r\n",
+		"+OK\r\n:9223372036854775807\r\n-ERR increment or decrement would overflow\r\n$19\r\n9223372036854775807\r\n"+
+			"-ERR decrement would overflow\r\n+OK\r\n:-9223372036854775808\r\n-ERR increment or decrement would overflow\r\n")
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "a/b/c", true},
+		{"user:*", "user:1/2", true},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"a*b", "a/b/c", false},
+		{"?/?", "a/b", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"[\\]]", "]", true},
+		{"", "", true},
+		{"", "a", false},
+	} {
+		if got := globMatch([]byte(c.pattern), []byte(c.key)); got != c.match {
+			t.Errorf("pattern %q key %q expected: %v, got: %v", c.pattern, c.key, c.match, got)
+		}
+	}
+}
+
+func TestRESPServer_CompareAndSwap(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// versions of a new cache start at 2
+	roundTrip(t, conn,
+		"SET v x\r\nGETV v\r\nCAS v 2 y\r\nCAS v 2 z\r\nGET v\r\nCAD v 2\r\nCAD v 3\r\nCAS v 0 w\r\nGETV missing\r\n",
+		"+OK\r\n*2\r\n$1\r\nx\r\n:2\r\n:3\r\n$-1\r\n$1\r\ny\r\n:0\r\n:1\r\n:4\r\n$-1\r\n")
+
+	// failed INCR leave the entry untouched, its version too
+	roundTrip(t, conn,
+		"SET s abc\r\nINCR s\r\nCAS s 5 t\r\n",
+		"+OK\r\n-ERR value is not an integer or out of range\r\n:6\r\n")
+}
+
+func TestRESPServer_BadMultibulk(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	for _, request := range []string{"*-1\r\n", "*0\r\n", "*-9223372036854775808\r\n"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, request, "-ERR Protocol error\r\n")
+		conn.Close()
+	}
+	// server still serve new connections
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "PING\r\n", "+PONG\r\n")
+}
+
+func TestRESPServer_RESP3Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrucached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lrucached.sock")
+
+	srv, _ := startRESPServer(t, "unix", path)
+	defer srv.Close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip(t, conn, "HELLO 3\r\nGET missing\r\nQUIT\r\n",
+		"%3\r\n$6\r\nserver\r\n$9\r\nlrucached\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+			"_\r\n+OK\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("QUIT should close connection, got: %v", err)
+	}
+}
+
+func TestRESPServer_ClientTracking(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	tracking, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracking.Close()
+	writer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	roundTrip(t, tracking, "CLIENT TRACKING ON\r\n", "-ERR client tracking need RESP3, switch with HELLO 3\r\n")
+	roundTrip(t, tracking, "HELLO 3\r\nCLIENT TRACKING ON\r\nGET k1\r\nMGET k2 k3\r\n",
+		"%3\r\n$6\r\nserver\r\n$9\r\nlrucached\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+			"+OK\r\n_\r\n*2\r\n_\r\n_\r\n")
+
+	// only keys read by tracking connection are pushed, once per read
+	roundTrip(t, writer, "SET k1 a\r\nSET other b\r\n", "+OK\r\n+OK\r\n")
+	roundTrip(t, tracking, "", ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk1\r\n")
+	roundTrip(t, writer, "SET k1 b\r\nDEL k3\r\n", "+OK\r\n:0\r\n")
+	roundTrip(t, tracking, "", ">2\r\n$10\r\ninvalidate\r\n*1\r\n$2\r\nk3\r\n")
+
+	roundTrip(t, tracking, "GET k1\r\n", "$1\r\nb\r\n")
+	roundTrip(t, writer, "FLUSHALL\r\n", "+OK\r\n")
+	roundTrip(t, tracking, "", ">2\r\n$10\r\ninvalidate\r\n_\r\n")
+
+	roundTrip(t, tracking, "CLIENT TRACKING OFF\r\nGET k1\r\n", "+OK\r\n_\r\n")
+	roundTrip(t, writer, "SET k1 c\r\n", "+OK\r\n")
+	roundTrip(t, tracking, "PING\r\n", "+PONG\r\n")
+}
+
+func TestRESPServer_TrackingClose(t *testing.T) {
+	srv, l := startRESPServer(t, "tcp", "127.0.0.1:0")
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn, "HELLO 3\r\nCLIENT TRACKING ON\r\nMGET k1 k2\r\n",
+		"%3\r\n$6\r\nserver\r\n$9\r\nlrucached\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+			"+OK\r\n*2\r\n_\r\n_\r\n")
+	if n := srv.tracking.size(); n != 2 {
+		t.Fatalf("expected 2 tracked keys, got: %d", n)
+	}
+	// closed connection is not pinned by its keys
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.tracking.size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	srv.tracking.mutex.Lock()
+	keys, conns := len(srv.tracking.keys), len(srv.tracking.conns)
+	srv.tracking.mutex.Unlock()
+	if keys != 0 || conns != 0 {
+		t.Errorf("closed connection still tracked, keys: %d, connections: %d", keys, conns)
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sync"
+)
+
+// keys remembered for client side caching; oldest are invalidated beyond that
+const defaultTrackingMaxKeys = 1 << 20
+
+/**
+trackingTable remember which connections have read a key with CLIENT TRACKING ON,
+a write of the key send them an invalidate push and forget them, like redis default mode.
+conns index keys of every connection, so a closed one is dropped at once.
+*/
+type trackingTable struct {
+	mutex    sync.Mutex
+	keys     map[string]map[*respConn]struct{}
+	conns    map[*respConn]map[string]struct{}
+	max_keys int
+}
+
+func newTrackingTable() *trackingTable {
+	return &trackingTable{
+		keys:     make(map[string]map[*respConn]struct{}),
+		conns:    make(map[*respConn]map[string]struct{}),
+		max_keys: defaultTrackingMaxKeys,
+	}
+}
+
+/**
+track remember c read key; an old key dropped for room is returned with its
+connections, caller push invalidate of it without holding locks
+*/
+func (this *trackingTable) track(c *respConn, key []byte) (string, map[*respConn]struct{}) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	var evicted string
+	var evicted_conns map[*respConn]struct{}
+	conns, ok := this.keys[string(key)]
+	if !ok {
+		if len(this.keys) >= this.max_keys {
+			evicted, evicted_conns = this.evictOne()
+		}
+		conns = make(map[*respConn]struct{})
+		this.keys[string(key)] = conns
+	}
+	conns[c] = struct{}{}
+	keys, ok := this.conns[c]
+	if !ok {
+		keys = make(map[string]struct{})
+		this.conns[c] = keys
+	}
+	keys[string(key)] = struct{}{}
+	return evicted, evicted_conns
+}
+
+/**
+untrack forget every key of c, when it's closed or turn tracking off
+*/
+func (this *trackingTable) untrack(c *respConn) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for key := range this.conns[c] {
+		conns := this.keys[key]
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(this.keys, key)
+		}
+	}
+	delete(this.conns, c)
+}
+
+/**
+invalidate send key to every connection which has read it
+*/
+func (this *trackingTable) invalidate(key []byte) {
+	this.mutex.Lock()
+	conns, ok := this.keys[string(key)]
+	if ok {
+		this.forget(string(key), conns)
+	}
+	this.mutex.Unlock()
+	// closed connections were untracked, the ones closing meanwhile ignore it
+	for c := range conns {
+		c.pushInvalidate(string(key))
+	}
+}
+
+/**
+invalidateAll tell every tracking connection to drop its whole cache
+*/
+func (this *trackingTable) invalidateAll() {
+	this.mutex.Lock()
+	all := this.conns
+	this.keys = make(map[string]map[*respConn]struct{})
+	this.conns = make(map[*respConn]map[string]struct{})
+	this.mutex.Unlock()
+	for c := range all {
+		c.pushInvalidateAll()
+	}
+}
+
+/**
+evictOne forget an arbitrary key, given by map iteration; caller hold mutex
+*/
+func (this *trackingTable) evictOne() (string, map[*respConn]struct{}) {
+	for key, conns := range this.keys {
+		this.forget(key, conns)
+		return key, conns
+	}
+	return "", nil
+}
+
+// caller hold mutex
+func (this *trackingTable) forget(key string, conns map[*respConn]struct{}) {
+	delete(this.keys, key)
+	for c := range conns {
+		keys := this.conns[c]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(this.conns, c)
+		}
+	}
+}
+
+func (this *trackingTable) size() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.keys)
+}
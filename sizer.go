@@ -0,0 +1,172 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Sizer can be implemented by cache entries which know their own memory usage;
+// EstimateSize will use it instead of walking the value with reflection.
+type Sizer interface {
+	Size() uint64
+}
+
+type MetadataChargePolicy int
+
+const (
+	// only the charge given by caller (or estimated from entry) is counted
+	DontChargeCacheMetadata MetadataChargePolicy = iota
+	// LRUHandle and key bytes are added to every entry's charge
+	FullChargeCacheMetadata
+)
+
+// approximate per entry overhead of a go map bucket slot
+const mapEntryOverhead = 16
+
+var sizerType = reflect.TypeOf((*Sizer)(nil)).Elem()
+
+/**
+EstimateSize return the approximate heap usage of entry in bytes;
+used by Insert/Merge when caller pass charge == 0.
+pointers, slices and maps shared inside entry are counted only once.
+*/
+func EstimateSize(entry interface{}) uint64 {
+	if entry == nil {
+		return 0
+	}
+	if s, ok := entry.(Sizer); ok {
+		return s.Size()
+	}
+	v := reflect.ValueOf(entry)
+	seen := make(map[uintptr]struct{})
+	return uint64(v.Type().Size()) + indirectSize(v, seen)
+}
+
+/**
+indirectSize return the memory referenced by v, the inline size of v itself
+is counted by the caller.
+*/
+func indirectSize(v reflect.Value, seen map[uintptr]struct{}) uint64 {
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface &&
+		v.CanInterface() && v.Type().Implements(sizerType) {
+		if s, ok := v.Interface().(Sizer); ok {
+			size := s.Size()
+			if inline := uint64(v.Type().Size()); size > inline {
+				return size - inline
+			}
+			return 0
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return uint64(v.Len())
+	case reflect.Ptr:
+		if v.IsNil() || visited(v.Pointer(), seen) {
+			return 0
+		}
+		elem := v.Elem()
+		if v.CanInterface() && v.Type().Implements(sizerType) {
+			if s, ok := v.Interface().(Sizer); ok {
+				return s.Size()
+			}
+		}
+		return uint64(elem.Type().Size()) + indirectSize(elem, seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		elem := v.Elem()
+		return uint64(elem.Type().Size()) + indirectSize(elem, seen)
+	case reflect.Slice:
+		if v.IsNil() || visited(v.Pointer(), seen) {
+			return 0
+		}
+		size := uint64(v.Cap()) * uint64(v.Type().Elem().Size())
+		if hasIndirect(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += indirectSize(v.Index(i), seen)
+			}
+		}
+		return size
+	case reflect.Array:
+		var size uint64
+		if hasIndirect(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += indirectSize(v.Index(i), seen)
+			}
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || visited(v.Pointer(), seen) {
+			return 0
+		}
+		kt, vt := v.Type().Key(), v.Type().Elem()
+		per_entry := uint64(kt.Size()) + uint64(vt.Size()) + mapEntryOverhead
+		size := uint64(v.Len()) * per_entry
+		if hasIndirect(kt) || hasIndirect(vt) {
+			iter := v.MapRange()
+			for iter.Next() {
+				size += indirectSize(iter.Key(), seen)
+				size += indirectSize(iter.Value(), seen)
+			}
+		}
+		return size
+	case reflect.Struct:
+		var size uint64
+		for i := 0; i < v.NumField(); i++ {
+			size += indirectSize(v.Field(i), seen)
+		}
+		return size
+	}
+	return 0
+}
+
+func visited(ptr uintptr, seen map[uintptr]struct{}) bool {
+	if _, ok := seen[ptr]; ok {
+		return true
+	}
+	seen[ptr] = struct{}{}
+	return false
+}
+
+// hasIndirect report whether values of t may reference other memory
+func hasIndirect(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return true
+	case reflect.Array:
+		return hasIndirect(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasIndirect(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+metadataCharge return the memory used by cache itself for one entry
+*/
+func metadataCharge(key []byte) uint64 {
+	return uint64(unsafe.Sizeof(LRUHandle{})) + uint64(len(key))
+}
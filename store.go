@@ -0,0 +1,463 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoreNotFound = errors.New("lrucache: key not found in store")
+	ErrStoreClosed   = errors.New("lrucache: store cache closed")
+)
+
+const storeLockStripes = 64
+
+/**
+Store is the backing store of a StoreCache; Get return ErrStoreNotFound for missing keys
+*/
+type Store interface {
+	Get(key []byte) (interface{}, error)
+	Put(key []byte, entry interface{}) error
+	Delete(key []byte) error
+	BatchPut(entries []StoreEntry) error
+}
+
+type StoreEntry struct {
+	Key   []byte
+	Entry interface{}
+}
+
+type WriteMode int
+
+const (
+	// Insert and Remove return after the store is written
+	WriteThrough WriteMode = iota
+	// Insert and Remove change the cache, store is written in background batches
+	WriteBehind
+)
+
+type StoreOptions struct {
+	Mode          WriteMode
+	FlushInterval time.Duration // write behind flush period, default 100ms
+	MaxBatch      int           // entries of a BatchPut, default 256; more pending start a flush at once
+	// background flush error; failed writes are kept and retried by next flush
+	OnFlushError func(err error)
+	// write behind Insert wait for flush when a shard has so many dirty bytes, 0 is shard capacity
+	MaxDirtyBytes uint64
+}
+
+type StoreStats struct {
+	Writes      uint64 // Insert and Remove
+	Coalesced   uint64 // write behind writes that replaced a pending one of the same key
+	StoreWrites uint64 // puts and deletes done on store
+	Flushes     uint64
+	FlushErrors uint64
+	Pending     uint64 // writes not in store yet
+	// write behind entries written by eviction before their flush
+	EvictionFlushes uint64
+}
+
+type storeStats struct {
+	writes, coalesced, store_writes, flushes, flush_errors, eviction_flushes uint64
+}
+
+// write behind change of a key waiting for flush
+type pendingWrite struct {
+	entry   interface{}
+	version uint64 // of the dirty cache entry, or a new id for a delete
+	deleted bool
+}
+
+/**
+StoreCache keep LRUCache in front of a Store. write behind writes of a key are
+coalesced, only the last one reach the store; Lookup see pending writes, so a
+value evicted before it's flushed is still read right.
+*/
+type StoreCache struct {
+	cache   *LRUCache
+	store   Store
+	options StoreOptions
+
+	locks [storeLockStripes]sync.Mutex // write through order of store and cache per key
+
+	mutex    sync.Mutex
+	pending  map[string]*pendingWrite
+	flushing map[string]*pendingWrite // taken by a flush, maybe not in store yet
+	closed   bool
+
+	flush_mutex sync.Mutex // one flush at a time, so a newer write never goes first
+	// held around write behind store writes; eviction flush a dirty entry anytime,
+	// and an older write of a flush must not land after it
+	store_mutex sync.Mutex
+	written     map[string]uint64 // version last written, of keys flushed by eviction
+	signal      chan struct{}
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	stats storeStats
+}
+
+func NewStoreCache(cache *LRUCache, store Store, options StoreOptions) *StoreCache {
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = 100 * time.Millisecond
+	}
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = 256
+	}
+	this := &StoreCache{
+		cache:   cache,
+		store:   store,
+		options: options,
+		pending: make(map[string]*pendingWrite),
+		written: make(map[string]uint64),
+		signal:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if options.Mode == WriteBehind {
+		// dirty victims of eviction are written at once
+		cache.SetFlusher(func(key []byte, entry interface{}, version uint64) error {
+			this.store_mutex.Lock()
+			defer this.store_mutex.Unlock()
+			err := store.Put(key, entry)
+			if err == nil {
+				this.mutex.Lock()
+				this.written[string(key)] = version
+				this.mutex.Unlock()
+				atomic.AddUint64(&this.stats.eviction_flushes, 1)
+			}
+			return err
+		}, options.MaxDirtyBytes)
+		this.wg.Add(1)
+		go this.flushLoop()
+	}
+	return this
+}
+
+/**
+Insert entry to cache and store; charge 0 means estimate it.
+with write through an error of store leave the cache unchanged
+*/
+func (this *StoreCache) Insert(key []byte, entry interface{}, charge uint64) error {
+	atomic.AddUint64(&this.stats.writes, 1)
+	if this.options.Mode == WriteThrough {
+		lock := this.lock(key)
+		defer lock.Unlock()
+		if err := this.store.Put(key, entry); err != nil {
+			return err
+		}
+		atomic.AddUint64(&this.stats.store_writes, 1)
+		this.cache.Insert(key, entry, charge, nil)
+		return nil
+	}
+	return this.queue(key, func() *pendingWrite {
+		version := this.cache.InsertDirty(key, entry, charge, nil)
+		return &pendingWrite{entry: entry, version: version}
+	})
+}
+
+/**
+Remove key from cache and store
+*/
+func (this *StoreCache) Remove(key []byte) error {
+	atomic.AddUint64(&this.stats.writes, 1)
+	if this.options.Mode == WriteThrough {
+		lock := this.lock(key)
+		defer lock.Unlock()
+		if err := this.store.Delete(key); err != nil && err != ErrStoreNotFound {
+			return err
+		}
+		atomic.AddUint64(&this.stats.store_writes, 1)
+		this.cache.Remove(key)
+		return nil
+	}
+	return this.queue(key, func() *pendingWrite {
+		this.cache.Remove(key)
+		return &pendingWrite{deleted: true, version: this.cache.NewId()}
+	})
+}
+
+/**
+Lookup read key from cache, then from pending writes, then from store;
+values read from store are cached, missing keys too as tombstones.
+return ErrStoreNotFound if key doesn't exist
+*/
+func (this *StoreCache) Lookup(key []byte) (interface{}, error) {
+	entry, token, status := this.cache.LookupOrLease(key)
+	if status == LeaseHit {
+		if tombstone, ok := entry.(*Tombstone); ok {
+			if tombstone.NotFound() {
+				return nil, ErrStoreNotFound
+			}
+			return nil, tombstone.Err
+		}
+		return entry, nil
+	}
+
+	this.mutex.Lock()
+	write, ok := this.pending[string(key)]
+	if !ok {
+		write, ok = this.flushing[string(key)]
+	}
+	this.mutex.Unlock()
+	if ok {
+		if token != 0 {
+			this.cache.ReleaseLease(key, token)
+		}
+		if write.deleted {
+			return nil, ErrStoreNotFound
+		}
+		return write.entry, nil
+	}
+
+	entry, err := this.store.Get(key)
+	switch {
+	case token == 0:
+		// another caller is loading it
+	case err == ErrStoreNotFound:
+		this.cache.InsertNotFoundWithLease(append([]byte(nil), key...), token)
+	case err != nil:
+		this.cache.ReleaseLease(key, token)
+	default:
+		this.cache.InsertWithLease(append([]byte(nil), key...), token, entry, 0, nil)
+	}
+	return entry, err
+}
+
+/**
+Flush write pending writes to store, and retry failed ones until ctx is done;
+return nil when every write made before it reached the store
+*/
+func (this *StoreCache) Flush(ctx context.Context) error {
+	for {
+		err := this.flush()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(this.options.FlushInterval):
+		}
+	}
+}
+
+/**
+Close flush pending writes like Flush and stop background flush;
+writes after it fail with ErrStoreClosed
+*/
+func (this *StoreCache) Close(ctx context.Context) error {
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	this.mutex.Unlock()
+	close(this.stop)
+	this.wg.Wait()
+	return this.Flush(ctx)
+}
+
+func (this *StoreCache) Cache() *LRUCache {
+	return this.cache
+}
+
+func (this *StoreCache) Stats() StoreStats {
+	this.mutex.Lock()
+	pending := len(this.pending) + len(this.flushing)
+	this.mutex.Unlock()
+	return StoreStats{
+		Writes:      atomic.LoadUint64(&this.stats.writes),
+		Coalesced:   atomic.LoadUint64(&this.stats.coalesced),
+		StoreWrites: atomic.LoadUint64(&this.stats.store_writes),
+		Flushes:     atomic.LoadUint64(&this.stats.flushes),
+		FlushErrors: atomic.LoadUint64(&this.stats.flush_errors),
+		Pending:     uint64(pending),
+
+		EvictionFlushes: atomic.LoadUint64(&this.stats.eviction_flushes),
+	}
+}
+
+func (this *StoreCache) lock(key []byte) *sync.Mutex {
+	lock := &this.locks[HashSlice(key)%storeLockStripes]
+	lock.Lock()
+	return lock
+}
+
+/**
+queue a write behind write; apply change the cache under the lock of key,
+so cache and pending writes agree on the order of writes of a key.
+apply may wait for flush when there are too many dirty bytes
+*/
+func (this *StoreCache) queue(key []byte, apply func() *pendingWrite) error {
+	lock := this.lock(key)
+	defer lock.Unlock()
+	this.mutex.Lock()
+	closed := this.closed
+	this.mutex.Unlock()
+	if closed {
+		return ErrStoreClosed
+	}
+	write := apply()
+
+	this.mutex.Lock()
+	if _, ok := this.pending[string(key)]; ok {
+		atomic.AddUint64(&this.stats.coalesced, 1)
+	}
+	this.pending[string(key)] = write
+	full := len(this.pending) >= this.options.MaxBatch
+	this.mutex.Unlock()
+
+	if full {
+		select {
+		case this.signal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (this *StoreCache) flushLoop() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		case <-this.signal:
+		}
+		if err := this.flush(); err != nil && this.options.OnFlushError != nil {
+			this.options.OnFlushError(err)
+		}
+	}
+}
+
+/**
+flush write what is pending now; writes failed are put back unless the key
+was written again meanwhile. return first error
+*/
+func (this *StoreCache) flush() error {
+	this.flush_mutex.Lock()
+	defer this.flush_mutex.Unlock()
+
+	this.mutex.Lock()
+	writes := this.pending
+	if len(writes) == 0 {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.pending = make(map[string]*pendingWrite)
+	this.flushing = writes
+	this.mutex.Unlock()
+	atomic.AddUint64(&this.stats.flushes, 1)
+
+	var first error
+	failed := make(map[string]*pendingWrite)
+	var batch []StoreEntry
+	put := func() {
+		this.store_mutex.Lock()
+		batch = this.drop_written(batch, writes)
+		if len(batch) == 0 {
+			this.store_mutex.Unlock()
+			return
+		}
+		err := this.store.BatchPut(batch)
+		this.store_mutex.Unlock()
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			for _, e := range batch {
+				failed[string(e.Key)] = writes[string(e.Key)]
+			}
+		} else {
+			atomic.AddUint64(&this.stats.store_writes, uint64(len(batch)))
+			for _, e := range batch {
+				this.cache.MarkClean(e.Key, writes[string(e.Key)].version)
+			}
+		}
+		batch = batch[:0]
+	}
+	for key, write := range writes {
+		if write.deleted {
+			var err error
+			this.store_mutex.Lock()
+			if len(this.drop_written([]StoreEntry{{Key: []byte(key)}}, writes)) > 0 {
+				err = this.store.Delete([]byte(key))
+			}
+			this.store_mutex.Unlock()
+			if err != nil && err != ErrStoreNotFound {
+				if first == nil {
+					first = err
+				}
+				failed[key] = write
+			} else {
+				atomic.AddUint64(&this.stats.store_writes, 1)
+			}
+			continue
+		}
+		batch = append(batch, StoreEntry{Key: []byte(key), Entry: write.entry})
+		if len(batch) >= this.options.MaxBatch {
+			put()
+		}
+	}
+	put()
+
+	this.mutex.Lock()
+	this.flushing = nil
+	for key, write := range failed {
+		if _, ok := this.pending[key]; !ok {
+			this.pending[key] = write
+		}
+	}
+	// no older write of these keys is left to drop
+	for key := range writes {
+		if _, ok := this.pending[key]; !ok {
+			delete(this.written, key)
+		}
+	}
+	this.mutex.Unlock()
+	if len(failed) > 0 {
+		atomic.AddUint64(&this.stats.flush_errors, 1)
+	}
+	return first
+}
+
+/**
+drop_written remove writes of batch older than what eviction already wrote to store;
+must hold store_mutex
+*/
+func (this *StoreCache) drop_written(batch []StoreEntry, writes map[string]*pendingWrite) []StoreEntry {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	kept := batch[:0]
+	for _, e := range batch {
+		if written, ok := this.written[string(e.Key)]; ok && written >= writes[string(e.Key)].version {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
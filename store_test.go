@@ -0,0 +1,258 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	mutex   sync.Mutex
+	data    map[string]interface{}
+	puts    int
+	batches int
+	fail    error
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string]interface{})}
+}
+
+func (this *memStore) Get(key []byte) (interface{}, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entry, ok := this.data[string(key)]
+	if !ok {
+		return nil, ErrStoreNotFound
+	}
+	return entry, nil
+}
+
+func (this *memStore) Put(key []byte, entry interface{}) error {
+	return this.BatchPut([]StoreEntry{{Key: key, Entry: entry}})
+}
+
+func (this *memStore) Delete(key []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.fail != nil {
+		return this.fail
+	}
+	delete(this.data, string(key))
+	return nil
+}
+
+func (this *memStore) BatchPut(entries []StoreEntry) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.fail != nil {
+		return this.fail
+	}
+	this.batches++
+	for _, e := range entries {
+		this.puts++
+		this.data[string(e.Key)] = e.Entry
+	}
+	return nil
+}
+
+func (this *memStore) setFail(err error) {
+	this.mutex.Lock()
+	this.fail = err
+	this.mutex.Unlock()
+}
+
+func (this *memStore) get(key string) interface{} {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.data[key]
+}
+
+func TestStoreCache_WriteThrough(t *testing.T) {
+	store := newMemStore()
+	cache := NewStoreCache(NewLRUCache(1024*1024, 1), store, StoreOptions{Mode: WriteThrough})
+	defer cache.Close(context.Background())
+
+	if err := cache.Insert([]byte("a"), "1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if store.get("a") != "1" || cache.Cache().Lookup([]byte("a")) != "1" {
+		t.Errorf("write through should write store and cache")
+	}
+
+	store.setFail(errors.New("store down"))
+	if err := cache.Insert([]byte("a"), "2", 2); err == nil {
+		t.Errorf("failed store write should fail Insert")
+	}
+	if value, _ := cache.Lookup([]byte("a")); value != "1" {
+		t.Errorf("failed write should not change cache, got: %v", value)
+	}
+	store.setFail(nil)
+
+	if err := cache.Remove([]byte("a")); err != nil || store.get("a") != nil {
+		t.Errorf("remove should delete from store, err: %v", err)
+	}
+
+	// read through; missing keys are cached as tombstones
+	store.Put([]byte("b"), "from store")
+	if value, err := cache.Lookup([]byte("b")); value != "from store" || err != nil {
+		t.Errorf("read through got: %v, %v", value, err)
+	}
+	if cache.Cache().Lookup([]byte("b")) != "from store" {
+		t.Errorf("value read from store should be cached")
+	}
+	if _, err := cache.Lookup([]byte("c")); err != ErrStoreNotFound {
+		t.Errorf("expected ErrStoreNotFound, got: %v", err)
+	}
+	if _, ok := cache.Cache().Lookup([]byte("c")).(*Tombstone); !ok {
+		t.Errorf("missing key should be cached as tombstone")
+	}
+}
+
+func TestStoreCache_WriteBehind(t *testing.T) {
+	store := newMemStore()
+	cache := NewStoreCache(NewLRUCache(1024*1024, 1), store, StoreOptions{Mode: WriteBehind, FlushInterval: time.Hour, MaxBatch: 1000})
+
+	for i := 0; i < 100; i++ {
+		cache.Insert([]byte("hot"), i, 10)
+	}
+	for i := 0; i < 50; i++ {
+		cache.Insert([]byte("key"+strconv.Itoa(i)), i, 10)
+	}
+	cache.Remove([]byte("key7"))
+	if store.get("hot") != nil {
+		t.Fatalf("write behind should not write store at once")
+	}
+	if value, err := cache.Lookup([]byte("hot")); value != 99 || err != nil {
+		t.Errorf("pending value should be read, got: %v, %v", value, err)
+	}
+	if _, err := cache.Lookup([]byte("key7")); err != ErrStoreNotFound {
+		t.Errorf("pending remove should be seen, got: %v", err)
+	}
+	stats := cache.Stats()
+	if stats.Coalesced != 100 || stats.Pending != 51 || cache.Cache().DirtyCharge() != 500 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// failed flush keep writes until store is back
+	store.setFail(errors.New("store down"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cache.Flush(ctx); err == nil {
+		t.Errorf("flush should fail while store is down")
+	}
+	if stats := cache.Stats(); stats.Pending != 51 || stats.FlushErrors == 0 {
+		t.Errorf("failed writes should be pending, stats: %+v", stats)
+	}
+	store.setFail(nil)
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.get("hot") != 99 || store.get("key49") != 49 || store.get("key7") != nil {
+		t.Errorf("flush wrote wrong values")
+	}
+	if dirty := cache.Cache().DirtyCharge(); dirty != 0 {
+		t.Errorf("flushed entries should be clean, dirty charge: %d", dirty)
+	}
+	// only last write of a key reach store, in one batch
+	if store.puts != 50 || store.batches != 1 {
+		t.Errorf("expected 50 puts in 1 batch, got %d in %d", store.puts, store.batches)
+	}
+	if err := cache.Insert([]byte("late"), 1, 1); err != ErrStoreClosed {
+		t.Errorf("insert after close expected ErrStoreClosed, got: %v", err)
+	}
+}
+
+func TestStoreCache_BackgroundFlush(t *testing.T) {
+	store := newMemStore()
+	cache := NewStoreCache(NewLRUCache(1024*1024, 1), store, StoreOptions{Mode: WriteBehind, FlushInterval: 5 * time.Millisecond})
+	defer cache.Close(context.Background())
+
+	cache.Insert([]byte("a"), "1", 2)
+	deadline := time.Now().Add(2 * time.Second)
+	for store.get("a") != "1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending write not flushed in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoreCache_EvictionFlush(t *testing.T) {
+	store := newMemStore()
+	// too small for all entries; dirty victims are written before they go
+	cache := NewStoreCache(NewLRUCache(100, 0), store, StoreOptions{Mode: WriteBehind, FlushInterval: time.Hour})
+	defer cache.Close(context.Background())
+
+	for i := 0; i < 20; i++ {
+		cache.Insert([]byte("key"+strconv.Itoa(i)), i, 10)
+	}
+	if got := cache.Stats().EvictionFlushes; got != 10 {
+		t.Errorf("expected 10 eviction flushes, got %d", got)
+	}
+	if store.get("key0") != 0 || store.get("key19") != nil {
+		t.Errorf("only evicted entries should be written")
+	}
+	if value, err := cache.Lookup([]byte("key3")); value != 3 || err != nil {
+		t.Errorf("evicted value got: %v, %v", value, err)
+	}
+}
+
+func TestStoreCache_EvictionFlushNewer(t *testing.T) {
+	store := newMemStore()
+	lru := NewLRUCache(100, 0)
+	cache := NewStoreCache(lru, store, StoreOptions{Mode: WriteBehind, FlushInterval: time.Hour})
+	defer cache.Close(context.Background())
+
+	// a newer value of key is flushed by eviction while the older write is still pending
+	cache.Insert([]byte("key"), "old", 10)
+	lru.InsertDirty([]byte("key"), "new", 10, nil)
+	for i := 0; i < 10; i++ {
+		lru.Insert([]byte("filler"+strconv.Itoa(i)), i, 10, nil)
+	}
+	if store.get("key") != "new" {
+		t.Fatalf("newer value not flushed by eviction, store: %v", store.get("key"))
+	}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.get("key") != "new" {
+		t.Errorf("older pending write overwrote newer value, store: %v", store.get("key"))
+	}
+
+	// same for a pending delete older than the value eviction wrote
+	cache.Remove([]byte("key"))
+	lru.InsertDirty([]byte("key"), "again", 10, nil)
+	for i := 0; i < 10; i++ {
+		lru.Insert([]byte("filler"+strconv.Itoa(i)), i, 10, nil)
+	}
+	if err := cache.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.get("key") != "again" {
+		t.Errorf("older pending delete removed newer value, store: %v", store.get("key"))
+	}
+	if len(cache.written) != 0 {
+		t.Errorf("versions of flushed keys are kept: %v", cache.written)
+	}
+}
@@ -0,0 +1,219 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"time"
+	"unsafe"
+)
+
+const (
+	defaultNotFoundTTL = 30 * time.Second
+	defaultErrorTTL    = time.Second
+	defaultMaxErrorTTL = time.Minute
+)
+
+/**
+Tombstone is cached in place of a value to remember that key doesn't exist (Err is nil),
+or that loading it failed. Lookup return *Tombstone until it expires, nil after.
+*/
+type Tombstone struct {
+	Err      error
+	Expires  time.Time
+	Failures int // consecutive load errors, error TTL doubles with each
+}
+
+func (this *Tombstone) NotFound() bool {
+	return this.Err == nil
+}
+
+type NegativeCacheOptions struct {
+	NotFoundTTL time.Duration // default 30s
+	ErrorTTL    time.Duration // TTL after first error, doubled by each next one; default 1s
+	MaxErrorTTL time.Duration // default 1m
+	// charge of a tombstone besides its key, default size of Tombstone
+	Charge uint64
+}
+
+/*********** LRUCache *************/
+
+/**
+SetNegativeCaching set TTLs and charge of tombstones inserted later
+*/
+func (this *LRUCache) SetNegativeCaching(options NegativeCacheOptions) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.SetNegativeCaching(options)
+	}
+}
+
+/**
+InsertNotFound cache absence of key for NotFoundTTL
+*/
+func (this *LRUCache) InsertNotFound(key []byte) *Tombstone {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].InsertTombstone(key, hash, nil);
+}
+
+/**
+InsertError cache a load error of key, so callers don't retry it at once;
+an error following an unexpired (or recently expired) error tombstone back off twice as long
+*/
+func (this *LRUCache) InsertError(key []byte, err error) *Tombstone {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].InsertTombstone(key, hash, err);
+}
+
+/**
+InsertNotFoundWithLease is InsertNotFound for the holder of a lease of LookupOrLease;
+fail with ErrLeaseInvalid like InsertWithLease
+*/
+func (this *LRUCache) InsertNotFoundWithLease(key []byte, token uint64) error {
+	hash := HashSlice(key);
+	_, err := this.shards[this.shard(hash)].InsertTombstoneWithLease(key, hash, token, nil);
+	return err
+}
+
+/**
+ApplyToAllCacheEntriesWithTombstones is ApplyToAllCacheEntries which also visit
+tombstones, expired ones included
+*/
+func (this *LRUCache) ApplyToAllCacheEntriesWithTombstones(travel_fun TravelEntryOperator) {
+	this.mutex.Lock();
+	defer this.mutex.Unlock();
+	this.txn_mutex.Lock();
+	defer this.txn_mutex.Unlock();
+	for _, shard := range this.shards {
+		shard.ApplyToAllCacheEntriesWithTombstones(travel_fun)
+	}
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) SetNegativeCaching(options NegativeCacheOptions) {
+	this.mutex.Lock()
+	defer this.unlock()
+	if options.NotFoundTTL <= 0 {
+		options.NotFoundTTL = defaultNotFoundTTL
+	}
+	if options.ErrorTTL <= 0 {
+		options.ErrorTTL = defaultErrorTTL
+	}
+	if options.MaxErrorTTL < options.ErrorTTL {
+		options.MaxErrorTTL = defaultMaxErrorTTL
+		if options.MaxErrorTTL < options.ErrorTTL {
+			options.MaxErrorTTL = options.ErrorTTL
+		}
+	}
+	this.negative = options
+}
+
+func (this *LRUCacheShard) InsertTombstone(key []byte, hash uint32, err error) *Tombstone {
+	this.mutex.Lock();
+	defer this.unlock()
+	this.invalidate_lease(key, nil)
+	return this.insert_tombstone(key, hash, err)
+}
+
+func (this *LRUCacheShard) InsertTombstoneWithLease(key []byte, hash uint32, token uint64, err error) (*Tombstone, error) {
+	this.mutex.Lock();
+	defer this.unlock()
+	if !this.take_lease(key, token) {
+		return nil, ErrLeaseInvalid
+	}
+	return this.insert_tombstone(key, hash, err), nil
+}
+
+func (this *LRUCacheShard) insert_tombstone(key []byte, hash uint32, err error) *Tombstone {
+	options := this.negative_options()
+	now := time.Now()
+	tombstone := &Tombstone{Err: err}
+	if err == nil {
+		tombstone.Expires = now.Add(options.NotFoundTTL)
+	} else {
+		ttl := options.ErrorTTL
+		tombstone.Failures = 1
+		if e := this.handle_lookup(key, hash); e != nil {
+			if old, ok := e.entry.(*Tombstone); ok && old.Err != nil && now.Before(old.Expires.Add(options.MaxErrorTTL)) {
+				tombstone.Failures = old.Failures + 1
+			}
+		}
+		for i := 1; i < tombstone.Failures && ttl < options.MaxErrorTTL; i++ {
+			ttl *= 2
+		}
+		if ttl > options.MaxErrorTTL {
+			ttl = options.MaxErrorTTL
+		}
+		tombstone.Expires = now.Add(ttl)
+	}
+	charge := options.Charge
+	if charge == 0 {
+		charge = uint64(unsafe.Sizeof(*tombstone))
+	}
+	this.insert(key, hash, tombstone, uint64(len(key))+charge, nil)
+	return tombstone
+}
+
+func (this *LRUCacheShard) ApplyToAllCacheEntriesWithTombstones(travel_fun TravelEntryOperator) {
+	this.mutex.Lock();
+	defer this.unlock()
+	this.table.ApplyToAllHandles(func(h *LRUHandle) {
+		entry, _ := this.handle_value(h)
+		if corrupt(h, entry) {
+			return
+		}
+		travel_fun(h.key, entry)
+	})
+}
+
+func (this *LRUCacheShard) negative_options() NegativeCacheOptions {
+	if this.negative.NotFoundTTL == 0 {
+		return NegativeCacheOptions{
+			NotFoundTTL: defaultNotFoundTTL,
+			ErrorTTL:    defaultErrorTTL,
+			MaxErrorTTL: defaultMaxErrorTTL,
+			Charge:      this.negative.Charge,
+		}
+	}
+	return this.negative
+}
+
+/**
+live_handle is called by lookups of a found handle; an expired tombstone is a miss.
+it's removed, unless it's an error one that may still be needed for backoff
+*/
+func (this *LRUCacheShard) live_handle(e *LRUHandle) bool {
+	tombstone, ok := e.entry.(*Tombstone)
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	if now.Before(tombstone.Expires) {
+		return true
+	}
+	if tombstone.Err == nil || !now.Before(tombstone.Expires.Add(this.negative_options().MaxErrorTTL)) {
+		this.lru_remove_handle(e, true, reasonExpired)
+	}
+	return false
+}
+
+func isTombstone(entry interface{}) bool {
+	_, ok := entry.(*Tombstone)
+	return ok
+}
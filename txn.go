@@ -0,0 +1,180 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrTxnConflict = errors.New("lrucache: transaction condition failed")
+
+type txnOpKind int
+
+const (
+	txnInsert txnOpKind = iota
+	txnRemove
+	txnMerge
+	txnCheck
+)
+
+type txnOp struct {
+	kind       txnOpKind
+	key        []byte
+	entry      interface{}
+	charge     uint64
+	deleter    DeleteCallback
+	merge      MergeOperator
+	charge_opt ChargeOperator
+	version    uint64
+}
+
+/**
+txnKey is state of a key during commit; ops change it, then it's written to shard
+*/
+type txnKey struct {
+	key     []byte
+	hash    uint32
+	shard   *LRUCacheShard
+	version uint64 // before the transaction, 0 if missing
+	exists  bool   // tombstone is not an entry
+	entry   interface{}
+	charge  uint64
+	deleter DeleteCallback
+	changed bool
+}
+
+/**
+Txn is a batch of operations on several keys applied atomically by Commit:
+all of them or, when a condition fails, none. ApplyToAllCacheEntries never see
+a part of it. a Txn is used by one goroutine and committed once.
+*/
+type Txn struct {
+	cache *LRUCache
+	ops   []txnOp
+}
+
+func (this *LRUCache) Txn() *Txn {
+	return &Txn{cache: this}
+}
+
+func (this *Txn) Insert(key []byte, entry interface{}, charge uint64, deleter DeleteCallback) *Txn {
+	this.ops = append(this.ops, txnOp{kind: txnInsert, key: key, entry: entry, charge: charge, deleter: deleter})
+	return this
+}
+
+func (this *Txn) Remove(key []byte) *Txn {
+	this.ops = append(this.ops, txnOp{kind: txnRemove, key: key})
+	return this
+}
+
+func (this *Txn) Merge(key []byte, entry interface{}, charge uint64, merge_opt MergeOperator, charge_opt ChargeOperator) *Txn {
+	this.ops = append(this.ops, txnOp{kind: txnMerge, key: key, entry: entry, charge: charge, merge: merge_opt, charge_opt: charge_opt})
+	return this
+}
+
+/**
+IfVersion make Commit fail with ErrTxnConflict unless key has version when the
+transaction start (see LookupVersioned); 0 means key must be missing
+*/
+func (this *Txn) IfVersion(key []byte, version uint64) *Txn {
+	this.ops = append(this.ops, txnOp{kind: txnCheck, key: key, version: version})
+	return this
+}
+
+/**
+Commit lock shards of all keys in index order, check conditions and run merges
+on a copy of the entries, then write the results. operators run with shards
+locked and must not use the cache
+*/
+func (this *Txn) Commit() error {
+	cache := this.cache
+	keys := make(map[string]*txnKey)
+	var order []*txnKey
+	var shards []int
+	for _, op := range this.ops {
+		if _, ok := keys[string(op.key)]; ok {
+			continue
+		}
+		hash := HashSlice(op.key)
+		index := int(cache.shard(hash))
+		state := &txnKey{key: op.key, hash: hash, shard: cache.shards[index]}
+		keys[string(op.key)] = state
+		order = append(order, state)
+		shards = append(shards, index)
+	}
+	sort.Ints(shards)
+
+	cache.txn_mutex.RLock()
+	defer cache.txn_mutex.RUnlock()
+	for i, index := range shards {
+		if i == 0 || index != shards[i-1] {
+			cache.shards[index].mutex.Lock()
+			defer cache.shards[index].unlock()
+		}
+	}
+
+	for _, state := range order {
+		if e := state.shard.versioned_handle(state.key, state.hash); e != nil {
+			state.version = e.version
+			state.exists = true
+			state.entry = e.entry
+			state.charge = state.shard.user_charge(e)
+			state.deleter = e.deleter
+		}
+	}
+
+	// nothing is written until every op passed
+	for _, op := range this.ops {
+		state := keys[string(op.key)]
+		switch op.kind {
+		case txnCheck:
+			if state.version != op.version {
+				return ErrTxnConflict
+			}
+		case txnInsert:
+			state.entry, state.charge, state.deleter = op.entry, op.charge, op.deleter
+			state.exists, state.changed = true, true
+		case txnRemove:
+			state.entry, state.charge, state.deleter = nil, 0, nil
+			state.exists, state.changed = false, true
+		case txnMerge:
+			var old interface{}
+			var old_charge uint64
+			if state.exists {
+				old, old_charge = state.entry, state.charge
+			}
+			state.entry = op.merge(old, op.entry)
+			state.charge = op.charge_opt(op.entry, old_charge, op.charge)
+			state.exists, state.changed = true, true
+		}
+	}
+
+	for _, state := range order {
+		if !state.changed {
+			continue
+		}
+		if state.exists {
+			state.shard.invalidate_lease(state.key, nil)
+			state.shard.insert(state.key, state.hash, state.entry, state.charge, state.deleter)
+		} else {
+			state.shard.invalidate_lease(state.key, state.shard.lru_remove(state.key, state.hash))
+		}
+	}
+	return nil
+}
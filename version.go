@@ -0,0 +1,114 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+/*********** LRUCache *************/
+
+/**
+LookupVersioned is Lookup which also return version of entry; every insert of key,
+Merge and Compute too, give it a new version from NewId. 0 means key is missing,
+tombstones are missing too
+*/
+func (this *LRUCache) LookupVersioned(key []byte) (interface{}, uint64) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].LookupVersioned(key, hash);
+}
+
+/**
+CompareAndSwap insert entry only if version of key is still expected, 0 expect
+key to be missing. return new version, or current one and false
+*/
+func (this *LRUCache) CompareAndSwap(key []byte, expected uint64, entry interface{}, charge uint64) (uint64, bool) {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].CompareAndSwap(key, hash, expected, entry, charge);
+}
+
+/**
+CompareAndDelete remove key only if its version is still expected
+*/
+func (this *LRUCache) CompareAndDelete(key []byte, expected uint64) bool {
+	hash := HashSlice(key);
+	return this.shards[this.shard(hash)].CompareAndDelete(key, hash, expected);
+}
+
+/*********** LRUCacheShard *************/
+
+func (this *LRUCacheShard) LookupVersioned(key []byte, hash uint32) (interface{}, uint64) {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.versioned_handle(key, hash)
+	if e == nil {
+		return nil, 0
+	}
+	this.record_access(key)
+	return e.entry, e.version
+}
+
+/**
+swapped entry keep deleter of the old one
+*/
+func (this *LRUCacheShard) CompareAndSwap(key []byte, hash uint32, expected uint64, entry interface{}, charge uint64) (uint64, bool) {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.versioned_handle(key, hash)
+	var deleter DeleteCallback = nil
+	if e != nil {
+		if e.version != expected {
+			return e.version, false
+		}
+		deleter = e.deleter
+	} else if expected != 0 {
+		return 0, false
+	}
+	this.invalidate_lease(key, nil)
+	version, err := this.insert_handle(key, hash, entry, charge, deleter, false)
+	if err != nil {
+		// not cached, e.g. capacity is 0
+		return 0, false
+	}
+	return version, true
+}
+
+func (this *LRUCacheShard) CompareAndDelete(key []byte, hash uint32, expected uint64) bool {
+	this.mutex.Lock();
+	defer this.unlock()
+	e := this.versioned_handle(key, hash)
+	if e == nil || e.version != expected {
+		return false
+	}
+	this.invalidate_lease(key, this.lru_remove(key, hash))
+	return true
+}
+
+/**
+versioned_handle find live handle of key, promoting it from secondary cache;
+a tombstone is a missing key, of version 0
+*/
+func (this *LRUCacheShard) versioned_handle(key []byte, hash uint32) *LRUHandle {
+	e := this.handle_lookup_update(key, hash)
+	if e != nil {
+		if !this.live_handle(e) || isTombstone(e.entry) {
+			return nil
+		}
+		return e
+	}
+	if this.secondary_promote(key, hash) == nil {
+		return nil
+	}
+	return this.handle_lookup(key, hash)
+}
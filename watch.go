@@ -0,0 +1,287 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultWatchBuffer = 64
+
+type EventType int
+
+const (
+	EventInserted EventType = iota
+	EventReplaced
+	EventMerged
+	EventRemoved // by Remove, Prune, or a delete of Compute or Txn
+	EventEvicted
+	EventExpired // tombstone expired
+)
+
+/**
+Event is a change of a watched key. Entry is the new entry of inserted, replaced
+and merged, the old one of removed, evicted and expired
+*/
+type Event struct {
+	Type    EventType
+	Key     []byte
+	Entry   interface{}
+	Version uint64
+}
+
+// what a full watch buffer do with a new event
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota
+	DropOldest
+	// close the watch; watcher know it missed events and should read the cache again
+	CloseOnOverflow
+)
+
+type WatchOptions struct {
+	Buffer   int // events buffered for a slow watcher, default 64
+	Overflow OverflowPolicy
+	// events are given to Callback in a goroutine of the watch instead of channel C
+	Callback func(event Event)
+}
+
+/**
+Watch receive events of a key or key prefix from C, in order of changes of a key.
+events are sent after shard is unlocked, never blocking the cache:
+when buffer is full they are dropped by Overflow policy.
+*/
+type Watch struct {
+	C <-chan Event
+
+	key      []byte
+	prefix   bool
+	options  WatchOptions
+	registry *watchRegistry
+
+	mutex      sync.Mutex
+	events     chan Event
+	closed     bool
+	overflowed bool
+	dropped    uint64
+}
+
+/**
+Watch key; Close the watch when it's not needed
+*/
+func (this *LRUCache) Watch(key []byte, options WatchOptions) *Watch {
+	return this.watches.add(key, false, options)
+}
+
+/**
+WatchPrefix watch every key start with prefix
+*/
+func (this *LRUCache) WatchPrefix(prefix []byte, options WatchOptions) *Watch {
+	return this.watches.add(prefix, true, options)
+}
+
+/**
+Close stop the watch and close C; events already buffered can still be read
+*/
+func (this *Watch) Close() {
+	this.registry.remove(this)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.closed {
+		this.closed = true
+		close(this.events)
+	}
+}
+
+// number of events dropped by overflow policy
+func (this *Watch) Dropped() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// whether the watch was closed by CloseOnOverflow
+func (this *Watch) Overflowed() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.overflowed
+}
+
+func (this *Watch) deliver(event Event) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return
+	}
+	for {
+		select {
+		case this.events <- event:
+			return
+		default:
+		}
+		switch this.options.Overflow {
+		case DropOldest:
+			select {
+			case <-this.events:
+				atomic.AddUint64(&this.dropped, 1)
+			default:
+			}
+		case CloseOnOverflow:
+			atomic.AddUint64(&this.dropped, 1)
+			this.overflowed = true
+			this.closed = true
+			close(this.events)
+			this.registry.remove(this)
+			return
+		default:
+			atomic.AddUint64(&this.dropped, 1)
+			return
+		}
+	}
+}
+
+/*********** watch registry *************/
+
+/**
+watchRegistry is shared by shards of a cache
+*/
+type watchRegistry struct {
+	count    int32 // watches registered, read without lock
+	mutex    sync.RWMutex
+	keys     map[string][]*Watch
+	prefixes []*Watch
+}
+
+func newWatchRegistry() *watchRegistry {
+	return &watchRegistry{keys: make(map[string][]*Watch)}
+}
+
+func (this *watchRegistry) add(key []byte, prefix bool, options WatchOptions) *Watch {
+	if options.Buffer <= 0 {
+		options.Buffer = defaultWatchBuffer
+	}
+	watch := &Watch{
+		key:      append([]byte(nil), key...),
+		prefix:   prefix,
+		options:  options,
+		registry: this,
+		events:   make(chan Event, options.Buffer),
+	}
+	if options.Callback != nil {
+		go func() {
+			for event := range watch.events {
+				options.Callback(event)
+			}
+		}()
+	} else {
+		watch.C = watch.events
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if prefix {
+		this.prefixes = append(this.prefixes, watch)
+	} else {
+		this.keys[string(key)] = append(this.keys[string(key)], watch)
+	}
+	atomic.AddInt32(&this.count, 1)
+	return watch
+}
+
+func (this *watchRegistry) remove(watch *Watch) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	list := this.prefixes
+	if !watch.prefix {
+		list = this.keys[string(watch.key)]
+	}
+	for i, w := range list {
+		if w == watch {
+			list = append(list[:i:i], list[i+1:]...)
+			atomic.AddInt32(&this.count, -1)
+			break
+		}
+	}
+	switch {
+	case watch.prefix:
+		this.prefixes = list
+	case len(list) == 0:
+		delete(this.keys, string(watch.key))
+	default:
+		this.keys[string(watch.key)] = list
+	}
+}
+
+func (this *watchRegistry) match(key []byte) []*Watch {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	watches := this.keys[string(key)]
+	for _, w := range this.prefixes {
+		if bytes.HasPrefix(key, w.key) {
+			watches = append(watches[:len(watches):len(watches)], w)
+		}
+	}
+	return watches
+}
+
+/*********** LRUCacheShard *************/
+
+type pendingEvent struct {
+	event   Event
+	watches []*Watch
+}
+
+/**
+emit queue event of e for watches of its key; they are sent by unlock
+*/
+func (this *LRUCacheShard) emit(event_type EventType, e *LRUHandle) {
+	if this.watches == nil || atomic.LoadInt32(&this.watches.count) == 0 {
+		return
+	}
+	watches := this.watches.match(e.key)
+	if len(watches) == 0 {
+		return
+	}
+	entry, _ := this.handle_value(e)
+	this.events = append(this.events, pendingEvent{
+		event:   Event{Type: event_type, Key: append([]byte(nil), e.key...), Entry: entry, Version: e.version},
+		watches: watches,
+	})
+}
+
+/**
+unlock shard, then send events queued while it was locked. dispatch_mutex is
+taken before unlock, so events of the next holder are sent after ours
+*/
+func (this *LRUCacheShard) unlock() {
+	if len(this.events) == 0 {
+		this.mutex.Unlock()
+		return
+	}
+	events := this.events
+	this.events = nil
+	this.dispatch_mutex.Lock()
+	this.mutex.Unlock()
+	for _, pending := range events {
+		for _, watch := range pending.watches {
+			watch.deliver(pending.event)
+		}
+	}
+	this.dispatch_mutex.Unlock()
+}
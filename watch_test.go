@@ -0,0 +1,185 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lrucache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, watch *Watch) Event {
+	select {
+	case event, ok := <-watch.C:
+		if !ok {
+			t.Fatalf("watch closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("no event")
+	}
+	return Event{}
+}
+
+func TestWatch_Key(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 2)
+	key := []byte("key")
+	watch := lru.Watch(key, WatchOptions{})
+	defer watch.Close()
+
+	lru.Insert(key, 1, 8, nil)
+	lru.Insert([]byte("other"), 1, 8, nil)
+	lru.Insert(key, 2, 8, nil)
+	lru.Merge(key, 3, 8, IntMergeOperator, IntChargeOperator)
+	_, version := lru.LookupVersioned(key)
+	lru.Remove(key)
+
+	expected := []Event{
+		{Type: EventInserted, Entry: 1},
+		{Type: EventReplaced, Entry: 2},
+		{Type: EventMerged, Entry: 5},
+		{Type: EventRemoved, Entry: 5, Version: version},
+	}
+	for _, e := range expected {
+		event := receive(t, watch)
+		if event.Type != e.Type || event.Entry != e.Entry || string(event.Key) != "key" {
+			t.Errorf("expected %+v, got %+v", e, event)
+		}
+		if e.Version != 0 && event.Version != e.Version {
+			t.Errorf("removed event version %d, expected %d", event.Version, e.Version)
+		}
+	}
+	select {
+	case event := <-watch.C:
+		t.Errorf("unexpected event: %+v", event)
+	default:
+	}
+
+	// closed watch get nothing
+	watch.Close()
+	lru.Insert(key, 1, 8, nil)
+	if _, ok := <-watch.C; ok {
+		t.Errorf("closed watch should get no event")
+	}
+}
+
+func TestWatch_PrefixCallback(t *testing.T) {
+	lru := NewLRUCache(100, 0)
+	var mutex sync.Mutex
+	var events []Event
+	watch := lru.WatchPrefix([]byte("user:"), WatchOptions{Callback: func(event Event) {
+		// cache is unlocked when events are given
+		lru.Lookup(event.Key)
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}})
+	defer watch.Close()
+
+	for i := 0; i < 3; i++ {
+		lru.Insert([]byte("user:"+strconv.Itoa(i)), i, 40, nil)
+	}
+	lru.Insert([]byte("post:1"), 1, 10, nil)
+	lru.SetNegativeCaching(NegativeCacheOptions{NotFoundTTL: 5 * time.Millisecond, Charge: 4})
+	lru.InsertNotFound([]byte("user:9"))
+	time.Sleep(10 * time.Millisecond)
+	lru.Lookup([]byte("user:9"))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mutex.Lock()
+		n := len(events)
+		mutex.Unlock()
+		if n >= 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	var types []EventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	// user:2 evict user:0, then the tombstone fill cache up and expire
+	expected := []EventType{EventInserted, EventInserted, EventInserted, EventEvicted, EventInserted, EventExpired}
+	if len(types) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, types)
+		}
+	}
+	if string(events[3].Key) != "user:0" || events[3].Entry != 0 {
+		t.Errorf("evicted event of user:0 expected, got %+v", events[3])
+	}
+	if _, ok := events[4].Entry.(*Tombstone); !ok || string(events[5].Key) != "user:9" {
+		t.Errorf("expected tombstone of user:9, got %+v", events[4])
+	}
+}
+
+func TestWatch_Overflow(t *testing.T) {
+	lru := NewLRUCache(1024*1024, 1)
+	key := []byte("key")
+	newest := lru.Watch(key, WatchOptions{Buffer: 2})
+	oldest := lru.Watch(key, WatchOptions{Buffer: 2, Overflow: DropOldest})
+	closing := lru.Watch(key, WatchOptions{Buffer: 2, Overflow: CloseOnOverflow})
+	defer newest.Close()
+	defer oldest.Close()
+
+	for i := 0; i < 5; i++ {
+		lru.Insert(key, i, 8, nil)
+	}
+	if first, second := receive(t, newest), receive(t, newest); first.Entry != 0 || second.Entry != 1 || newest.Dropped() != 3 {
+		t.Errorf("DropNewest kept %v %v, dropped %d", first.Entry, second.Entry, newest.Dropped())
+	}
+	if first, second := receive(t, oldest), receive(t, oldest); first.Entry != 3 || second.Entry != 4 || oldest.Dropped() != 3 {
+		t.Errorf("DropOldest kept %v %v, dropped %d", first.Entry, second.Entry, oldest.Dropped())
+	}
+	receive(t, closing)
+	receive(t, closing)
+	if _, ok := <-closing.C; ok || !closing.Overflowed() {
+		t.Errorf("watch should be closed on overflow")
+	}
+	closing.Close()
+}
+
+func TestWatch_LoadingCacheRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	loader := &testLoader{}
+	cache := NewLoadingCache(NewLRUCache(1024*1024, 1), loader.load,
+		LoadingOptions{SoftTTL: 10 * time.Second, Now: clock.Now})
+	key := []byte("k")
+	watch := cache.Cache().Watch(key, WatchOptions{})
+	defer watch.Close()
+
+	cache.Get(key)
+	if event := receive(t, watch); event.Type != EventInserted {
+		t.Errorf("load expected inserted event, got: %+v", event)
+	}
+	clock.Advance(15 * time.Second)
+	cache.Get(key)
+	// refresh is the last op of the shard, its event must not wait for another one
+	cache.Close()
+	event := receive(t, watch)
+	if e, ok := event.Entry.(*loadedEntry); event.Type != EventReplaced || !ok || e.value != "k-2" {
+		t.Errorf("refresh expected replaced event of k-2, got: %+v", event)
+	}
+}